@@ -0,0 +1,36 @@
+$(function() {
+
+  var callTable = $('#calls').dataTable({
+    "data": [],
+    "iDisplayLength": 5,
+    "bLengthChange": false,
+    "oLanguage": { "sSearch": "" },
+    "order": [[ 0, "desc" ]],
+    "columns": [
+        { "data": "id" },
+        { "data": "created_at" },
+        { "data": "mobile",
+          "mRender": function( data, type, full ) {
+            return data ? data : "unknown";
+          },
+          bUseRendered: false
+        },
+        { "data": "device" }
+    ]
+  });
+
+  var loadData = function() {
+    $.ajax({
+      url: "/api/calls/"
+    })
+    .done(function(logs) {
+      if(!logs.calls) {
+        return
+      }
+      callTable.fnClearTable(logs.calls);
+      callTable.fnAddData(logs.calls);
+    })
+  };
+
+  loadData();
+});
@@ -0,0 +1,133 @@
+$(function() {
+  var Registration = ["Not registered", "Home", "Searching", "Denied", "Unknown", "Roaming"]
+
+  var deviceTable = $('#devices').dataTable({
+    "data": [],
+    "paging": false,
+    "searching": false,
+    "info": false,
+    "columns": [
+        { "data": "device",
+          "mRender": function( data, type, full ) {
+            if(full.online) {
+              return data;
+            }
+            var reason = full.reason ? ": " + $("<div>").text(full.reason).html() : "";
+            return data + " <small>(offline" + reason + ")</small>";
+          },
+          bUseRendered: false
+        },
+        { "data": "status.operator", "defaultContent": "" },
+        { "data": "status.registration", "defaultContent": "",
+          "mRender": function( data, type, full ) {
+            if(!full.status) {
+              return "";
+            }
+            return Registration[data] || data;
+          },
+          bUseRendered: false
+        },
+        { "data": "status.signal", "defaultContent": "",
+          "mRender": function( data, type, full ) {
+            if(!full.status) {
+              return "";
+            }
+            if(data > 31) {
+              return "unknown";
+            }
+            return (-113 + 2 * data) + " dBm";
+          },
+          bUseRendered: false
+        },
+        { "data": "status.sim", "defaultContent": "" },
+        { "data": "status.imei", "defaultContent": "" },
+        { "data": "status.imsi", "defaultContent": "" },
+        { "data": "status.created_at", "defaultContent": "" },
+        { "data": "storage.used", "defaultContent": "",
+          "mRender": function( data, type, full ) {
+            if(!full.storage) {
+              return "";
+            }
+            var text = data + " / " + full.storage.total + " <small>" + full.storage.storage + "</small>";
+            if(full.storage.total > 0 && data >= full.storage.total) {
+              return "<strong>" + text + " full</strong>";
+            }
+            return text;
+          },
+          bUseRendered: false
+        },
+        { "data": "usage.day", "defaultContent": "",
+          "mRender": function( data, type, full ) {
+            if(!full.usage) {
+              return "";
+            }
+            var quota = function(sent, limit, period) {
+              var text = sent + (limit > 0 ? " / " + limit : "") + " <small>" + period + "</small>";
+              if(limit > 0 && sent >= limit) {
+                return "<strong>" + text + " quota used up</strong>";
+              }
+              return text;
+            };
+            var text = quota(data, full.usage.day_limit, "today") + "<br>" + quota(full.usage.month, full.usage.month_limit, "this month");
+            if(full.usage.minute_limit > 0) {
+              text += "<br>" + full.usage.minute + " / " + full.usage.minute_limit + " <small>last minute</small>";
+            }
+            return text;
+          },
+          bUseRendered: false
+        },
+        { "data": "balance.text", "defaultContent": "",
+          "mRender": function( data, type, full ) {
+            if(!full.balance) {
+              return "";
+            }
+            return $("<div>").text(data).html() + " <small>" + full.balance.created_at + "</small>";
+          },
+          bUseRendered: false
+        }
+    ]
+  });
+
+  var loadData = function() {
+    $.ajax({
+      url: "/api/devices/"
+    })
+    .done(function(resp) {
+      if(!resp.devices) {
+        return
+      }
+      deviceTable.fnClearTable(resp.devices);
+      deviceTable.fnAddData(resp.devices);
+    })
+    .done(function(resp) {
+      // Signal history, oldest sample first
+      var series = []
+      var devices = resp.devices || [];
+      for(var i = 0;i < devices.length;i++) {
+        var history = devices[i].history || [];
+        var data = []
+        for(var j = history.length - 1;j >= 0;j--) {
+          var signal = history[j].signal > 31 ? null : history[j].signal;
+          data.push([ moment(history[j].created_at).format("HH:mm"), signal ])
+        }
+        series.push({ label: devices[i].device, data: data })
+      }
+      $.plot("#signalChart", series, {
+        series: {
+          lines: { show: true },
+          points: { show: true }
+        },
+        xaxis: {
+          mode: "categories",
+          tickLength: 0
+        },
+        yaxis: {
+          min: 0,
+          max: 31
+        }
+      });
+    })
+  };
+
+  loadData();
+});
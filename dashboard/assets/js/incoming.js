@@ -8,9 +8,25 @@ $(function() {
     "order": [[ 0, "desc" ]],
     "columns": [
         { "data": "id" },
-        { "data": "created_at" },
-        { "data": "mobile" },
-        { "data": "body" }
+        { "data": "created_at",
+          "mRender": function( data, type, full ) {
+            // time stamp of service centre, read time for older messages
+            return full.sent_at ? moment(full.sent_at).format("YYYY-MM-DD HH:mm:ss") : data;
+          },
+          bUseRendered: false
+        },
+        { "data": "mobile",
+          "mRender": function( data, type, full ) {
+            return full.name ? $("<div>").text(full.name).html() + " <small>" + data + "</small>" : data;
+          },
+          bUseRendered: false
+        },
+        { "data": "body",
+          "mRender": function( data, type, full ) {
+            return full.partial ? data + " (incomplete)" : data;
+          },
+          bUseRendered: false
+        }
     ]
   });
   
@@ -1,5 +1,5 @@
 $(function() {
-  var SMSStatus = ["Pending", "Processed", "Error"]
+  var SMSStatus = ["Pending", "Processed", "Error", "Delivered", "Expired", "Rejected"]
 
   // SMS Log Table
   var logTable = $('#smsdata').dataTable({
@@ -15,6 +15,12 @@ $(function() {
         { "data": "body" },
         { "data": "status",
           "mRender": function( data, type, full ) {
+            if(full.delivered_at) {
+              return SMSStatus[data] + " <small>" + full.delivered_at + "</small>";
+            }
+            if(full.error) {
+              return SMSStatus[data] + " <small>" + $("<div>").text(full.error).html() + "</small>";
+            }
             return SMSStatus[data];
           },
           bUseRendered: false
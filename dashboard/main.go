@@ -1,12 +1,20 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/haxpax/gosms"
 	"github.com/haxpax/gosms/modem"
+	_ "github.com/haxpax/gosms/modem/simulator"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -24,7 +32,6 @@ func main() {
 		log.Println("main: ", "Error initializing database: ", err, " Aborting")
 		os.Exit(1)
 	}
-	defer db.Close()
 
 	serverhost, _ := appConfig.Get("SETTINGS", "SERVERHOST")
 	serverport, _ := appConfig.Get("SETTINGS", "SERVERPORT")
@@ -56,42 +63,218 @@ func main() {
 		Recipient: smtprecipient,
 	}
 
+	options := gosms.DefaultOptions()
+	options.DB = db
+	options.SMTP = &smtp
+
 	_numDevices, _ := appConfig.Get("SETTINGS", "DEVICES")
 	numDevices, _ := strconv.Atoi(_numDevices)
 	log.Println("main: number of devices: ", numDevices)
 
 	var modems []*modem.Driver
+	weights := map[string]int{}
+	groups := map[string][]string{}
 	for i := 0; i < numDevices; i++ {
 		dev := fmt.Sprintf("DEVICE%v", i)
 		_port, _ := appConfig.Get(dev, "COMPORT")
-		_baud := 115200 //appConfig.Get(dev, "BAUDRATE")
+		_baud := 115200
+		if _baudRate, _ := appConfig.Get(dev, "BAUDRATE"); _baudRate != "" {
+			if baudRate, err := strconv.Atoi(strings.TrimSpace(_baudRate)); err == nil && baudRate > 0 {
+				_baud = baudRate
+			}
+		}
 		_devid, _ := appConfig.Get(dev, "DEVID")
 		m := modem.New(_port, _baud, _devid)
+		if _mode, _ := appConfig.Get(dev, "MODE"); strings.ToUpper(strings.TrimSpace(_mode)) == "PDU" {
+			m.Mode = modem.PDUMode
+		}
+		if _concatRef, _ := appConfig.Get(dev, "CONCATREF"); strings.TrimSpace(_concatRef) == "16" {
+			m.Concat16 = true
+		}
+		_statusReports, _ := appConfig.Get(dev, "STATUSREPORTS")
+		m.StatusReports = strings.TrimSpace(_statusReports) != "0"
+		if _balanceUSSD, _ := appConfig.Get(dev, "BALANCEUSSD"); strings.TrimSpace(_balanceUSSD) != "" {
+			check := gosms.BalanceCheck{Code: strings.TrimSpace(_balanceUSSD), Interval: 24 * time.Hour}
+			if _balanceInterval, _ := appConfig.Get(dev, "BALANCEINTERVAL"); strings.TrimSpace(_balanceInterval) != "" {
+				balanceInterval, _ := strconv.Atoi(strings.TrimSpace(_balanceInterval))
+				check.Interval = time.Duration(balanceInterval) * time.Minute
+			}
+			options.BalanceChecks[_devid] = check
+		}
+		if _pin, _ := appConfig.Get(dev, "PIN"); strings.TrimSpace(_pin) != "" {
+			m.PIN = strings.TrimSpace(_pin)
+		}
+		if _weight, _ := appConfig.Get(dev, "WEIGHT"); strings.TrimSpace(_weight) != "" {
+			weight, err := strconv.Atoi(strings.TrimSpace(_weight))
+			if err != nil || weight < 0 {
+				log.Println("main: ", "Invalid config: ", dev, "WEIGHT must be 0 or more", " Aborting")
+				os.Exit(1)
+			}
+			weights[_devid] = weight
+		}
+		limits := gosms.DeviceLimits{}
+		for key, limit := range map[string]*int{"RATELIMIT": &limits.PerMinute, "DAILYLIMIT": &limits.PerDay, "MONTHLYLIMIT": &limits.PerMonth} {
+			if _limit, _ := appConfig.Get(dev, key); strings.TrimSpace(_limit) != "" {
+				value, err := strconv.Atoi(strings.TrimSpace(_limit))
+				if err != nil || value < 0 {
+					log.Println("main: ", "Invalid config: ", dev, key, "must be 0 or more", " Aborting")
+					os.Exit(1)
+				}
+				*limit = value
+			}
+		}
+		options.Limits[_devid] = limits
+		if _group, _ := appConfig.Get(dev, "GROUP"); strings.TrimSpace(_group) != "" {
+			for _, group := range strings.Split(_group, ",") {
+				if group = strings.TrimSpace(group); group != "" {
+					groups[group] = append(groups[group], _devid)
+				}
+			}
+		}
+		if _storage, _ := appConfig.Get(dev, "STORAGE"); strings.TrimSpace(_storage) != "" {
+			m.Storage = strings.ToUpper(strings.TrimSpace(_storage))
+		}
+		if _profile, _ := appConfig.Get(dev, "PROFILE"); strings.TrimSpace(_profile) != "" && strings.ToLower(strings.TrimSpace(_profile)) != "auto" {
+			profile, err := modem.LookupProfile(_profile)
+			if err != nil {
+				log.Println("main: ", "Invalid config: ", dev, err.Error(), " Aborting")
+				os.Exit(1)
+			}
+			m.Profile = profile
+		}
 		modems = append(modems, m)
 	}
+	options.Drivers = modems
+	options.Groups = groups
+
+	_numRoutes, _ := appConfig.Get("SETTINGS", "ROUTES")
+	numRoutes, _ := strconv.Atoi(strings.TrimSpace(_numRoutes))
+	for i := 0; i < numRoutes; i++ {
+		section := fmt.Sprintf("ROUTE%v", i)
+		_prefix, _ := appConfig.Get(section, "PREFIX")
+		_pattern, _ := appConfig.Get(section, "REGEX")
+		_target, _ := appConfig.Get(section, "TARGET")
+		route := gosms.Route{Prefix: strings.TrimSpace(_prefix), Target: strings.TrimSpace(_target), Fallback: true}
+		if strings.TrimSpace(_pattern) != "" {
+			pattern, err := regexp.Compile(strings.TrimSpace(_pattern))
+			if err != nil {
+				log.Println("main: ", "Invalid config: ", section, err.Error(), " Aborting")
+				os.Exit(1)
+			}
+			route.Pattern = pattern
+		}
+		if _fallback, _ := appConfig.Get(section, "FALLBACK"); strings.TrimSpace(_fallback) == "0" {
+			route.Fallback = false
+		}
+		options.Routes = append(options.Routes, route)
+	}
+
+	if _selector, ok := appConfig.Get("SETTINGS", "SELECTOR"); ok && strings.TrimSpace(_selector) != "" {
+		selector, err := gosms.LookupSelector(_selector, weights)
+		if err != nil {
+			log.Println("main: ", "Invalid config: ", err.Error(), " Aborting")
+			os.Exit(1)
+		}
+		options.Selector = selector
+	}
 
 	_bufferSize, _ := appConfig.Get("SETTINGS", "BUFFERSIZE")
-	bufferSize, _ := strconv.Atoi(_bufferSize)
+	options.BufferSize, _ = strconv.Atoi(_bufferSize)
 
 	_bufferLow, _ := appConfig.Get("SETTINGS", "BUFFERLOW")
-	bufferLow, _ := strconv.Atoi(_bufferLow)
+	options.BufferLow, _ = strconv.Atoi(_bufferLow)
 
 	_loaderTimeout, _ := appConfig.Get("SETTINGS", "MSGTIMEOUT")
 	loaderTimeout, _ := strconv.Atoi(_loaderTimeout)
+	options.LoaderTimeout = time.Duration(loaderTimeout) * time.Minute
 
 	_loaderCountout, _ := appConfig.Get("SETTINGS", "MSGCOUNTOUT")
-	loaderCountout, _ := strconv.Atoi(_loaderCountout)
+	options.LoaderCountout, _ = strconv.Atoi(_loaderCountout)
 
 	_loaderTimeoutLong, _ := appConfig.Get("SETTINGS", "MSGTIMEOUTLONG")
 	loaderTimeoutLong, _ := strconv.Atoi(_loaderTimeoutLong)
+	options.LoaderLongTimeout = time.Duration(loaderTimeoutLong) * time.Minute
+
+	if _pollInterval, ok := appConfig.Get("SETTINGS", "POLLINTERVAL"); ok {
+		pollInterval, _ := strconv.Atoi(_pollInterval)
+		options.PollInterval = time.Duration(pollInterval) * time.Second
+	}
+
+	if _healthInterval, ok := appConfig.Get("SETTINGS", "HEALTHINTERVAL"); ok {
+		healthInterval, _ := strconv.Atoi(_healthInterval)
+		options.HealthInterval = time.Duration(healthInterval) * time.Second
+	}
+
+	if _reconnectMaxDelay, ok := appConfig.Get("SETTINGS", "RECONNECTMAXDELAY"); ok {
+		if reconnectMaxDelay, _ := strconv.Atoi(_reconnectMaxDelay); reconnectMaxDelay > 0 {
+			options.ReconnectMaxDelay = time.Duration(reconnectMaxDelay) * time.Second
+		}
+	}
+
+	if _partTimeout, ok := appConfig.Get("SETTINGS", "PARTTIMEOUT"); ok {
+		partTimeout, _ := strconv.Atoi(_partTimeout)
+		options.IncomingPartTimeout = time.Duration(partTimeout) * time.Minute
+	}
+
+	if _storageAlert, ok := appConfig.Get("SETTINGS", "STORAGEALERT"); ok {
+		options.StorageAlertLevel, _ = strconv.Atoi(strings.TrimSpace(_storageAlert))
+	}
 
-	log.Println("main: Initializing worker")
-	gosms.InitWorker(modems, bufferSize, bufferLow, loaderTimeout, loaderCountout, loaderTimeoutLong, &smtp)
+	if _callReply, ok := appConfig.Get("SETTINGS", "CALLREPLY"); ok {
+		options.CallReply = strings.TrimSpace(_callReply)
+	}
+
+	shutdownTimeout := 30 * time.Second
+	if _shutdownTimeout, ok := appConfig.Get("SETTINGS", "SHUTDOWNTIMEOUT"); ok {
+		if timeout, _ := strconv.Atoi(strings.TrimSpace(_shutdownTimeout)); timeout > 0 {
+			shutdownTimeout = time.Duration(timeout) * time.Second
+		}
+	}
+
+	log.Println("main: Initializing gateway")
+	gateway := gosms.NewGateway(options)
+	if err = gateway.Start(context.Background()); err != nil {
+		log.Println("main: ", "Error starting gateway: ", err, " Aborting")
+		db.Close()
+		os.Exit(1)
+	}
 
 	log.Println("main: Initializing server")
-	err = InitServer(serverhost, serverport, serverusername, serverpassword)
-	if err != nil {
+	server := InitServer(gateway, serverhost, serverport, serverusername, serverpassword)
+	serverErrors := make(chan error, 1)
+	go func() {
+		serverErrors <- server.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	exitCode := 0
+	select {
+	case sig := <-signals:
+		log.Println("main: ", "Received ", sig, ", shutting down")
+	case err := <-serverErrors:
 		log.Println("main: ", "Error starting server: ", err.Error(), " Aborting")
-		os.Exit(1)
+		exitCode = 1
+	}
+
+	// API stops first so no new messages come while devices finish theirs
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil && err != http.ErrServerClosed {
+		log.Println("main: ", "Error stopping server: ", err)
+	}
+	if err := gateway.Shutdown(ctx); err != nil {
+		log.Println("main: ", "Error stopping gateway: ", err)
+		exitCode = 1
+	}
+	if err := db.Close(); err != nil {
+		log.Println("main: ", "Error closing database: ", err)
+		exitCode = 1
+	}
+
+	log.Println("main: ", "Stopped")
+	if exitCode != 0 {
+		os.Exit(exitCode)
 	}
 }
@@ -4,12 +4,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/haxpax/gosms"
+	"github.com/haxpax/gosms/modem"
 	"github.com/gorilla/mux"
 	"github.com/satori/go.uuid"
 	"html/template"
 	"log"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"encoding/base64"
 )
@@ -36,9 +38,38 @@ type IncomingSMSDataResponse struct {
 	Messages []gosms.IncomingSMS    `json:"messages"`
 }
 
+//response structure to /calls/
+type CallsDataResponse struct {
+	Status  int                  `json:"status"`
+	Message string               `json:"message"`
+	Calls   []gosms.IncomingCall `json:"calls"`
+}
+
+//response structure to /devices/
+type DevicesDataResponse struct {
+	Status  int                `json:"status"`
+	Message string             `json:"message"`
+	Devices []gosms.DeviceInfo `json:"devices"`
+}
+
+//response structure to /devices/{id}/ussd
+type USSDDataResponse struct {
+	Status  int         `json:"status"`
+	Message string      `json:"message"`
+	USSD    *USSDResult `json:"ussd,omitempty"`
+}
+
+type USSDResult struct {
+	Status int    `json:"status"`
+	Text   string `json:"text"`
+	More   bool   `json:"more"`
+}
+
 // Cache templates
 var templates = template.Must(template.ParseFiles("./templates/index.html"))
 
+var gateway *gosms.Gateway
+
 var authUsername string
 var authPassword string
 
@@ -71,30 +102,96 @@ func sendSMSHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("--- sendSMSHandler")
 	w.Header().Set("Content-type", "application/json")
 
-	//TODO: validation
 	r.ParseForm()
 	mobile := r.FormValue("mobile")
 	message := r.FormValue("message")
-	newUuid := uuid.NewV1()
-	sms := &gosms.OutgoingSMS{UUID: newUuid.String(), Mobile: mobile, Body: message, Retries: 0}
-	gosms.SendMessage(sms)
 
 	smsresp := OutgoingSMSResponse{Status: 200, Message: "ok"}
+	newUuid := uuid.NewV1()
+	sms := &gosms.OutgoingSMS{UUID: newUuid.String(), Body: message, Retries: 0}
+	if address, err := modem.ParseAddress(mobile); err != nil {
+		smsresp = OutgoingSMSResponse{Status: 400, Message: err.Error()}
+	} else if address.Kind == modem.AddressAlphanumeric {
+		smsresp = OutgoingSMSResponse{Status: 400, Message: "mobile must be a number: " + mobile}
+	} else if err := parseSendOptions(r, sms); err != nil {
+		smsresp = OutgoingSMSResponse{Status: 400, Message: err.Error()}
+	} else if err := parseTarget(r, sms); err != nil {
+		smsresp = OutgoingSMSResponse{Status: 400, Message: err.Error()}
+	} else {
+		sms.Mobile = address.String()
+		if err := gateway.SendMessage(sms); err != nil {
+			log.Println("DB error: ", err)
+			smsresp = OutgoingSMSResponse{Status: 500, Message: err.Error()}
+		}
+	}
+
 	var toWrite []byte
 	toWrite, err := json.Marshal(smsresp)
 	if err != nil {
 		log.Println(err)
 		//lets just depend on the server to raise 500
 	}
+	w.WriteHeader(smsresp.Status)
 	w.Write(toWrite)
 }
 
+// parseSendOptions reads optional class, validity and report params
+func parseSendOptions(r *http.Request, sms *gosms.OutgoingSMS) error {
+	if value := strings.TrimSpace(r.FormValue("class")); value != "" {
+		class, err := strconv.Atoi(value)
+		if err != nil || class < 0 || class > 3 {
+			return fmt.Errorf("class must be 0-3: %s", value)
+		}
+		sms.Class = &class
+	}
+
+	if value := strings.TrimSpace(r.FormValue("validity")); value != "" {
+		validity, err := strconv.Atoi(value)
+		if err != nil || validity < 5 || validity > 63*7*24*60 {
+			return fmt.Errorf("validity must be 5 minutes to 63 weeks in minutes: %s", value)
+		}
+		sms.Validity = validity
+	}
+
+	if value := strings.TrimSpace(r.FormValue("report")); value != "" {
+		if value != "0" && value != "1" {
+			return fmt.Errorf("report must be 0 or 1: %s", value)
+		}
+		report := value == "1"
+		sms.Report = &report
+	}
+	return nil
+}
+
+// parseTarget reads optional device or group param which pins message to
+// device or group, routes are not applied then
+func parseTarget(r *http.Request, sms *gosms.OutgoingSMS) error {
+	device := strings.TrimSpace(r.FormValue("device"))
+	group := strings.TrimSpace(r.FormValue("group"))
+
+	switch {
+	case device != "" && group != "":
+		return fmt.Errorf("device and group can not be used together")
+	case device != "":
+		if !gateway.HasDevice(device) {
+			return fmt.Errorf("unknown device: %s", device)
+		}
+		sms.Target = device
+	case group != "":
+		if !gateway.HasGroup(group) {
+			return fmt.Errorf("unknown group: %s", group)
+		}
+		sms.Target = group
+	}
+	return nil
+}
+
 // dumps JSON data, used by log view. Methods allowed: GET
 func getLogsHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("--- getLogsHandler")
-	messages, _ := gosms.GetOutgoingMessages("")
-	summary, _ := gosms.GetStatusSummary()
-	dayCount, _ := gosms.GetLast7DaysMessageCount()
+	messages, _ := gateway.GetOutgoingMessages("")
+	summary, _ := gateway.GetStatusSummary()
+	dayCount, _ := gateway.GetLast7DaysMessageCount()
 	logs := OutgoingSMSDataResponse{
 		Status:   200,
 		Message:  "ok",
@@ -115,7 +212,7 @@ func getLogsHandler(w http.ResponseWriter, r *http.Request) {
 // dumps JSON data, used by log view. Methods allowed: GET
 func getIncomingHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("--- getIncomingHandler")
-	messages, _ := gosms.GetIncomingMessages("")
+	messages, _ := gateway.GetIncomingMessages("")
 	logs := IncomingSMSDataResponse{
 		Status:   200,
 		Message:  "ok",
@@ -131,11 +228,79 @@ func getIncomingHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(toWrite)
 }
 
+// dumps JSON data, used by missed calls view. Methods allowed: GET
+func getCallsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("--- getCallsHandler")
+	calls, _ := gateway.GetIncomingCalls("")
+	logs := CallsDataResponse{
+		Status:  200,
+		Message: "ok",
+		Calls:   calls,
+	}
+	var toWrite []byte
+	toWrite, err := json.Marshal(logs)
+	if err != nil {
+		log.Println(err)
+		//lets just depend on the server to raise 500
+	}
+	w.Header().Set("Content-type", "application/json")
+	w.Write(toWrite)
+}
+
+// dumps health of all devices, used by devices view. Methods allowed: GET
+func getDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("--- getDevicesHandler")
+	devices, _ := gateway.GetDevices(48)
+	logs := DevicesDataResponse{
+		Status:  200,
+		Message: "ok",
+		Devices: devices,
+	}
+	var toWrite []byte
+	toWrite, err := json.Marshal(logs)
+	if err != nil {
+		log.Println(err)
+		//lets just depend on the server to raise 500
+	}
+	w.Header().Set("Content-type", "application/json")
+	w.Write(toWrite)
+}
+
+// runs USSD code on device, e.g. *100# for balance. Methods allowed: POST
+func ussdHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("--- ussdHandler")
+	w.Header().Set("Content-type", "application/json")
+
+	r.ParseForm()
+	device := mux.Vars(r)["id"]
+	code := strings.TrimSpace(r.FormValue("code"))
+
+	resp := USSDDataResponse{Status: 200, Message: "ok"}
+	if code == "" {
+		resp = USSDDataResponse{Status: 400, Message: "code is required"}
+	} else if answer, err := gateway.RunUSSD(device, code); err != nil {
+		resp = USSDDataResponse{Status: 500, Message: err.Error()}
+	} else {
+		resp.USSD = &USSDResult{Status: answer.Status, Text: answer.Text, More: answer.More()}
+	}
+
+	toWrite, err := json.Marshal(resp)
+	if err != nil {
+		log.Println(err)
+		//lets just depend on the server to raise 500
+	}
+	w.WriteHeader(resp.Status)
+	w.Write(toWrite)
+}
+
 /* end API handlers */
 
-func InitServer(host string, port string, username string, password string) error {
+// InitServer prepares API and dashboard server, caller runs ListenAndServe
+// and stops it with Shutdown
+func InitServer(gw *gosms.Gateway, host string, port string, username string, password string) *http.Server {
 	log.Println("--- InitServer ", host, port)
 
+	gateway = gw
 	authUsername = username
 	authPassword = password
 
@@ -151,13 +316,14 @@ func InitServer(host string, port string, username string, password string) erro
 	api := r.PathPrefix("/api").Subrouter()
 	api.Methods("GET").Path("/logs/").HandlerFunc(use(getLogsHandler, basicAuth))
 	api.Methods("GET").Path("/incoming/").HandlerFunc(use(getIncomingHandler, basicAuth))
+	api.Methods("GET").Path("/calls/").HandlerFunc(use(getCallsHandler, basicAuth))
+	api.Methods("GET").Path("/devices/").HandlerFunc(use(getDevicesHandler, basicAuth))
+	api.Methods("POST").Path("/devices/{id}/ussd").HandlerFunc(use(ussdHandler, basicAuth))
 	api.Methods("POST").Path("/sms/").HandlerFunc(use(sendSMSHandler, basicAuth))
 
-	http.Handle("/", r)
-
 	bind := fmt.Sprintf("%s:%s", host, port)
 	log.Println("listening on: ", bind)
-	return http.ListenAndServe(bind, nil)
+	return &http.Server{Addr: bind, Handler: r}
 
 }
 
@@ -6,91 +6,339 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 	"log"
 	"os"
+	"time"
 )
 
-var db *sql.DB
-
+// InitDB opens database and creates or upgrades its tables, the database is
+// passed to Gateway in Options
 func InitDB(driver, dbname string) (*sql.DB, error) {
-	var err error
-
 	if _, err := os.Stat(dbname); os.IsNotExist(err) {
 		log.Printf("InitDB: database does not exist %s, creating", dbname)
 	}
 
-	if db, err = sql.Open(driver, dbname); err != nil {
+	db, err := sql.Open(driver, dbname)
+	if err != nil {
 		return nil, err
 	}
 
-	if err = updateDB(); err != nil {
+	if err = updateDB(db); err != nil {
+		db.Close()
 		return nil, err
 	}
 
 	return db, nil
 }
 
-func updateDB() (err error) {
+func updateDB(db *sql.DB) (err error) {
+
+	//create messages table
+	createMessages := `CREATE TABLE messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+		uuid char(32) UNIQUE NOT NULL,
+		message char(160)   NOT NULL,
+		mobile   char(15)    NOT NULL,
+		status  INTEGER DEFAULT 0,
+		retries INTEGER DEFAULT 0,
+		device string NULL,
+		created_at TIMESTAMP default CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP,
+		delivered_at TIMESTAMP,
+		error string NULL,
+		class INTEGER NULL,
+		validity INTEGER DEFAULT 0,
+		report INTEGER NULL,
+		target string NULL
+	    );`
+	if err = createTable(db, "messages", createMessages); err != nil {
+		return err
+	}
+	if err = addColumn(db, "messages", "delivered_at", "TIMESTAMP"); err != nil {
+		return err
+	}
+	if err = addColumn(db, "messages", "error", "string NULL"); err != nil {
+		return err
+	}
+	if err = addColumn(db, "messages", "class", "INTEGER NULL"); err != nil {
+		return err
+	}
+	if err = addColumn(db, "messages", "validity", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	if err = addColumn(db, "messages", "report", "INTEGER NULL"); err != nil {
+		return err
+	}
+	if err = addColumn(db, "messages", "target", "string NULL"); err != nil {
+		return err
+	}
+
+	//message references of sent parts, status reports refer to them
+	createReferences := `CREATE TABLE message_references (
+		id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+		uuid char(32) NOT NULL,
+		device string NOT NULL,
+		reference INTEGER NOT NULL,
+		status INTEGER DEFAULT 1,
+		created_at TIMESTAMP default CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP
+	    );`
+	if err = createTable(db, "message_references", createReferences); err != nil {
+		return err
+	}
+	if _, err = db.Exec("CREATE INDEX IF NOT EXISTS message_references_device ON message_references(device, reference)"); err != nil {
+		return err
+	}
+
+	createIncoming := `CREATE TABLE incoming (
+		id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+		message char(160)   NOT NULL,
+		mobile   char(15)    NOT NULL,
+		device string NULL,
+		partial INTEGER DEFAULT 0,
+		storage_index INTEGER NULL,
+		status string NULL,
+		name string NULL,
+		sent_at TIMESTAMP NULL,
+		created_at TIMESTAMP default CURRENT_TIMESTAMP
+	    );`
+	if err = createTable(db, "incoming", createIncoming); err != nil {
+		return err
+	}
+	if err = addColumn(db, "incoming", "partial", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	if err = addColumn(db, "incoming", "storage_index", "INTEGER NULL"); err != nil {
+		return err
+	}
+	if err = addColumn(db, "incoming", "status", "string NULL"); err != nil {
+		return err
+	}
+	if err = addColumn(db, "incoming", "name", "string NULL"); err != nil {
+		return err
+	}
+	if err = addColumn(db, "incoming", "sent_at", "TIMESTAMP NULL"); err != nil {
+		return err
+	}
+
+	//parts of concatenated messages waiting for the rest of the message
+	createIncomingParts := `CREATE TABLE incoming_parts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+		device string NOT NULL,
+		mobile char(15) NOT NULL,
+		reference INTEGER NOT NULL,
+		total INTEGER NOT NULL,
+		part INTEGER NOT NULL,
+		message char(160) NOT NULL,
+		name string NULL,
+		sent_at TIMESTAMP NULL,
+		created_at TIMESTAMP default CURRENT_TIMESTAMP,
+		UNIQUE(device, mobile, reference, total, part)
+	    );`
+	if err = createTable(db, "incoming_parts", createIncomingParts); err != nil {
+		return err
+	}
+	if err = addColumn(db, "incoming_parts", "name", "string NULL"); err != nil {
+		return err
+	}
+	if err = addColumn(db, "incoming_parts", "sent_at", "TIMESTAMP NULL"); err != nil {
+		return err
+	}
+
+	//calls rejected by devices
+	createCalls := `CREATE TABLE calls (
+		id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+		mobile char(15) NULL,
+		device string NOT NULL,
+		created_at TIMESTAMP default CURRENT_TIMESTAMP
+	    );`
+	if err = createTable(db, "calls", createCalls); err != nil {
+		return err
+	}
+
+	//per device state which has to survive restarts
+	createDevices := `CREATE TABLE devices (
+		devid string PRIMARY KEY NOT NULL,
+		concat_ref INTEGER DEFAULT 0,
+		updated_at TIMESTAMP
+	    );`
+	if err = createTable(db, "devices", createDevices); err != nil {
+		return err
+	}
+	if err = addColumn(db, "devices", "rejected_pin", "string NULL"); err != nil {
+		return err
+	}
+
+	//periodic samples of device health
+	createDeviceStatus := `CREATE TABLE device_status (
+		id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+		device string NOT NULL,
+		signal INTEGER,
+		ber INTEGER,
+		registration INTEGER,
+		gprs_registration INTEGER,
+		operator string,
+		sim string,
+		imei string,
+		imsi string,
+		created_at TIMESTAMP default CURRENT_TIMESTAMP
+	    );`
+	if err = createTable(db, "device_status", createDeviceStatus); err != nil {
+		return err
+	}
+	if _, err = db.Exec("CREATE INDEX IF NOT EXISTS device_status_device ON device_status(device, id)"); err != nil {
+		return err
+	}
+
+	//answers to balance check USSD
+	createDeviceBalance := `CREATE TABLE device_balance (
+		id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+		device string NOT NULL,
+		code string NOT NULL,
+		response string NOT NULL,
+		created_at TIMESTAMP default CURRENT_TIMESTAMP
+	    );`
+	if err = createTable(db, "device_balance", createDeviceBalance); err != nil {
+		return err
+	}
+
+	//messages sent by devices per day, quotas are checked against it
+	createDeviceUsage := `CREATE TABLE device_usage (
+		device string NOT NULL,
+		day string NOT NULL,
+		count INTEGER DEFAULT 0,
+		PRIMARY KEY(device, day)
+	    );`
+	if err = createTable(db, "device_usage", createDeviceUsage); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// nullString stores empty value as NULL
+func nullString(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
 
-	res1, err := db.Query("SELECT name FROM sqlite_master WHERE type='table' AND name='messages'");
+// createTable runs the create statement only if table does not exist yet
+func createTable(db *sql.DB, name, create string) error {
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type='table' AND name=?", name)
 	if err != nil {
 		return err
 	}
 
-	defer res1.Close();
-	if res1.Next() == false {
-		//create messages table
-		createMessages := `CREATE TABLE messages (
-			id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
-			uuid char(32) UNIQUE NOT NULL,
-			message char(160)   NOT NULL,
-			mobile   char(15)    NOT NULL,
-			status  INTEGER DEFAULT 0,
-			retries INTEGER DEFAULT 0,
-			device string NULL,
-			created_at TIMESTAMP default CURRENT_TIMESTAMP,
-			updated_at TIMESTAMP
-		    );`
-		if _, err = db.Exec(createMessages, nil); err != nil {
-			return err
-		}
+	exists := rows.Next()
+	rows.Close()
+	if exists {
+		return nil
 	}
 
+	_, err = db.Exec(create)
+	return err
+}
 
-	res2, err := db.Query("SELECT name FROM sqlite_master WHERE type='table' AND name='incoming'");
+// addColumn upgrades tables created by older versions
+func addColumn(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
 	if err != nil {
 		return err
 	}
 
-	defer res2.Close();
-	if res2.Next() == false {
-		createIncoming := `CREATE TABLE incoming (
-			id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
-			message char(160)   NOT NULL,
-			mobile   char(15)    NOT NULL,
-			device string NULL,
-			created_at TIMESTAMP default CURRENT_TIMESTAMP
-		    );`
-		if _, err = db.Exec(createIncoming, nil); err != nil {
-			return err
+	exists := false
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, ctype string
+		var dflt sql.NullString
+		rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk)
+		if name == column {
+			exists = true
 		}
 	}
+	rows.Close()
+	if exists {
+		return nil
+	}
 
-	return nil
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
 }
 
-func insertOutgoingMessage(sms *OutgoingSMS) error {
-	_, err := db.Exec("INSERT INTO messages(uuid, message, mobile, created_at) VALUES(?, ?, ?, DATETIME('now'))", sms.UUID, sms.Body, sms.Mobile)
+func (g *Gateway) insertOutgoingMessage(sms *OutgoingSMS) error {
+	_, err := g.db.Exec("INSERT INTO messages(uuid, message, mobile, class, validity, report, target, created_at) VALUES(?, ?, ?, ?, ?, ?, ?, DATETIME('now'))",
+		sms.UUID, sms.Body, sms.Mobile, sms.Class, sms.Validity, sms.Report, nullString(sms.Target))
 	return err
 }
 
-func updateOutgoingMessageStatus(sms OutgoingSMS) error {
-	_, err := db.Exec("UPDATE messages SET status=?, retries=?, device=?, updated_at=DATETIME('now') WHERE uuid=?", sms.Status, sms.Retries, sms.Device, sms.UUID)
+// scanSendOptions fills optional message settings read from database
+func scanSendOptions(sms *OutgoingSMS, class sql.NullInt64, report sql.NullBool) {
+	if class.Valid {
+		value := int(class.Int64)
+		sms.Class = &value
+	}
+	if report.Valid {
+		value := report.Bool
+		sms.Report = &value
+	}
+}
+
+func (g *Gateway) updateOutgoingMessageStatus(sms OutgoingSMS) error {
+	_, err := g.db.Exec("UPDATE messages SET status=?, retries=?, device=?, error=?, updated_at=DATETIME('now') WHERE uuid=?", sms.Status, sms.Retries, sms.Device, sms.Error, sms.UUID)
+	return err
+}
+
+// updateOutgoingMessagePending returns message which was not tried back to
+// pending, its retries and last error are kept
+func (g *Gateway) updateOutgoingMessagePending(uuid string) error {
+	_, err := g.db.Exec("UPDATE messages SET status=?, updated_at=DATETIME('now') WHERE uuid=?", SMSPending, uuid)
 	return err
 }
 
-func getPendingOutgoingMessages(bufferSize int) ([]OutgoingSMS, error) {
-	query := fmt.Sprintf("SELECT uuid, message, mobile, status, retries FROM messages WHERE status!=%v AND retries<%v LIMIT %v", SMSProcessed, SMSRetryLimit, bufferSize)
+func (g *Gateway) updateOutgoingMessageDelivery(uuid string, status int, deliveredAt time.Time) error {
+	var delivered interface{}
+	if status == SMSDelivered {
+		delivered = deliveredAt.UTC().Format("2006-01-02 15:04:05")
+	}
+	_, err := g.db.Exec("UPDATE messages SET status=?, delivered_at=?, updated_at=DATETIME('now') WHERE uuid=?", status, delivered, uuid)
+	return err
+}
+
+func (g *Gateway) insertMessageReferences(uuid, device string, refs []int) error {
+	for _, ref := range refs {
+		_, err := g.db.Exec("INSERT INTO message_references(uuid, device, reference, created_at) VALUES(?, ?, ?, DATETIME('now'))", uuid, device, ref)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateMessageReference stores status of the latest part sent through device
+// with given reference, references wrap at 255 so older ones are ignored.
+// delivered is true when all parts of the message are delivered
+func (g *Gateway) updateMessageReference(device string, ref, status int) (uuid string, delivered bool, err error) {
+	var id int
+	err = g.db.QueryRow("SELECT id, uuid FROM message_references WHERE device=? AND reference=? ORDER BY id DESC LIMIT 1", device, ref).Scan(&id, &uuid)
+	if err != nil {
+		return "", false, err
+	}
 
-	rows, err := db.Query(query)
+	if _, err = g.db.Exec("UPDATE message_references SET status=?, updated_at=DATETIME('now') WHERE id=?", status, id); err != nil {
+		return "", false, err
+	}
+
+	var undelivered int
+	err = g.db.QueryRow("SELECT COUNT(id) FROM message_references WHERE uuid=? AND status!=?", uuid, SMSDelivered).Scan(&undelivered)
+	return uuid, undelivered == 0, err
+}
+
+func (g *Gateway) getPendingOutgoingMessages(bufferSize int) ([]OutgoingSMS, error) {
+	// messages in error failed for good, e.g. number does not exist. Messages
+	// never tried come first, the others in order they were last routed
+	query := fmt.Sprintf("SELECT uuid, message, mobile, status, retries, class, validity, report, target FROM messages WHERE status=%v AND retries<%v ORDER BY updated_at, id LIMIT %v", SMSPending, SMSRetryLimit, bufferSize)
+
+	rows, err := g.db.Query(query)
 	if err != nil {
 		return nil, err
 	}
@@ -100,21 +348,26 @@ func getPendingOutgoingMessages(bufferSize int) ([]OutgoingSMS, error) {
 
 	for rows.Next() {
 		sms := OutgoingSMS{}
-		rows.Scan(&sms.UUID, &sms.Body, &sms.Mobile, &sms.Status, &sms.Retries)
+		var class sql.NullInt64
+		var report sql.NullBool
+		var target sql.NullString
+		rows.Scan(&sms.UUID, &sms.Body, &sms.Mobile, &sms.Status, &sms.Retries, &class, &sms.Validity, &report, &target)
+		scanSendOptions(&sms, class, report)
+		sms.Target = target.String
 		messages = append(messages, sms)
 	}
 	rows.Close()
 	return messages, nil
 }
 
-func GetOutgoingMessages(filter string) ([]OutgoingSMS, error) {
+func (g *Gateway) GetOutgoingMessages(filter string) ([]OutgoingSMS, error) {
 	/*
 	   expecting filter as empty string or WHERE clauses,
 	   simply append it to the query to get desired set out of database
 	*/
-	query := fmt.Sprintf("SELECT id, uuid, message, mobile, status, retries, device, created_at, updated_at FROM messages %v", filter)
+	query := fmt.Sprintf("SELECT id, uuid, message, mobile, status, retries, device, created_at, updated_at, delivered_at, error, class, validity, report, target FROM messages %v", filter)
 
-	rows, err := db.Query(query)
+	rows, err := g.db.Query(query)
 	if err != nil {
 		return nil, err
 	}
@@ -124,16 +377,22 @@ func GetOutgoingMessages(filter string) ([]OutgoingSMS, error) {
 
 	for rows.Next() {
 		sms := OutgoingSMS{}
-		rows.Scan(&sms.Id, &sms.UUID, &sms.Body, &sms.Mobile, &sms.Status, &sms.Retries, &sms.Device, &sms.CreatedAt, &sms.UpdatedAt)
+		var device, updatedAt, deliveredAt, failure, target sql.NullString
+		var class sql.NullInt64
+		var report sql.NullBool
+		rows.Scan(&sms.Id, &sms.UUID, &sms.Body, &sms.Mobile, &sms.Status, &sms.Retries, &device, &sms.CreatedAt, &updatedAt, &deliveredAt, &failure,
+			&class, &sms.Validity, &report, &target)
+		sms.Device, sms.UpdatedAt, sms.DeliveredAt, sms.Error, sms.Target = device.String, updatedAt.String, deliveredAt.String, failure.String, target.String
+		scanSendOptions(&sms, class, report)
 		messages = append(messages, sms)
 	}
 	rows.Close()
 	return messages, nil
 }
 
-func GetLast7DaysMessageCount() (map[string]int, error) {
+func (g *Gateway) GetLast7DaysMessageCount() (map[string]int, error) {
 
-	rows, err := db.Query(`SELECT strftime('%Y-%m-%d', created_at) as datestamp,
+	rows, err := g.db.Query(`SELECT strftime('%Y-%m-%d', created_at) as datestamp,
     COUNT(id) as messagecount FROM messages GROUP BY datestamp
     ORDER BY datestamp DESC LIMIT 7`)
 	if err != nil {
@@ -152,8 +411,8 @@ func GetLast7DaysMessageCount() (map[string]int, error) {
 	return dayCount, nil
 }
 
-func GetStatusSummary() ([]int, error) {
-	rows, err := db.Query(`SELECT status, COUNT(id) as messagecount
+func (g *Gateway) GetStatusSummary() ([]int, error) {
+	rows, err := g.db.Query(`SELECT status, COUNT(id) as messagecount
     FROM messages GROUP BY status ORDER BY status`)
 	if err != nil {
 		return nil, err
@@ -161,29 +420,32 @@ func GetStatusSummary() ([]int, error) {
 	defer rows.Close()
 
 	var status, count int
-	statusSummary := make([]int, 3)
+	statusSummary := make([]int, SMSRejected+1)
 	for rows.Next() {
 		rows.Scan(&status, &count)
-		statusSummary[status] = count
+		if status >= 0 && status < len(statusSummary) {
+			statusSummary[status] = count
+		}
 	}
 	rows.Close()
 	return statusSummary, nil
 }
 
 
-func insertIncomingMessage(sms *IncomingSMS) error {
-	_, err := db.Exec("INSERT INTO incoming(message, mobile, device, created_at) VALUES(?, ?, ?, DATETIME('now'))", sms.Body, sms.Mobile, sms.Device)
+func (g *Gateway) insertIncomingMessage(sms *IncomingSMS) error {
+	_, err := g.db.Exec("INSERT INTO incoming(message, mobile, device, partial, storage_index, status, name, sent_at, created_at) VALUES(?, ?, ?, ?, ?, ?, ?, ?, DATETIME('now'))",
+		sms.Body, sms.Mobile, sms.Device, sms.Partial, sms.Index, sms.Status, sms.Name, nullString(sms.SentAt))
 	return err
 }
 
-func GetIncomingMessages(filter string) ([]IncomingSMS, error) {
+func (g *Gateway) GetIncomingMessages(filter string) ([]IncomingSMS, error) {
 	/*
 	   expecting filter as empty string or WHERE clauses,
 	   simply append it to the query to get desired set out of database
 	*/
-	query := fmt.Sprintf("SELECT id, message, mobile, device, created_at FROM incoming %v", filter)
+	query := fmt.Sprintf("SELECT id, message, mobile, device, partial, storage_index, status, name, sent_at, created_at FROM incoming %v", filter)
 
-	rows, err := db.Query(query)
+	rows, err := g.db.Query(query)
 	if err != nil {
 		return nil, err
 	}
@@ -193,9 +455,224 @@ func GetIncomingMessages(filter string) ([]IncomingSMS, error) {
 
 	for rows.Next() {
 		sms := IncomingSMS{}
-		rows.Scan(&sms.Id, &sms.Body, &sms.Mobile, &sms.Device, &sms.CreatedAt)
+		var index sql.NullInt64
+		var status, name, sentAt sql.NullString
+		rows.Scan(&sms.Id, &sms.Body, &sms.Mobile, &sms.Device, &sms.Partial, &index, &status, &name, &sentAt, &sms.CreatedAt)
+		sms.Index, sms.Status, sms.Name, sms.SentAt = int(index.Int64), status.String, name.String, sentAt.String
+		if !index.Valid {
+			sms.Index = -1 // stored by older version
+		}
 		messages = append(messages, sms)
 	}
 	rows.Close()
 	return messages, nil
-}
\ No newline at end of file
+}
+
+func (g *Gateway) insertIncomingCall(call *IncomingCall) error {
+	_, err := g.db.Exec("INSERT INTO calls(mobile, device, created_at) VALUES(?, ?, DATETIME('now'))", call.Mobile, call.Device)
+	return err
+}
+
+func (g *Gateway) GetIncomingCalls(filter string) ([]IncomingCall, error) {
+	/*
+	   expecting filter as empty string or WHERE clauses,
+	   simply append it to the query to get desired set out of database
+	*/
+	query := fmt.Sprintf("SELECT id, mobile, device, created_at FROM calls %v", filter)
+
+	rows, err := g.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var calls []IncomingCall
+
+	for rows.Next() {
+		call := IncomingCall{}
+		rows.Scan(&call.Id, &call.Mobile, &call.Device, &call.CreatedAt)
+		calls = append(calls, call)
+	}
+	rows.Close()
+	return calls, nil
+}
+
+func (g *Gateway) insertIncomingPart(device, mobile string, reference, total, part int, body, name, sentAt string) error {
+	// modem may list the same part again if its deletion failed
+	_, err := g.db.Exec("INSERT OR IGNORE INTO incoming_parts(device, mobile, reference, total, part, message, name, sent_at, created_at) VALUES(?, ?, ?, ?, ?, ?, ?, ?, DATETIME('now'))",
+		device, mobile, reference, total, part, body, name, nullString(sentAt))
+	return err
+}
+
+// getIncomingParts returns bodies of received parts ordered by part number
+func (g *Gateway) getIncomingParts(device, mobile string, reference, total int) ([]string, error) {
+	rows, err := g.db.Query("SELECT message FROM incoming_parts WHERE device=? AND mobile=? AND reference=? AND total=? ORDER BY part",
+		device, mobile, reference, total)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var parts []string
+	for rows.Next() {
+		var body string
+		rows.Scan(&body)
+		parts = append(parts, body)
+	}
+	rows.Close()
+	return parts, nil
+}
+
+// getIncomingPartsSender returns name of originator and time stamp of the
+// earliest received part
+func (g *Gateway) getIncomingPartsSender(device, mobile string, reference, total int) (name, sentAt string, err error) {
+	var n, sent sql.NullString
+	err = g.db.QueryRow("SELECT MAX(name), MIN(sent_at) FROM incoming_parts WHERE device=? AND mobile=? AND reference=? AND total=?",
+		device, mobile, reference, total).Scan(&n, &sent)
+	return n.String, sent.String, err
+}
+
+func (g *Gateway) deleteIncomingParts(device, mobile string, reference, total int) error {
+	_, err := g.db.Exec("DELETE FROM incoming_parts WHERE device=? AND mobile=? AND reference=? AND total=?",
+		device, mobile, reference, total)
+	return err
+}
+
+// incomingPartSet identifies parts belonging to one concatenated message
+type incomingPartSet struct {
+	Mobile    string
+	Reference int
+	Total     int
+}
+
+// getStaleIncomingParts returns incomplete messages whose first part arrived
+// before given timeout
+func (g *Gateway) getStaleIncomingParts(device string, timeout time.Duration) ([]incomingPartSet, error) {
+	rows, err := g.db.Query(`SELECT mobile, reference, total FROM incoming_parts WHERE device=?
+    GROUP BY mobile, reference, total HAVING MIN(created_at) < DATETIME('now', ?)`,
+		device, fmt.Sprintf("-%d seconds", int(timeout.Seconds())))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sets []incomingPartSet
+	for rows.Next() {
+		set := incomingPartSet{}
+		rows.Scan(&set.Mobile, &set.Reference, &set.Total)
+		sets = append(sets, set)
+	}
+	rows.Close()
+	return sets, nil
+}
+
+func (g *Gateway) ensureDevice(devid string) error {
+	_, err := g.db.Exec("INSERT OR IGNORE INTO devices(devid, updated_at) VALUES(?, DATETIME('now'))", devid)
+	return err
+}
+
+func (g *Gateway) getConcatReference(devid string) (uint16, error) {
+	var ref int
+	err := g.db.QueryRow("SELECT concat_ref FROM devices WHERE devid=?", devid).Scan(&ref)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return uint16(ref), err
+}
+
+func (g *Gateway) updateConcatReference(devid string, ref uint16) error {
+	if err := g.ensureDevice(devid); err != nil {
+		return err
+	}
+	_, err := g.db.Exec("UPDATE devices SET concat_ref=?, updated_at=DATETIME('now') WHERE devid=?", ref, devid)
+	return err
+}
+
+// getRejectedPIN returns hash of PIN whose entry failed on device, empty
+// when there is none
+func (g *Gateway) getRejectedPIN(devid string) (string, error) {
+	var hash sql.NullString
+	err := g.db.QueryRow("SELECT rejected_pin FROM devices WHERE devid=?", devid).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return hash.String, err
+}
+
+func (g *Gateway) updateRejectedPIN(devid, hash string) error {
+	if err := g.ensureDevice(devid); err != nil {
+		return err
+	}
+	_, err := g.db.Exec("UPDATE devices SET rejected_pin=?, updated_at=DATETIME('now') WHERE devid=?", nullString(hash), devid)
+	return err
+}
+
+func (g *Gateway) insertDeviceStatus(status *DeviceStatus) error {
+	_, err := g.db.Exec(`INSERT INTO device_status(device, signal, ber, registration, gprs_registration, operator, sim, imei, imsi, created_at)
+    VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, DATETIME('now'))`,
+		status.Device, status.Signal, status.BitErrorRate, status.Registration, status.GPRSRegistration,
+		status.Operator, status.SIM, status.IMEI, status.IMSI)
+	if err != nil {
+		return err
+	}
+
+	_, err = g.db.Exec("DELETE FROM device_status WHERE created_at < DATETIME('now', ?)", fmt.Sprintf("-%d seconds", int(g.options.DeviceStatusRetention.Seconds())))
+	return err
+}
+
+// GetDeviceStatusHistory returns latest health samples of device, newest first
+func (g *Gateway) GetDeviceStatusHistory(device string, limit int) ([]DeviceStatus, error) {
+	rows, err := g.db.Query(`SELECT device, signal, ber, registration, gprs_registration, operator, sim, imei, imsi, created_at
+    FROM device_status WHERE device=? ORDER BY id DESC LIMIT ?`, device, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []DeviceStatus
+	for rows.Next() {
+		status := DeviceStatus{}
+		rows.Scan(&status.Device, &status.Signal, &status.BitErrorRate, &status.Registration, &status.GPRSRegistration,
+			&status.Operator, &status.SIM, &status.IMEI, &status.IMSI, &status.CreatedAt)
+		history = append(history, status)
+	}
+	rows.Close()
+	return history, nil
+}
+
+func (g *Gateway) insertDeviceBalance(balance *DeviceBalance) error {
+	_, err := g.db.Exec("INSERT INTO device_balance(device, code, response, created_at) VALUES(?, ?, ?, DATETIME('now'))",
+		balance.Device, balance.Code, balance.Text)
+	return err
+}
+
+// getDeviceBalance returns latest balance check of device, nil when there was none
+func (g *Gateway) getDeviceBalance(device string) (*DeviceBalance, error) {
+	balance := &DeviceBalance{}
+	err := g.db.QueryRow("SELECT device, code, response, created_at FROM device_balance WHERE device=? ORDER BY id DESC LIMIT 1", device).
+		Scan(&balance.Device, &balance.Code, &balance.Text, &balance.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return balance, nil
+}
+
+func (g *Gateway) addDeviceUsage(device, day string, count int) error {
+	_, err := g.db.Exec("INSERT OR IGNORE INTO device_usage(device, day, count) VALUES(?, ?, 0)", device, day)
+	if err != nil {
+		return err
+	}
+	_, err = g.db.Exec("UPDATE device_usage SET count=count+? WHERE device=? AND day=?", count, device, day)
+	return err
+}
+
+// getDeviceUsage returns messages sent by device on given day, YYYY-MM-DD,
+// and in its month
+func (g *Gateway) getDeviceUsage(device, day string) (sentDay, sentMonth int, err error) {
+	err = g.db.QueryRow(`SELECT COALESCE(SUM(CASE WHEN day=? THEN count END), 0), COALESCE(SUM(count), 0)
+    FROM device_usage WHERE device=? AND day LIKE ?`, day, device, day[:7]+"-%").Scan(&sentDay, &sentMonth)
+	return sentDay, sentMonth, err
+}
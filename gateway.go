@@ -0,0 +1,635 @@
+package gosms
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/haxpax/gosms/modem"
+)
+
+// Options configure Gateway, DefaultOptions returns values used by the
+// dashboard when conf.ini does not say otherwise
+type Options struct {
+	// Drivers are modems messages are sent through, Gateway connects them
+	// on Start and closes them on Stop
+	Drivers []*modem.Driver
+
+	// DB is database prepared by InitDB
+	DB *sql.DB
+
+	// BufferSize is how many pending messages are loaded from database at
+	// once, they are loaded again when fewer than BufferLow are waiting
+	BufferSize int
+	BufferLow  int
+
+	// message loader checks database after LoaderCountout messages were
+	// enqueued or LoaderTimeout passed since it was last woken up, and
+	// every LoaderLongTimeout even if nothing happens
+	LoaderTimeout     time.Duration
+	LoaderCountout    int
+	LoaderLongTimeout time.Duration
+
+	// SMTP sends notifications about incoming messages, missed calls and
+	// full storage, nil disables them
+	SMTP *SMTP
+
+	// BalanceChecks are run periodically on devices, keyed by device id
+	BalanceChecks map[string]BalanceCheck
+
+	// Limits are send rate limits and quotas of devices, keyed by device id,
+	// messages wait while all devices are at their quota
+	Limits map[string]DeviceLimits
+
+	// HealthInterval is how often signal, registration and SIM state of
+	// every device is sampled, zero disables sampling
+	HealthInterval time.Duration
+
+	// DeviceStatusRetention is how long health samples are kept in database
+	DeviceStatusRetention time.Duration
+
+	// PollInterval is how often all devices are checked for messages which
+	// were not announced by +CMTI, zero disables polling
+	PollInterval time.Duration
+
+	// IncomingPartTimeout is how long parts of concatenated message wait for
+	// the rest, after that whatever arrived is delivered as partial message
+	IncomingPartTimeout time.Duration
+
+	// ReconnectDelay is how long device waits before first attempt to
+	// reconnect lost modem, the delay doubles with every failure up to
+	// ReconnectMaxDelay
+	ReconnectDelay    time.Duration
+	ReconnectMaxDelay time.Duration
+
+	// StorageAlertLevel is usage of device message storage in percent which
+	// is reported by email, full storage does not take new messages, zero
+	// disables the alert
+	StorageAlertLevel int
+
+	// CallReply is SMS sent back to callers, calls are always rejected,
+	// empty disables the reply
+	CallReply string
+
+	// CallerIDWait is how long device waits for +CLIP after RING before it
+	// rejects call of unknown caller
+	CallerIDWait time.Duration
+
+	// Selector picks device for every outgoing message, nil passes messages
+	// to devices in turn
+	Selector DeviceSelector
+
+	// Groups are device ids by group name, routes and messages can be sent
+	// through any device of a group
+	Groups map[string][]string
+
+	// Routes are tried in order, message goes through first route matching
+	// its destination, messages matching no route go to any device
+	Routes []Route
+
+	// device which failed to send FailureLimit times in a row is skipped for
+	// FailureCooldown, unless all devices fail
+	FailureLimit    int
+	FailureCooldown time.Duration
+}
+
+// DefaultOptions returns options with built-in defaults, drivers and
+// database have to be filled in
+func DefaultOptions() Options {
+	return Options{
+		BufferSize:            10,
+		BufferLow:             4,
+		LoaderTimeout:         5 * time.Minute,
+		LoaderCountout:        10,
+		LoaderLongTimeout:     20 * time.Minute,
+		BalanceChecks:         map[string]BalanceCheck{},
+		Limits:                map[string]DeviceLimits{},
+		HealthInterval:        5 * time.Minute,
+		DeviceStatusRetention: 7 * 24 * time.Hour,
+		PollInterval:          60 * time.Second,
+		IncomingPartTimeout:   60 * time.Minute,
+		ReconnectDelay:        5 * time.Second,
+		ReconnectMaxDelay:     5 * time.Minute,
+		StorageAlertLevel:     80,
+		CallerIDWait:          2 * time.Second,
+		FailureLimit:          3,
+		FailureCooldown:       5 * time.Minute,
+	}
+}
+
+// Gateway sends and receives messages through its devices and keeps them
+// in database, several gateways can run in one process as long as they do
+// not share modems
+type Gateway struct {
+	options Options
+	db      *sql.DB
+	devices []*Device
+
+	queue               chan OutgoingSMS
+	send                chan OutgoingSMS
+	wakeupMessageLoader chan bool
+
+	loaderMu                    sync.Mutex
+	messageCountSinceLastWakeup int
+	timeOfLastWakeup            time.Time
+
+	// held are messages on their way to devices, they are still pending in
+	// database until they are tried, so message loader must not load them
+	heldMu sync.Mutex
+	held   map[string]bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// sendCtx outlives ctx so that messages being sent are finished on
+	// shutdown, it is cancelled only when shutdown deadline passes
+	sendCtx    context.Context
+	sendCancel context.CancelFunc
+}
+
+// NewGateway prepares gateway, nothing is connected until Start
+func NewGateway(options Options) *Gateway {
+	if options.BufferSize <= 0 {
+		options.BufferSize = 1
+	}
+	if options.BalanceChecks == nil {
+		options.BalanceChecks = map[string]BalanceCheck{}
+	}
+	if options.Selector == nil {
+		options.Selector = &RoundRobinSelector{}
+	}
+
+	g := &Gateway{
+		options:             options,
+		db:                  options.DB,
+		queue:               make(chan OutgoingSMS, options.BufferSize),
+		send:                make(chan OutgoingSMS, options.BufferSize),
+		wakeupMessageLoader: make(chan bool, 1),
+		held:                map[string]bool{},
+	}
+
+	//older time handles the cold start state of the system
+	g.timeOfLastWakeup = time.Now().Add(-options.LoaderTimeout)
+	g.wakeupMessageLoader <- true
+	return g
+}
+
+// Start connects devices and starts sending pending messages, it returns
+// right away and gateway runs until ctx is done or Stop is called
+func (g *Gateway) Start(ctx context.Context) error {
+	log.Println("--- Gateway Start")
+	if g.db == nil {
+		return errors.New("gateway has no database")
+	}
+	if g.ctx != nil {
+		return errors.New("gateway already started")
+	}
+	if err := g.checkRoutes(); err != nil {
+		return err
+	}
+	g.ctx, g.cancel = context.WithCancel(ctx)
+	g.sendCtx, g.sendCancel = context.WithCancel(context.Background())
+
+	// init all devices
+	for _, driver := range g.options.Drivers {
+		events := driver.Subscribe()
+		rejected := g.loadRejectedPIN(driver)
+		err := driver.Connect()
+		if err != nil {
+			log.Println("Start: error connecting", driver.DeviceId, err)
+		}
+		g.saveRejectedPIN(driver, rejected)
+
+		if ref, err := g.getConcatReference(driver.DeviceId); err == nil {
+			driver.ConcatReference = ref
+		} else {
+			log.Println("Start: unable to load concatenation reference", driver.DeviceId, err)
+		}
+
+		device := &Device{
+			Driver:  driver,
+			Send:    make(chan OutgoingSMS, g.options.BufferSize),
+			Poll:    make(chan bool, 1),
+			Events:  events,
+			gateway: g,
+			online:  err == nil,
+		}
+		if err != nil {
+			device.reason = err.Error()
+		}
+		if err := device.loadUsage(); err != nil {
+			log.Println("Start: unable to load usage", driver.DeviceId, err)
+		}
+		g.devices = append(g.devices, device)
+
+		g.wg.Add(1)
+		go func() {
+			defer g.wg.Done()
+			device.Worker(g.ctx)
+		}()
+	}
+
+	g.wg.Add(2)
+	go func() {
+		defer g.wg.Done()
+		g.dispatcher(g.ctx)
+	}()
+
+	// load older messages
+	go func() {
+		defer g.wg.Done()
+		g.messageLoader(g.ctx)
+	}()
+
+	return nil
+}
+
+// loadRejectedPIN tells driver its PIN failed before restart, SIM would
+// come closer to PUK lock with every restart otherwise. It returns
+// rejected PIN driver starts with
+func (g *Gateway) loadRejectedPIN(driver *modem.Driver) string {
+	hash, err := g.getRejectedPIN(driver.DeviceId)
+	if err != nil {
+		log.Println("DB error: ", err)
+	}
+	if hash != "" && driver.PIN != "" && hash == pinHash(driver.PIN) {
+		driver.RejectedPIN = driver.PIN
+	}
+	return driver.RejectedPIN
+}
+
+// saveRejectedPIN stores PIN which failed while connecting, only its hash
+// is kept in database
+func (g *Gateway) saveRejectedPIN(driver *modem.Driver, before string) {
+	if driver.RejectedPIN == before {
+		return
+	}
+	if err := g.updateRejectedPIN(driver.DeviceId, pinHash(driver.RejectedPIN)); err != nil {
+		log.Println("DB error: ", err)
+	}
+}
+
+func pinHash(pin string) string {
+	if pin == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(pin))
+	return hex.EncodeToString(sum[:])
+}
+
+// Stop is Shutdown without deadline
+func (g *Gateway) Stop() {
+	g.Shutdown(context.Background())
+}
+
+// Shutdown stops taking new messages and lets devices finish messages they
+// are sending, sends still running when ctx is done are aborted. Buffered
+// messages go back to pending and devices are closed, database is left open
+// for its owner
+func (g *Gateway) Shutdown(ctx context.Context) error {
+	if g.cancel == nil {
+		return nil
+	}
+	log.Println("--- Gateway Shutdown")
+
+	g.cancel()
+
+	done := make(chan bool)
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Println("Shutdown: deadline passed, aborting messages being sent")
+		err = ctx.Err()
+		g.sendCancel()
+		<-done
+	}
+	g.sendCancel()
+
+	g.requeueBuffered()
+
+	for _, device := range g.devices {
+		device.Driver.Unsubscribe(device.Events)
+		device.Driver.Close()
+	}
+	return err
+}
+
+// requeueBuffered returns messages which waited in channels back to
+// pending, they are loaded again on next start
+func (g *Gateway) requeueBuffered() {
+	buffers := []chan OutgoingSMS{g.send, g.queue}
+	for _, device := range g.devices {
+		buffers = append(buffers, device.Send)
+	}
+
+	count := 0
+	for _, buffer := range buffers {
+		for len(buffer) > 0 {
+			message := <-buffer
+			if err := g.updateOutgoingMessagePending(message.UUID); err != nil {
+				log.Println("DB error: ", err)
+			}
+			g.release(message.UUID)
+			count++
+		}
+	}
+	log.Println("Shutdown: ", count, "buffered messages returned to pending")
+}
+
+// dispatcher routes new and pending messages to devices and tells devices
+// when to poll for incoming messages
+func (g *Gateway) dispatcher(ctx context.Context) {
+	// new messages are announced by modem, polling only picks up
+	// whatever the notifications missed
+	var poll <-chan time.Time
+	if g.options.PollInterval > 0 {
+		ticker := time.NewTicker(g.options.PollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	for {
+		select {
+		case message := <-g.send:
+			g.routeMessage(message)
+		case message := <-g.queue:
+			// select should work at random, so if queue will be full and we will have new request
+			// for send, it should pass through nearly realtime
+			g.routeMessage(message)
+		case t := <-poll:
+			log.Println("Polling time", t)
+			// poll all devices, one request waiting is enough
+			for _, device := range g.devices {
+				if device.Online() {
+					select {
+					case device.Poll <- true:
+					default:
+					}
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// routeMessage passes message to device it is pinned to, to device of the
+// first route which matches its destination or to any device. Pinned
+// messages and routes without fallback wait for their devices, everything
+// else stays pending in database only when all devices are offline or at
+// their quota. Message also stays pending when queue of chosen device is
+// full, e.g. as it waits for its rate limit, so that other messages are not
+// held up
+func (g *Gateway) routeMessage(message OutgoingSMS) {
+	var device *Device
+	if message.Target != "" {
+		if device = g.selectDevice(message, g.targetDevices(message.Target)); device == nil {
+			log.Println("routeMessage: no device of", message.Target, "online within quota, message stays pending", message.UUID)
+			g.leavePending(message)
+			return
+		}
+	} else if route := g.matchRoute(message.Mobile); route != nil {
+		device = g.selectDevice(message, g.targetDevices(route.Target))
+		if device == nil && !route.Fallback {
+			log.Println("routeMessage: no device of", route.Target, "online within quota, message stays pending", message.UUID)
+			g.leavePending(message)
+			return
+		}
+	}
+
+	if device == nil {
+		if device = g.selectDevice(message, g.devices); device == nil {
+			log.Println("routeMessage: no device online within quota, message stays pending", message.UUID)
+			g.leavePending(message)
+			return
+		}
+	}
+
+	select {
+	case device.Send <- message:
+	default:
+		log.Println("routeMessage: queue of", device.Driver.DeviceId, "is full, message stays pending", message.UUID)
+		g.leavePending(message)
+	}
+}
+
+// leavePending moves message which stays pending behind other pending
+// messages, so that messages which can not go do not hold them up
+func (g *Gateway) leavePending(message OutgoingSMS) {
+	if err := g.updateOutgoingMessagePending(message.UUID); err != nil {
+		log.Println("DB error: ", err)
+	}
+	g.release(message.UUID)
+}
+
+// hold marks message as being on its way to device, it returns false when
+// the message is already held
+func (g *Gateway) hold(uuid string) bool {
+	g.heldMu.Lock()
+	defer g.heldMu.Unlock()
+	if g.held[uuid] {
+		return false
+	}
+	g.held[uuid] = true
+	return true
+}
+
+// release lets message loader load message again, it is called once
+// database tells what happened to the message
+func (g *Gateway) release(uuid string) {
+	g.heldMu.Lock()
+	delete(g.held, uuid)
+	g.heldMu.Unlock()
+}
+
+func (g *Gateway) heldCount() int {
+	g.heldMu.Lock()
+	defer g.heldMu.Unlock()
+	return len(g.held)
+}
+
+// selectDevice asks selector for one of online devices which did not use up
+// their quota, failing devices and devices waiting for their rate limit are
+// left out unless all of them fail or wait
+func (g *Gateway) selectDevice(message OutgoingSMS, devices []*Device) *Device {
+	var online, healthy []*Device
+	for _, device := range devices {
+		if device.Online() && !device.AtQuota() {
+			online = append(online, device)
+			if !device.Failing() {
+				healthy = append(healthy, device)
+			}
+		}
+	}
+
+	if len(online) == 0 {
+		return nil
+	}
+	if len(healthy) == 0 {
+		healthy = online
+	}
+
+	var ready []*Device
+	for _, device := range healthy {
+		if device.rateWait() == 0 {
+			ready = append(ready, device)
+		}
+	}
+	if len(ready) == 0 {
+		ready = healthy
+	}
+	return g.options.Selector.Select(message, ready)
+}
+
+// SendMessage stores message and tries to send it immediately
+func (g *Gateway) SendMessage(message *OutgoingSMS) error {
+	log.Println("--- SendMessage", message)
+	// held before it is in database, loader would take it as well otherwise
+	g.hold(message.UUID)
+	if err := g.insertOutgoingMessage(message); err != nil {
+		g.release(message.UUID)
+		return err
+	}
+
+	select {
+	case g.send <- *message:
+	default:
+		// dispatcher is busy, message loader picks the message up
+		g.release(message.UUID)
+		g.EnqueueMessage(message)
+	}
+	return nil
+}
+
+// EnqueueMessage tells message loader that message waits in database, the
+// loader is woken up only if it has been too long or too many messages
+// since last wakeup
+func (g *Gateway) EnqueueMessage(message *OutgoingSMS) {
+	log.Println("--- EnqueueMessage: ", message)
+
+	g.loaderMu.Lock()
+	defer g.loaderMu.Unlock()
+
+	g.messageCountSinceLastWakeup++
+	if g.messageCountSinceLastWakeup > g.options.LoaderCountout || time.Now().Sub(g.timeOfLastWakeup) > g.options.LoaderTimeout {
+		log.Println("EnqueueMessage: ", "waking up message loader")
+		g.wakeup()
+		g.messageCountSinceLastWakeup = 0
+		g.timeOfLastWakeup = time.Now()
+	}
+	log.Println("EnqueueMessage - anon: count since last wakeup: ", g.messageCountSinceLastWakeup)
+}
+
+// wakeup makes message loader check database, one call waiting is enough
+func (g *Gateway) wakeup() {
+	select {
+	case g.wakeupMessageLoader <- true:
+	default:
+	}
+}
+
+// messageLoader loads pending messages from database as needed
+func (g *Gateway) messageLoader(ctx context.Context) {
+	for {
+		/*
+		   - set a fairly long timeout for wakeup
+		   - if there are very few number of messages in the system and they failed at first go,
+		   and there are no events happening to call EnqueueMessage, those messages might get
+		   stalled in the system until someone knocks on the API door
+		   - we can afford a really long polling in this case
+		*/
+		log.Println("messageLoader: ", "waiting for wakeup call")
+		select {
+		case <-g.wakeupMessageLoader:
+			log.Println("messageLoader: woken up by channel call")
+		case <-time.After(g.options.LoaderLongTimeout):
+			log.Println("messageLoader: woken up by timeout")
+		case <-ctx.Done():
+			return
+		}
+		if len(g.queue) >= g.options.BufferLow {
+			//if we have sufficient number of messages to process,
+			//don't bother hitting the database
+			log.Println("messageLoader: ", "I have sufficient messages")
+			continue
+		}
+
+		countToFetch := g.options.BufferSize - len(g.queue)
+		log.Println("messageLoader: ", "I need to fetch more messages", countToFetch)
+		// held messages are pending as well, they are skipped
+		pendingMsgs, err := g.getPendingOutgoingMessages(countToFetch + g.heldCount())
+		if err != nil {
+			log.Println("DB error: ", err)
+			continue
+		}
+
+		log.Println("messageLoader: ", len(pendingMsgs), " pending messages found")
+		for _, msg := range pendingMsgs {
+			if countToFetch == 0 {
+				break
+			}
+			if !g.hold(msg.UUID) {
+				continue
+			}
+			countToFetch--
+			select {
+			case g.queue <- msg:
+			case <-ctx.Done():
+				g.release(msg.UUID)
+				return
+			}
+		}
+	}
+}
+
+// GetDevices returns all configured devices with their latest health samples
+func (g *Gateway) GetDevices(historySize int) ([]DeviceInfo, error) {
+	var infos []DeviceInfo
+	for _, device := range g.devices {
+		history, err := g.GetDeviceStatusHistory(device.Driver.DeviceId, historySize)
+		if err != nil {
+			return nil, err
+		}
+
+		info := DeviceInfo{Device: device.Driver.DeviceId, Online: device.Online(), Reason: device.Reason(), Storage: device.Storage(),
+			Usage: device.Usage(), History: history}
+		if len(history) > 0 {
+			info.Status = &history[0]
+		}
+		if info.Balance, err = g.getDeviceBalance(device.Driver.DeviceId); err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// RunUSSD sends USSD code or menu reply through device and returns network
+// answer, session stays open when the answer asks for reply
+func (g *Gateway) RunUSSD(deviceId, code string) (*modem.USSDResponse, error) {
+	for _, device := range g.devices {
+		if device.Driver.DeviceId != deviceId {
+			continue
+		}
+		if !device.Online() {
+			return nil, errors.New("device is offline: " + deviceId)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), modem.DefaultUSSDTimeout)
+		defer cancel()
+		return device.Driver.USSD(ctx, code)
+	}
+	return nil, errors.New("unknown device: " + deviceId)
+}
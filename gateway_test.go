@@ -0,0 +1,299 @@
+package gosms
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haxpax/gosms/modem"
+	"github.com/haxpax/gosms/modem/simulator"
+)
+
+// testOptions returns options with fresh database and short timeouts, no
+// polling and no health sampling. Message loader looks at database whenever
+// message is enqueued or device comes online
+func testOptions(t *testing.T) Options {
+	t.Helper()
+
+	db, err := InitDB("sqlite3", filepath.Join(t.TempDir(), "db.sqlite"))
+	if err != nil {
+		t.Fatalf("InitDB failed: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	options := DefaultOptions()
+	options.DB = db
+	options.PollInterval = 0
+	options.HealthInterval = 0
+	options.LoaderTimeout = 0
+	options.LoaderLongTimeout = time.Minute
+	options.ReconnectDelay = 50 * time.Millisecond
+	options.ReconnectMaxDelay = 100 * time.Millisecond
+	return options
+}
+
+// simDriver registers simulator under name of the test and returns driver
+// for it, id is device id
+func simDriver(t *testing.T, id string, sim *simulator.Modem) *modem.Driver {
+	name := strings.Replace(t.Name(), "/", "-", -1) + "-" + id
+	simulator.Register(name, sim)
+	return modem.New("sim://"+name, 115200, id)
+}
+
+// startGateway starts gateway which is stopped when test ends
+func startGateway(t *testing.T, options Options) *Gateway {
+	t.Helper()
+
+	g := NewGateway(options)
+	if err := g.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	t.Cleanup(g.Stop)
+	return g
+}
+
+// getMessage reads outgoing message from database
+func getMessage(t *testing.T, g *Gateway, uuid string) OutgoingSMS {
+	t.Helper()
+
+	messages, err := g.GetOutgoingMessages(fmt.Sprintf("WHERE uuid='%s'", uuid))
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("message %s: %v, %v", uuid, messages, err)
+	}
+	return messages[0]
+}
+
+// waitStatus waits until message gets given status
+func waitStatus(t *testing.T, g *Gateway, uuid string, status int) OutgoingSMS {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		message := getMessage(t, g, uuid)
+		if message.Status == status {
+			return message
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("message %s has status %d, want %d", uuid, message.Status, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGatewaySendMessage(t *testing.T) {
+	sim := simulator.New()
+	options := testOptions(t)
+	options.Drivers = []*modem.Driver{simDriver(t, "gsm0", sim)}
+	g := startGateway(t, options)
+
+	if err := g.SendMessage(&OutgoingSMS{UUID: "first", Mobile: "+447700900123", Body: "hello"}); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+
+	message := waitStatus(t, g, "first", SMSProcessed)
+	if message.Device != "gsm0" || message.Retries != 1 || message.Error != "" {
+		t.Errorf("got %+v", message)
+	}
+	if sent := sim.Sent(); len(sent) != 1 || sent[0].Text != "hello" {
+		t.Errorf("simulator sent %+v", sent)
+	}
+}
+
+func TestGatewayLoadsPendingMessages(t *testing.T) {
+	sim := simulator.New()
+	options := testOptions(t)
+	options.Drivers = []*modem.Driver{simDriver(t, "gsm0", sim)}
+
+	// messages left pending by previous run
+	g := NewGateway(options)
+	for i := 0; i < 3; i++ {
+		message := &OutgoingSMS{UUID: fmt.Sprint("old", i), Mobile: "+447700900123", Body: fmt.Sprint("message ", i)}
+		if err := g.insertOutgoingMessage(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := g.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer g.Stop()
+
+	for i := 0; i < 3; i++ {
+		waitStatus(t, g, fmt.Sprint("old", i), SMSProcessed)
+	}
+	if sent := sim.Sent(); len(sent) != 3 {
+		t.Errorf("simulator sent %d messages, want 3", len(sent))
+	}
+}
+
+func TestGatewayNoDuplicates(t *testing.T) {
+	sim := simulator.New()
+	options := testOptions(t)
+	options.Drivers = []*modem.Driver{simDriver(t, "gsm0", sim)}
+	options.BufferSize = 2
+	options.LoaderLongTimeout = 20 * time.Millisecond
+	g := startGateway(t, options)
+
+	// slow device keeps messages in its queue while loader looks at
+	// database, they are pending there but must not be loaded again
+	sim.Script(simulator.Behaviour{Command: "AT+CMGS", Delay: 50 * time.Millisecond})
+	for i := 0; i < 8; i++ {
+		if err := g.SendMessage(&OutgoingSMS{UUID: fmt.Sprint("m", i), Mobile: "+447700900123", Body: fmt.Sprint("message ", i)}); err != nil {
+			t.Fatalf("SendMessage failed: %v", err)
+		}
+	}
+	for i := 0; i < 8; i++ {
+		waitStatus(t, g, fmt.Sprint("m", i), SMSProcessed)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	count := map[string]int{}
+	for _, sent := range sim.Sent() {
+		count[sent.Text]++
+	}
+	if len(count) != 8 || len(sim.Sent()) != 8 {
+		t.Errorf("sent %d messages, %d different ones", len(sim.Sent()), len(count))
+	}
+}
+
+func TestGatewayOfflineDevice(t *testing.T) {
+	sim := simulator.New()
+	sim.Unplug()
+	options := testOptions(t)
+	options.Drivers = []*modem.Driver{simDriver(t, "gsm0", sim)}
+	g := startGateway(t, options)
+
+	if err := g.SendMessage(&OutgoingSMS{UUID: "waiting", Mobile: "+447700900123", Body: "hello"}); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+
+	// message waits in database for the device, no attempt is counted
+	time.Sleep(300 * time.Millisecond)
+	if message := getMessage(t, g, "waiting"); message.Status != SMSPending || message.Retries != 0 {
+		t.Errorf("got %+v", message)
+	}
+
+	sim.Plug()
+	waitStatus(t, g, "waiting", SMSProcessed)
+}
+
+func TestGatewayRequeue(t *testing.T) {
+	sim := simulator.New()
+	options := testOptions(t)
+	options.Drivers = []*modem.Driver{simDriver(t, "gsm0", sim)}
+	g := startGateway(t, options)
+
+	// modem is lost while it sends the message
+	sim.Script(simulator.Behaviour{Command: "AT+CMGS", Silent: true, Times: 1})
+	if err := g.SendMessage(&OutgoingSMS{UUID: "lost", Mobile: "+447700900123", Body: "hello"}); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	sim.Unplug()
+	time.Sleep(200 * time.Millisecond)
+	if message := getMessage(t, g, "lost"); message.Status != SMSPending || message.Retries != 0 {
+		t.Errorf("lost attempt was counted: %+v", message)
+	}
+
+	sim.Plug()
+	if message := waitStatus(t, g, "lost", SMSProcessed); message.Retries != 1 {
+		t.Errorf("got %+v", message)
+	}
+	if sent := sim.Sent(); len(sent) != 1 {
+		t.Errorf("simulator sent %d messages, want 1", len(sent))
+	}
+}
+
+func TestGatewayStartErrors(t *testing.T) {
+	if err := NewGateway(DefaultOptions()).Start(context.Background()); err == nil {
+		t.Error("gateway without database started")
+	}
+
+	g := startGateway(t, testOptions(t))
+	if err := g.Start(context.Background()); err == nil {
+		t.Error("gateway started twice")
+	}
+}
+
+func TestGatewayShutdown(t *testing.T) {
+	sim := simulator.New()
+	options := testOptions(t)
+	options.Drivers = []*modem.Driver{simDriver(t, "gsm0", sim)}
+	g := startGateway(t, options)
+
+	// message being sent is finished
+	sim.Script(simulator.Behaviour{Command: "AT+CMGS", Delay: 300 * time.Millisecond})
+	if err := g.SendMessage(&OutgoingSMS{UUID: "slow", Mobile: "+447700900123", Body: "hello"}); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := g.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+	if message := getMessage(t, g, "slow"); message.Status != SMSProcessed {
+		t.Errorf("got %+v", message)
+	}
+}
+
+func TestGatewayShutdownDeadline(t *testing.T) {
+	sim := simulator.New()
+	options := testOptions(t)
+	options.Drivers = []*modem.Driver{simDriver(t, "gsm0", sim)}
+	g := startGateway(t, options)
+
+	// message which is not sent by the deadline stays pending
+	sim.Script(simulator.Behaviour{Command: "AT+CMGS", Silent: true})
+	if err := g.SendMessage(&OutgoingSMS{UUID: "stuck", Mobile: "+447700900123", Body: "hello"}); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := g.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown = %v, want deadline error", err)
+	}
+	if message := getMessage(t, g, "stuck"); message.Status != SMSPending || message.Retries != 0 {
+		t.Errorf("aborted attempt was counted: %+v", message)
+	}
+}
+
+func TestGatewayRejectedPIN(t *testing.T) {
+	sim := simulator.New()
+	sim.SIM, sim.PIN = "SIM PIN", "1234"
+	options := testOptions(t)
+	driver := simDriver(t, "gsm0", sim)
+	driver.PIN = "0000"
+	options.Drivers = []*modem.Driver{driver}
+	g := startGateway(t, options)
+	if device := g.devices[0]; device.Online() {
+		t.Fatal("device with wrong PIN is online")
+	}
+	g.Stop()
+
+	// restarted gateway does not enter the same PIN again
+	restart := func(pin string) *Device {
+		driver := modem.New(driver.ComPort, 115200, "gsm0")
+		driver.PIN = pin
+		options.Drivers = []*modem.Driver{driver}
+		g := startGateway(t, options)
+		defer g.Stop()
+		return g.devices[0]
+	}
+	if device := restart("0000"); device.Online() || !strings.Contains(device.Reason(), "failed before") {
+		t.Errorf("online %v, reason %q", device.Online(), device.Reason())
+	}
+	if sim.SIM != "SIM PIN" {
+		t.Errorf("SIM state %q, want SIM PIN", sim.SIM)
+	}
+
+	// changed PIN is tried
+	if device := restart("1234"); !device.Online() {
+		t.Errorf("device is offline: %q", device.Reason())
+	}
+}
@@ -0,0 +1,124 @@
+package gosms
+
+import (
+	"log"
+	"time"
+)
+
+// DeviceLimits are most messages device sends per minute, day and month,
+// zero means no limit. Every part of long message counts
+type DeviceLimits struct {
+	PerMinute int
+	PerDay    int
+	PerMonth  int
+}
+
+// DeviceUsage is number of messages device sent in last minute, today and
+// this month, days and months are in local time
+type DeviceUsage struct {
+	Minute      int `json:"minute"`
+	Day         int `json:"day"`
+	Month       int `json:"month"`
+	MinuteLimit int `json:"minute_limit"`
+	DayLimit    int `json:"day_limit"`
+	MonthLimit  int `json:"month_limit"`
+}
+
+func (d *Device) limits() DeviceLimits {
+	return d.gateway.options.Limits[d.Driver.DeviceId]
+}
+
+// Usage returns messages sent by device together with its limits
+func (d *Device) Usage() DeviceUsage {
+	limits := d.limits()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rollUsage(time.Now())
+	return DeviceUsage{
+		Minute:      len(d.recent),
+		Day:         d.sentDay,
+		Month:       d.sentMonth,
+		MinuteLimit: limits.PerMinute,
+		DayLimit:    limits.PerDay,
+		MonthLimit:  limits.PerMonth,
+	}
+}
+
+// AtQuota reports whether device used up its daily or monthly quota, such
+// device takes no messages until the quota renews
+func (d *Device) AtQuota() bool {
+	usage := d.Usage()
+	return (usage.DayLimit > 0 && usage.Day >= usage.DayLimit) ||
+		(usage.MonthLimit > 0 && usage.Month >= usage.MonthLimit)
+}
+
+// rateWait returns how long device has to wait before it may send next
+// message without going over its limit per minute
+func (d *Device) rateWait() time.Duration {
+	limit := d.limits().PerMinute
+	if limit <= 0 {
+		return 0
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	d.rollUsage(now)
+	if len(d.recent) < limit {
+		return 0
+	}
+	return d.recent[len(d.recent)-limit].Add(time.Minute).Sub(now)
+}
+
+// rollUsage forgets sends older than a minute and starts new day or month,
+// caller holds d.mu
+func (d *Device) rollUsage(now time.Time) {
+	for len(d.recent) > 0 && now.Sub(d.recent[0]) >= time.Minute {
+		d.recent = d.recent[1:]
+	}
+
+	day := now.Format("2006-01-02")
+	if day == d.usageDay {
+		return
+	}
+	if len(d.usageDay) < 7 || day[:7] != d.usageDay[:7] {
+		d.sentMonth = 0
+	}
+	d.sentDay = 0
+	d.usageDay = day
+}
+
+// countSent adds sent parts to usage and stores it, so that quotas hold
+// across restarts
+func (d *Device) countSent(parts int) {
+	now := time.Now()
+
+	d.mu.Lock()
+	d.rollUsage(now)
+	for i := 0; i < parts; i++ {
+		d.recent = append(d.recent, now)
+	}
+	d.sentDay += parts
+	d.sentMonth += parts
+	day := d.usageDay
+	d.mu.Unlock()
+
+	if err := d.gateway.addDeviceUsage(d.Driver.DeviceId, day, parts); err != nil {
+		log.Println("DB error: ", err)
+	}
+}
+
+// loadUsage reads messages sent today and this month from database
+func (d *Device) loadUsage() error {
+	day := time.Now().Format("2006-01-02")
+	sentDay, sentMonth, err := d.gateway.getDeviceUsage(d.Driver.DeviceId, day)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.usageDay, d.sentDay, d.sentMonth = day, sentDay, sentMonth
+	d.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,108 @@
+package gosms
+
+import (
+	"testing"
+	"time"
+
+	"github.com/haxpax/gosms/modem"
+	"github.com/haxpax/gosms/modem/simulator"
+)
+
+func TestRollUsage(t *testing.T) {
+	now := time.Date(2015, 2, 1, 12, 0, 0, 0, time.Local)
+	tests := []struct {
+		usageDay         string
+		wantDay, wantMon int
+	}{
+		{"2015-02-01", 5, 20}, // same day
+		{"2015-01-31", 0, 0},  // new month
+		{"", 0, 0},            // nothing loaded yet
+	}
+
+	for _, test := range tests {
+		d := &Device{usageDay: test.usageDay, sentDay: 5, sentMonth: 20}
+		d.recent = []time.Time{now.Add(-2 * time.Minute), now.Add(-time.Minute), now.Add(-time.Second)}
+		d.rollUsage(now)
+		if d.sentDay != test.wantDay || d.sentMonth != test.wantMon || d.usageDay != "2015-02-01" || len(d.recent) != 1 {
+			t.Errorf("from %q: %+v", test.usageDay, d)
+		}
+	}
+
+	d := &Device{usageDay: "2015-02-01", sentDay: 5, sentMonth: 20}
+	d.rollUsage(now.AddDate(0, 0, 1))
+	if d.sentDay != 0 || d.sentMonth != 20 {
+		t.Errorf("new day: %+v", d)
+	}
+}
+
+func TestRateWait(t *testing.T) {
+	devices := testDevices("a")
+	d := devices[0]
+	d.gateway.options.Limits = map[string]DeviceLimits{"a": {PerMinute: 2}}
+
+	if wait := d.rateWait(); wait != 0 {
+		t.Errorf("idle device waits %v", wait)
+	}
+
+	now := time.Now()
+	d.recent = []time.Time{now.Add(-30 * time.Second), now.Add(-10 * time.Second)}
+	if wait := d.rateWait(); wait < 29*time.Second || wait > 30*time.Second {
+		t.Errorf("device waits %v, want 30s", wait)
+	}
+}
+
+func TestGatewayQuota(t *testing.T) {
+	limited, spare := simulator.New(), simulator.New()
+	options := testOptions(t)
+	options.Drivers = []*modem.Driver{simDriver(t, "limited", limited), simDriver(t, "spare", spare)}
+	options.Limits = map[string]DeviceLimits{"limited": {PerDay: 2}}
+	g := startGateway(t, options)
+
+	for _, uuid := range []string{"m0", "m1", "m2", "m3", "m4", "m5"} {
+		if err := g.SendMessage(&OutgoingSMS{UUID: uuid, Mobile: "+447700900123", Body: uuid}); err != nil {
+			t.Fatalf("SendMessage failed: %v", err)
+		}
+		waitStatus(t, g, uuid, SMSProcessed)
+	}
+	if len(limited.Sent()) != 2 || len(spare.Sent()) != 4 {
+		t.Errorf("devices sent %d and %d messages, want 2 and 4", len(limited.Sent()), len(spare.Sent()))
+	}
+
+	// message pinned to device at quota waits
+	if err := g.SendMessage(&OutgoingSMS{UUID: "pinned", Mobile: "+447700900123", Body: "hello", Target: "limited"}); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if message := getMessage(t, g, "pinned"); message.Status != SMSPending || message.Retries != 0 {
+		t.Errorf("got %+v", message)
+	}
+
+	// usage is kept across restarts
+	g.Stop()
+	restarted := startGateway(t, options)
+	if usage := restarted.devices[0].Usage(); usage.Day != 2 || usage.Month != 2 || usage.DayLimit != 2 {
+		t.Errorf("usage after restart %+v", usage)
+	}
+}
+
+func TestGatewayRateLimit(t *testing.T) {
+	limited, spare := simulator.New(), simulator.New()
+	options := testOptions(t)
+	options.Drivers = []*modem.Driver{simDriver(t, "limited", limited), simDriver(t, "spare", spare)}
+	options.Limits = map[string]DeviceLimits{"limited": {PerMinute: 1}}
+	g := startGateway(t, options)
+
+	// device which waits for its rate limit is skipped while other one can send
+	for _, uuid := range []string{"m0", "m1", "m2", "m3"} {
+		if err := g.SendMessage(&OutgoingSMS{UUID: uuid, Mobile: "+447700900123", Body: uuid}); err != nil {
+			t.Fatalf("SendMessage failed: %v", err)
+		}
+		waitStatus(t, g, uuid, SMSProcessed)
+	}
+	if len(limited.Sent()) != 1 || len(spare.Sent()) != 3 {
+		t.Errorf("devices sent %d and %d messages, want 1 and 3", len(limited.Sent()), len(spare.Sent()))
+	}
+	if usage := g.devices[0].Usage(); usage.Minute != 1 || usage.MinuteLimit != 1 {
+		t.Errorf("usage %+v", usage)
+	}
+}
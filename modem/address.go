@@ -0,0 +1,118 @@
+package modem
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// kinds of address, see ParseAddress
+const (
+	AddressNational      = iota // digits as dialled within the country, trunk prefix included
+	AddressInternational        // E.164 number given with leading +
+	AddressShortCode            // few digits valid within operator network only
+	AddressAlphanumeric         // sender name, e.g. of a bank, it can not be replied to
+)
+
+// type of address octets used by AT commands and PDUs, 3GPP TS 23.040 9.1.2.5
+const (
+	TypeUnknown       = 129 // unknown type of number, ISDN numbering plan
+	TypeInternational = 145
+	TypeAlphanumeric  = 208
+)
+
+// numbers of at most shortCodeDigits digits are taken as short codes
+const shortCodeDigits = 6
+
+// Address is phone number or alphanumeric sender classified by its type of
+// number
+type Address struct {
+	Kind  int
+	Value string // digits without +, or name
+}
+
+// ParseAddress classifies number or sender name given by user or modem.
+// Spaces, dashes, dots and parentheses in numbers are ignored, international
+// numbers must be valid E.164 numbers and names must fit 11 GSM characters
+func ParseAddress(value string) (Address, error) {
+	value = strings.TrimSpace(value)
+	number := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(" -.()/", r) {
+			return -1
+		}
+		return r
+	}, value)
+
+	switch {
+	case value == "":
+		return Address{}, fmt.Errorf("%w: empty", ErrInvalidAddress)
+	case strings.HasPrefix(number, "+"):
+		digits := number[1:]
+		if !isDigits(digits) || len(digits) < 7 || len(digits) > 15 || digits[0] == '0' {
+			return Address{}, fmt.Errorf("%w: %s is not E.164 number", ErrInvalidAddress, value)
+		}
+		return Address{Kind: AddressInternational, Value: digits}, nil
+	case isDigits(number):
+		if len(number) > 20 { // address field holds 20 semi-octets
+			return Address{}, fmt.Errorf("%w: %s is too long", ErrInvalidAddress, value)
+		}
+		if len(number) <= shortCodeDigits {
+			return Address{Kind: AddressShortCode, Value: number}, nil
+		}
+		return Address{Kind: AddressNational, Value: number}, nil
+	}
+
+	if septets, err := EncodeGSM7(value); err != nil || len(septets) > 11 {
+		return Address{}, fmt.Errorf("%w: %s is not a number nor name of at most 11 GSM characters", ErrInvalidAddress, value)
+	}
+	return Address{Kind: AddressAlphanumeric, Value: value}, nil
+}
+
+// String returns international numbers with leading +
+func (a Address) String() string {
+	if a.Kind == AddressInternational {
+		return "+" + a.Value
+	}
+	return a.Value
+}
+
+// Type returns type of address as given to AT+CMGS and shown in +CLIP
+func (a Address) Type() int {
+	switch a.Kind {
+	case AddressInternational:
+		return TypeInternational
+	case AddressAlphanumeric:
+		return TypeAlphanumeric
+	}
+	return TypeUnknown
+}
+
+// recipient validates destination of sent message
+func recipient(mobile string) (Address, error) {
+	address, err := ParseAddress(mobile)
+	if err != nil {
+		return address, err
+	}
+	if address.Kind == AddressAlphanumeric {
+		return address, fmt.Errorf("%w: messages can not be sent to name %s", ErrInvalidAddress, mobile)
+	}
+	return address, nil
+}
+
+// numberWithType adds + to international number which modem gave with type
+// of address 145 but without the sign
+func numberWithType(number, toa string) string {
+	if t, _ := strconv.Atoi(strings.TrimSpace(toa)); t == TypeInternational && number != "" && !strings.HasPrefix(number, "+") {
+		return "+" + number
+	}
+	return number
+}
+
+func isDigits(value string) bool {
+	for _, c := range value {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return value != ""
+}
@@ -0,0 +1,85 @@
+package modem
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		value string
+		kind  int
+		text  string
+		toa   int
+	}{
+		{"+447700900123", AddressInternational, "+447700900123", TypeInternational},
+		{" +44 (0)7700-900.123 ", AddressInternational, "+4407700900123", TypeInternational},
+		{"+1234567", AddressInternational, "+1234567", TypeInternational},
+		{"07700900123", AddressNational, "07700900123", TypeUnknown},
+		{"1234567", AddressNational, "1234567", TypeUnknown},
+		{"123456", AddressShortCode, "123456", TypeUnknown},
+		{"1234", AddressShortCode, "1234", TypeUnknown},
+		{"MyBank", AddressAlphanumeric, "MyBank", TypeAlphanumeric},
+		{"Info 24", AddressAlphanumeric, "Info 24", TypeAlphanumeric},
+	}
+
+	for _, test := range tests {
+		address, err := ParseAddress(test.value)
+		if err != nil {
+			t.Errorf("ParseAddress(%q) failed: %v", test.value, err)
+			continue
+		}
+		if address.Kind != test.kind || address.String() != test.text || address.Type() != test.toa {
+			t.Errorf("ParseAddress(%q) = %+v, %s, %d, want kind %d, %s, %d",
+				test.value, address, address.String(), address.Type(), test.kind, test.text, test.toa)
+		}
+	}
+}
+
+func TestParseAddressInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"   ",
+		"+",
+		"+123456",           // too short for E.164
+		"+1234567890123456", // too long for E.164
+		"+0123456789",       // country code can not start with 0
+		"+44 7700 9001a3",
+		"123456789012345678901", // does not fit address field
+		"Longer than eleven",
+		"Привет",
+	}
+
+	for _, value := range tests {
+		if address, err := ParseAddress(value); !errors.Is(err, ErrInvalidAddress) {
+			t.Errorf("ParseAddress(%q) = %+v, %v, want ErrInvalidAddress", value, address, err)
+		}
+	}
+}
+
+func TestRecipient(t *testing.T) {
+	if _, err := recipient("MyBank"); !errors.Is(err, ErrInvalidAddress) {
+		t.Errorf("message to name was accepted: %v", err)
+	}
+	if _, err := recipient("1234"); err != nil {
+		t.Errorf("message to short code was refused: %v", err)
+	}
+}
+
+func TestNumberWithType(t *testing.T) {
+	tests := []struct {
+		number, toa, want string
+	}{
+		{"447700900123", "145", "+447700900123"},
+		{"+447700900123", "145", "+447700900123"},
+		{"07700900123", "129", "07700900123"},
+		{"447700900123", "", "447700900123"},
+		{"", "145", ""},
+	}
+
+	for _, test := range tests {
+		if got := numberWithType(test.number, test.toa); got != test.want {
+			t.Errorf("numberWithType(%q, %q) = %q, want %q", test.number, test.toa, got, test.want)
+		}
+	}
+}
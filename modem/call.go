@@ -0,0 +1,8 @@
+package modem
+
+// Hangup rejects incoming call or ends the running one, modem keeps ringing
+// otherwise and the caller hears ringing tone until they give up
+func (m *Driver) Hangup() error {
+	_, err := m.Exec("ATH\r\n")
+	return err
+}
@@ -1,7 +1,7 @@
 package modem
 
 import (
-	"github.com/tarm/serial"
+	"context"
 	"log"
 	"strings"
 	"errors"
@@ -10,170 +10,547 @@ import (
 	"regexp"
 	"strconv"
 	"unicode/utf16"
-	"math/rand"
 	"time"
+	"sync"
+)
+
+// SMS message formats selected by AT+CMGF
+const (
+	TextMode = iota
+	PDUMode
 )
 
 type Driver struct {
 	ComPort  string
 	BaudRate int
-	Port     *serial.Port
+	Mode     int
+	Port     Transport
 	DeviceId string
+
+	// Concat16 selects 16-bit reference number in concatenation header,
+	// ConcatReference is the reference used for next long message
+	Concat16        bool
+	ConcatReference uint16
+
+	// StatusReports requests delivery report for every sent message
+	StatusReports bool
+
+	// Storage is preferred message storage, e.g. SM, ME or MT, empty means
+	// the one of Profile
+	Storage string
+
+	// Profile selects vendor specific behaviour, nil means detect it on
+	// every connect
+	Profile *Profile
+
+	// PIN unlocks SIM which asks for it, PIN whose entry failed is never
+	// tried again as every attempt brings the SIM closer to PUK lock.
+	// RejectedPIN is the PIN which failed, owner keeps it across restarts
+	PIN         string
+	RejectedPIN string
+
+	// CommandTimeout bounds commands sent without explicit timeout,
+	// SendTimeout bounds every part of sent message as the modem waits for
+	// the network, zero means default
+	CommandTimeout time.Duration
+	SendTimeout    time.Duration
+
+	profile     *Profile
+	storage     string
+	responses   chan string
+	done        chan struct{}
+	mu          sync.Mutex
+	cmdMu       sync.Mutex // held for whole exchange, e.g. AT+CMGS with its body
+	ussdMu      sync.Mutex
+	command     string
+	subscribers []chan Event
 }
 
+// default timeouts, a modem which behaves nicely answers well in time
+const (
+	DefaultCommandTimeout = 5 * time.Second
+	DefaultSendTimeout    = 60 * time.Second
+)
+
 func New(ComPort string, BaudRate int, DeviceId string) (modem *Driver) {
 	modem = &Driver{ComPort: ComPort, BaudRate: BaudRate, DeviceId: DeviceId}
 	return modem
 }
 
 func (m *Driver) Connect() (err error) {
-	config := &serial.Config{Name: m.ComPort, Baud: m.BaudRate, ReadTimeout: time.Second * 5} // read timeout should not happen if modem will behave nicely
-	m.Port, err = serial.OpenPort(config)
+	port, err := Dial(m.ComPort, m.BaudRate)
 
 	if err == nil {
-		m.initModem()
+		responses := make(chan string, 64)
+		done := make(chan struct{})
+
+		// commands in flight finish with the old port before it is replaced
+		m.cmdMu.Lock()
+		m.mu.Lock()
+		m.Port, m.responses, m.done = port, responses, done
+		m.mu.Unlock()
+		m.cmdMu.Unlock()
+		go m.readLoop(port, responses, done)
+
+		err = m.initModem()
+		if err != nil {
+			m.Close()
+		}
 	}
 
 	return err
 }
 
-func (m *Driver) initModem() {
-	m.SendCommand("ATE0\r\n", true) // echo off
+// Close releases the port, Closed channel is closed once reader stops.
+// It may be called while other goroutine sends command
+func (m *Driver) Close() error {
+	m.mu.Lock()
+	port := m.Port
+	m.Port = nil
+	m.mu.Unlock()
+
+	if port == nil {
+		return nil
+	}
+	return port.Close()
+}
+
+// port returns open port, nil after Close
+func (m *Driver) port() Transport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.Port
+}
+
+// Closed returns channel which is closed when port is lost, it is replaced
+// by every Connect
+func (m *Driver) Closed() <-chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.done
+}
+
+// Connected reports whether port is open and being read
+func (m *Driver) Connected() bool {
+	done := m.Closed()
+	if done == nil || m.port() == nil {
+		return false
+	}
+
+	select {
+	case <-done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (m *Driver) initModem() error {
+	if !strings.Contains(m.SendCommand("ATE0\r\n", true), "OK") { // echo off
+		return errors.New("modem is not responding")
+	}
 	m.SendCommand("AT+CMEE=1\r\n", true) // useful error messages
-	m.SendCommand("AT+WIND=0\r\n", true) // disable notifications
-	m.SendCommand("AT+CMGF=1\r\n", true) // switch to Text SMS Mode mode
+	if err := m.unlockSIM(); err != nil {
+		return err
+	}
+
+	profile := m.Profile
+	if profile == nil {
+		profile = m.detectProfile()
+	}
+	// reader decodes URCs with the profile meanwhile
+	m.mu.Lock()
+	m.profile = profile
+	m.mu.Unlock()
+	for _, command := range profile.Init {
+		if _, err := m.Exec(command + "\r\n"); err != nil {
+			m.log("--- Profile:", profile.Name, command, err.Error())
+		}
+	}
+
+	if m.Mode == PDUMode {
+		m.SendCommand("AT+CMGF=0\r\n", true) // switch to PDU mode
+	} else {
+		m.SendCommand("AT+CMGF=1\r\n", true) // switch to Text SMS Mode mode
+	}
 	m.SendCommand("AT+CSCS=\"UCS2\"\r\n", true); // switch to ucs2 communication
-	m.SendCommand("AT+CPMS=\"MT\"\r\n", true) // read SMS messages from SIM and device memory
+	m.SendCommand("AT+CREG=1\r\n", true) // report network registration changes
+	m.SendCommand("AT+CLIP=1\r\n", true) // identify caller with +CLIP after RING
+	storage := m.Storage
+	if storage == "" {
+		storage = profile.Storage
+	}
+	if err := m.selectStorage(storage); err != nil {
+		m.log("--- Storage:", storage, err.Error())
+		m.setStorage("SM") // every modem can read messages from SIM
+		m.selectStorage("SM")
+	}
+	// indicate new messages with +CMTI, route status reports as +CDS, they
+	// are routed even without StatusReports as single message may ask for one
+	m.SendCommand("AT+CNMI=2,1,0,1,0\r\n", true)
+
+	if !m.Connected() {
+		return ErrPortClosed
+	}
+	return nil
 }
 
+// Expect waits for response containing one of possibilities, it is meant to
+// follow Send and neither is safe for concurrent use, see SendCommandContext
 func (m *Driver) Expect(possibilities []string) (string, error) {
-	buffer := make([]byte, 128)
+	return m.expect(context.Background(), possibilities, m.commandTimeout())
+}
+
+func (m *Driver) expect(ctx context.Context, possibilities []string, timeout time.Duration) (string, error) {
 	var output bytes.Buffer
+	defer m.setCommand("")
 
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 	for {
-		c, err := m.Port.Read(buffer)
-		output.WriteString(string(buffer[:c]))
+		select {
+		case response, ok := <-m.responses:
+			if !ok {
+				m.log("--- Expect:", strings.Join(possibilities, "|"), "Got:", output.String(), "(port closed!)")
+				return output.String(), ErrPortClosed
+			}
+			output.WriteString(response)
 
-		for _, possibility := range possibilities {
-			if strings.Contains(output.String(), possibility) {
-				m.log("--- Expect:", strings.Join(possibilities, "|"), "Got:", output.String());
-				return output.String(), nil
+			for _, possibility := range possibilities {
+				if strings.Contains(output.String(), possibility) {
+					m.log("--- Expect:", strings.Join(possibilities, "|"), "Got:", output.String())
+					return output.String(), nil
+				}
 			}
+		case <-timer.C:
+			m.log("--- Expect:", strings.Join(possibilities, "|"), "Got:", output.String(), "(match not found!)")
+			return output.String(), ErrTimeout
+		case <-ctx.Done():
+			m.log("--- Expect:", strings.Join(possibilities, "|"), "Got:", output.String(), "(cancelled!)")
+			return output.String(), ctx.Err()
 		}
+	}
+}
 
-		if err != nil {
-			break;
-		}
+// Send writes command to modem, port is closed when write fails so the
+// device can be reconnected
+func (m *Driver) Send(command string) error {
+	if strings.HasPrefix(command, "AT+CPIN=") {
+		m.log("--- Send: AT+CPIN=****") // keep PIN out of logs
+	} else {
+		m.log("--- Send:", command)
+	}
+	port := m.port()
+	if port == nil {
+		return ErrPortClosed
 	}
+	m.setCommand(command)
 
-	m.log("--- Expect:", strings.Join(possibilities, "|"), "Got:", output.String(), "(match not found!)");
-	return output.String(), errors.New("match not found")
-}
+	// forget late responses to previous command
+	for len(m.responses) > 0 {
+		<-m.responses
+	}
 
-func (m *Driver) Send(command string) {
-	m.log("--- Send:", command)
-	_, err := m.Port.Write([]byte(command))
+	_, err := port.Write([]byte(command))
 	if err != nil {
-		log.Fatal(err)
+		m.log("--- Send failed:", err.Error())
+		m.setCommand("")
+		m.Close()
+		return ErrPortClosed
 	}
+
+	return nil
 }
 
-func (m *Driver) SendCommand(command string, waitForOk bool) (output string) {
-	m.Send(command)
+// ActiveProfile returns profile used since last Connect
+func (m *Driver) ActiveProfile() *Profile {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.profile == nil {
+		return ProfileGeneric
+	}
+	return m.profile
+}
 
-	if waitForOk {
-		output, _ = m.Expect([]string{"OK\r\n", "ERROR\r\n"}) // we will not change api so errors are ignored for now
-		time.Sleep(time.Millisecond * 100)
+func (m *Driver) SendCommand(command string, waitForOk bool) (output string) {
+	if !waitForOk {
+		m.cmdMu.Lock()
+		m.Send(command)
+		m.cmdMu.Unlock()
+		return ""
 	}
 
+	output, _ = m.Exec(command) // callers look at the output, see Exec for errors
 	return output
 }
 
-func (m *Driver) SendSMS(mobile string, message string) (sent bool, err error) {
+// Exec sends command and waits for final result code, failure is returned
+// as *CMSError, *CMEError, ErrCommandFailed, ErrTimeout or ErrPortClosed
+func (m *Driver) Exec(command string) (string, error) {
+	return m.SendCommandContext(context.Background(), command, 0)
+}
+
+// SendCommandContext is Exec which gives up when ctx is done or when no
+// final result code arrives within timeout, zero timeout means
+// CommandTimeout. Commands of concurrent callers are sent one after another
+func (m *Driver) SendCommandContext(ctx context.Context, command string, timeout time.Duration) (string, error) {
+	if timeout <= 0 {
+		timeout = m.commandTimeout()
+	}
+
+	m.cmdMu.Lock()
+	defer m.cmdMu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if err := m.Send(command); err != nil {
+		return "", err
+	}
+
+	output, err := m.expect(ctx, finalResults, timeout)
+	if err != nil {
+		return output, err
+	}
+
+	return output, resultError(output)
+}
+
+func (m *Driver) commandTimeout() time.Duration {
+	if m.CommandTimeout > 0 {
+		return m.CommandTimeout
+	}
+	return DefaultCommandTimeout
+}
+
+func (m *Driver) sendTimeout() time.Duration {
+	if m.SendTimeout > 0 {
+		return m.SendTimeout
+	}
+	return DefaultSendTimeout
+}
+
+// SendSMS returns message references assigned by the network to every part
+// of the message, status reports refer to them
+func (m *Driver) SendSMS(mobile string, message string) (sent bool, refs []int, err error) {
+	return m.SendSMSContext(context.Background(), mobile, message)
+}
+
+// SendSMSContext is SendSMS which stops when ctx is done, parts which were
+// already sent stay sent
+func (m *Driver) SendSMSContext(ctx context.Context, mobile string, message string) (sent bool, refs []int, err error) {
+	return m.SendSMSWithOptions(ctx, mobile, message, SendOptions{StatusReport: m.StatusReports})
+}
+
+// SendOptions are settings of single message, zero value sends message
+// without class, with default validity period and without status report
+type SendOptions struct {
+	Class          int // e.g. Class0 for flash message
+	ValidityPeriod time.Duration
+	StatusReport   bool
+}
+
+// SendSMSWithOptions is SendSMSContext with per message settings which
+// override StatusReports of the driver
+func (m *Driver) SendSMSWithOptions(ctx context.Context, mobile string, message string, options SendOptions) (sent bool, refs []int, err error) {
 	log.Println("--- SendSMS ", mobile, message)
 
-	if IsASCII(message) {
-		m.SendCommand("AT+CSMP=17,167,0,0\r\n", true);
-	} else {
-		m.SendCommand("AT+CSMP=17,167,0,8\r\n", true);
+	address, err := recipient(mobile)
+	if err != nil {
+		return false, nil, err
 	}
+	mobile = address.String()
 
-	if IsASCII(message) && len(message) > 160 {
-		return m.sendConcatenatedSMS(mobile, message)
-	} else if IsASCII(message) != true && len(message) > 70 {
-		return m.sendConcatenatedSMS(mobile, message)
+	if m.Mode == PDUMode {
+		return m.sendPDUSMS(ctx, mobile, message, options)
+	}
+
+	firstOctet := 17 // SMS-SUBMIT, relative validity period
+	if options.StatusReport {
+		firstOctet |= 0x20 // status report request
+	}
+
+	alphabet := AlphabetGSM7
+	if !IsASCII(message) {
+		alphabet = AlphabetUCS2
+	}
+	m.SendCommand(fmt.Sprintf("AT+CSMP=%d,%d,0,%d\r\n", firstOctet, EncodeValidity(options.ValidityPeriod), encodeDCS(alphabet, options.Class)), true)
+
+	if (IsASCII(message) && len(message) > 160) || (IsASCII(message) != true && len(message) > 70) {
+		// text mode has no standard way to send user data header, so long
+		// messages always go out as concatenated PDUs
+		m.SendCommand("AT+CMGF=0\r\n", true)
+		sent, refs, err = m.sendPDUSMS(ctx, mobile, message, options)
+		m.SendCommand("AT+CMGF=1\r\n", true)
+		return sent, refs, err
 	} else {
-		return m.sendSingleSMS(mobile, message)
+		return m.sendSingleSMS(ctx, mobile, message)
 	}
 }
 
-func (m *Driver) sendSingleSMS(mobile string, message string) (sent bool, err error) {
-	mobile = ASCII2UCS2HEX(mobile)
+func (m *Driver) sendSingleSMS(ctx context.Context, mobile string, message string) (sent bool, refs []int, err error) {
+	address, err := recipient(mobile)
+	if err != nil {
+		return false, nil, err
+	}
 	message = ASCII2UCS2HEX(message)
 
-	m.Send("AT+CMGS=\""+mobile+"\"\r") // should return ">"
+	command := fmt.Sprintf("AT+CMGS=\"%s\",%d\r", ASCII2UCS2HEX(address.String()), address.Type())
+	refs, err = m.submit(ctx, command, message)
+	return err == nil, refs, err
+}
 
-	m.Expect([]string{">"})
-	time.Sleep(time.Millisecond * 100)
+func (m *Driver) sendPDUSMS(ctx context.Context, mobile string, message string, options SendOptions) (sent bool, refs []int, err error) {
+	parts := SplitMessage(message, m.Concat16)
+	if len(parts) == 1 {
+		return m.sendPDU(ctx, &Submit{
+			Destination:    mobile,
+			Text:           message,
+			StatusReport:   options.StatusReport,
+			Class:          options.Class,
+			ValidityPeriod: options.ValidityPeriod,
+		})
+	}
 
-	// EOM CTRL-Z = 26
-	m.Send(message+string(26));
+	ref := m.ConcatReference
+	m.ConcatReference++
+
+	for i, part := range parts {
+		submit := &Submit{
+			Destination:    mobile,
+			Text:           part,
+			UDH:            ConcatHeader(ref, len(parts), i+1, m.Concat16),
+			StatusReport:   options.StatusReport,
+			Class:          options.Class,
+			ValidityPeriod: options.ValidityPeriod,
+		}
 
-	output, err := m.Expect([]string{"OK\r\n", "ERROR\r\n"})
-	time.Sleep(time.Millisecond * 100)
+		sent, partRefs, err := m.sendPDU(ctx, submit)
+		if !sent {
+			log.Println("Sending of part", i+1, "of", len(parts), "failed")
+			return sent, refs, err
+		}
+		refs = append(refs, partRefs...)
+	}
+
+	return true, refs, nil
+}
 
+func (m *Driver) sendPDU(ctx context.Context, submit *Submit) (sent bool, refs []int, err error) {
+	pdu, length, err := submit.Encode()
 	if err != nil {
-		log.Println("Invalid response to send SMS:", output)
-		return false, nil // we will try again
+		return false, nil, err
 	}
 
-	if strings.HasSuffix(output, "OK\r\n") {
-		return true, nil
-	} else { // ERROR
-		return false, errors.New("ERROR")
-	}
+	refs, err = m.submit(ctx, fmt.Sprintf("AT+CMGS=%d\r", length), pdu)
+	return err == nil, refs, err
 }
 
-func (m *Driver) sendConcatenatedSMS(mobile string, message string) (sent bool, err error) {
-	var messages *[]string
-	if IsASCII(message) {
-		messages = splitString(message, 153) // UDH len in septets = 7
-	} else {
-		messages = splitString(message, 67)
+// submit issues AT+CMGS and gives message body once modem prompts for it,
+// modem may refuse the message right away instead of prompting
+func (m *Driver) submit(ctx context.Context, command, body string) (refs []int, err error) {
+	m.cmdMu.Lock()
+	defer m.cmdMu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := m.Send(command); err != nil {
+		return nil, err
 	}
 
-	ref := rand.Int() % 255
-	total := len(*messages);
+	output, err := m.expect(ctx, append([]string{">"}, finalResults...), m.commandTimeout())
+	if err != nil {
+		if err != ErrPortClosed {
+			m.Send("\x1b") // ESC leaves message entry, prompt may have come late
+		}
+		return nil, err
+	}
+	if !strings.Contains(output, ">") {
+		return nil, resultError(output)
+	}
 
-	var status string
-	for i, message := range *messages {
-		// messagem, (153 char 7-bit / 67 char ucs2)
+	// EOM CTRL-Z = 26
+	if err := m.Send(body + "\x1a"); err != nil {
+		return nil, err
+	}
 
-		m.Send(fmt.Sprintf("AT^SCMS=%s,145,%d,%d,%d,%d\r", ASCII2UCS2HEX(mobile), i + 1, total, 8, ref))
+	// once the body is given message can not be taken back, so cancelling
+	// only stops waiting for the network
+	output, err = m.expect(ctx, finalResults, m.sendTimeout())
+	if err == nil {
+		err = resultError(output)
+	}
+	if err != nil {
+		log.Println("Sending SMS failed:", strings.TrimSpace(output), err)
+		return nil, err
+	}
 
-		m.Expect([]string{">"})
-		time.Sleep(time.Millisecond * 100)
+	return parseMessageReferences(output), nil
+}
 
-		m.Send(ASCII2UCS2HEX(message)+string(26));
+var cmgsLine = regexp.MustCompile(`\+CMGS: (\d+)`)
 
-		status, err = m.Expect([]string{"OK\r\n", "ERROR\r\n"})
-		time.Sleep(time.Millisecond * 100)
+func parseMessageReferences(output string) []int {
+	var refs []int
+	for _, match := range cmgsLine.FindAllStringSubmatch(output, -1) {
+		ref, _ := strconv.Atoi(match[1])
+		refs = append(refs, ref)
+	}
+	return refs
+}
 
-		if err != nil {
-			log.Println("Invalid response to send SMS:", status)
-			break
-		}
+// IncomingMessage is a message read from modem storage, Index is -1 for
+// messages routed directly with +CMT. Parts, Part and Reference are set only
+// for parts of concatenated message
+type IncomingMessage struct {
+	Index      int
+	Status     string    // storage status, e.g. REC UNREAD
+	Originator string
+	Name       string    // phonebook entry or alphanumeric name of originator
+	Timestamp  time.Time // when service centre received the message, in its timezone
+	Body       string
+	Reference  int
+	Parts      int
+	Part       int
+}
+
+// storage status of messages in PDU mode, text mode uses the names
+var pduStatus = map[string]string{"0": "REC UNREAD", "1": "REC READ", "2": "STO UNSENT", "3": "STO SENT"}
+
+// ReadSMS lists all messages in storage, they are left there marked read
+// until they are deleted. Messages are listed as PDUs in text mode as well,
+// text mode drops user data header which tells parts of long message
+func (m *Driver) ReadSMS() []IncomingMessage {
+	messages, _ := m.ListSMS()
+	return messages
+}
+
+// ListSMS is ReadSMS which also counts listed messages it could not decode,
+// they are marked read as well, so DeleteReadSMS would remove them
+func (m *Driver) ListSMS() (messages []IncomingMessage, undecoded int) {
+	if m.Mode == PDUMode {
+		return m.readPDUSMS()
 	}
 
-	if strings.HasSuffix(status, "OK\r\n") {
-		return true, nil
-	} else { // ERROR
-		return false, errors.New("ERROR")
+	if !m.switchToPDU() {
+		return m.readTextSMS()
 	}
+	defer m.SendCommand("AT+CMGF=1\r\n", true)
+	return m.readPDUSMS()
 }
 
-func (m *Driver) ReadSMS() (*[][]string) {
+// switchToPDU selects PDU mode for reading messages in text mode, modems
+// which can not do it are read in text mode
+func (m *Driver) switchToPDU() bool {
+	if _, err := m.Exec("AT+CMGF=0\r\n"); err != nil {
+		m.log("--- PDU mode refused, long messages are read as separate parts:", err.Error())
+		return false
+	}
+	return true
+}
 
+func (m *Driver) readTextSMS() ([]IncomingMessage, int) {
 	/*
 	1. index
 	2. status
@@ -186,21 +563,191 @@ func (m *Driver) ReadSMS() (*[][]string) {
 
 	output := m.SendCommand("AT+CMGL=\"ALL\"\r\n", true);
 	matches := r.FindAllStringSubmatch(output, -1);
-	var messages [][]string
+	var messages []IncomingMessage
 
 	for _, match := range matches {
+		index, _ := strconv.Atoi(match[1]);
+		messages = append(messages, textMessage(index, match[2], match[3], match[4], match[5], match[6]))
+	}
 
-		log.Println("---> incoming message", match[1])
-		log.Printf("     status: %v, originator: %s, name: %s, timestamp: %s\n", match[2], UCS2HEX2ASCII(match[3]), UCS2HEX2ASCII(match[4]), match[5])
-		log.Println("    ", UCS2HEX2ASCII(match[6]), "\n")
+	return messages, strings.Count(output, "+CMGL:") - len(messages)
+}
 
-		messages = append(messages, []string{UCS2HEX2ASCII(match[3]), UCS2HEX2ASCII(match[6])})
+func (m *Driver) readPDUSMS() ([]IncomingMessage, int) {
 
-		index, _ := strconv.Atoi(match[1]);
-		m.DeleteSMS(index)
+	/*
+	1. index
+	2. status
+	3. length
+	4. pdu
+	 */
+	r := regexp.MustCompile(`\+CMGL: (\d+),(\d+),[^,\r\n]*,(\d+)\r?\n([0-9a-fA-F]+)\r?\n`)
+
+	output := m.SendCommand("AT+CMGL=4\r\n", true)
+	matches := r.FindAllStringSubmatch(output, -1)
+	var messages []IncomingMessage
+
+	for _, match := range matches {
+		index, _ := strconv.Atoi(match[1])
+
+		message, err := pduMessage(index, pduStatus[match[2]], match[4])
+		if err != nil {
+			log.Println("---> unable to decode message, left in storage:", match[1], match[4], err)
+		} else {
+			messages = append(messages, *message)
+		}
+	}
+
+	return messages, strings.Count(output, "+CMGL:") - len(messages)
+}
+
+/*
+text mode
+1. status
+2. originator
+3. name
+4. timestamp
+5. message
+*/
+var textCMGR = regexp.MustCompile(`\+CMGR: "([^"]+)","([0-9a-fA-F+]*)",([^,]*),"([^"]+)"\r?\n([0-9a-fA-F]*)\r?\n`)
+
+/*
+PDU mode
+1. status
+2. length
+3. pdu
+*/
+var pduCMGR = regexp.MustCompile(`\+CMGR: (\d+),[^,\r\n]*,(\d+)\r?\n([0-9a-fA-F]+)\r?\n`)
+
+// status report in text mode, fields after status are the same as in +CDS
+var textCMGRReport = regexp.MustCompile(`\+CMGR: "[^"]*",([^\r\n]+)`)
+
+// ReadSMSAt reads single message announced by +CMTI, the message is left in
+// storage until it is deleted with DeleteSMSAt
+func (m *Driver) ReadSMSAt(storage string, index int) (*IncomingMessage, error) {
+	if m.Mode != PDUMode && m.switchToPDU() {
+		defer m.SendCommand("AT+CMGF=1\r\n", true)
+	}
+
+	output, err := m.readAt(storage, index)
+	if err != nil {
+		return nil, err
 	}
 
-	return &messages
+	var message *IncomingMessage
+	if match := pduCMGR.FindStringSubmatch(output); match != nil {
+		message, err = pduMessage(index, pduStatus[match[1]], match[3])
+	} else if match := textCMGR.FindStringSubmatch(output); match != nil {
+		text := textMessage(index, match[1], match[2], match[3], match[4], match[5])
+		message = &text
+	} else {
+		err = fmt.Errorf("no message at %s %d", storage, index)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// ReadStatusReportAt reads and deletes status report announced by +CDSI
+func (m *Driver) ReadStatusReportAt(storage string, index int) (*StatusReport, error) {
+	output, err := m.readAt(storage, index)
+	if err != nil {
+		return nil, err
+	}
+
+	var report *StatusReport
+	if match := pduCMGR.FindStringSubmatch(output); match != nil {
+		report, err = DecodeStatusReport(match[3])
+	} else if match := textCMGRReport.FindStringSubmatch(output); match != nil {
+		report, err = parseTextStatusReport(match[1], true)
+	} else {
+		err = fmt.Errorf("no status report at %s %d", storage, index)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	m.deleteAt(storage, index)
+	return report, nil
+}
+
+// readAt issues AT+CMGR, switching to given storage first if needed
+func (m *Driver) readAt(storage string, index int) (string, error) {
+	if active := m.activeStorage(); storage != "" && storage != active {
+		m.SendCommand(fmt.Sprintf("AT+CPMS=\"%s\"\r\n", storage), true)
+		defer m.SendCommand(fmt.Sprintf("AT+CPMS=\"%s\"\r\n", active), true)
+	}
+
+	output, err := m.Exec(fmt.Sprintf("AT+CMGR=%d\r\n", index))
+	if err != nil {
+		return output, fmt.Errorf("unable to read %s %d: %v", storage, index, err)
+	}
+
+	return output, nil
+}
+
+func (m *Driver) deleteAt(storage string, index int) {
+	if active := m.activeStorage(); storage != "" && storage != active {
+		m.SendCommand(fmt.Sprintf("AT+CPMS=\"%s\"\r\n", storage), true)
+		defer m.SendCommand(fmt.Sprintf("AT+CPMS=\"%s\"\r\n", active), true)
+	}
+
+	m.DeleteSMS(index)
+}
+
+// textMessage decodes message fields listed in text mode with UCS2 charset
+func textMessage(index int, status, originator, name, timestamp, body string) IncomingMessage {
+	originator = decodeUCS2Field(originator)
+	name = decodeUCS2Field(strings.Trim(name, `"`))
+	if address, err := ParseAddress(originator); err == nil && address.Kind == AddressAlphanumeric && name == "" {
+		name = originator
+	}
+	if len(body)%4 == 0 && isHex(body) {
+		body = UCS2HEX2ASCII(body)
+	}
+
+	log.Println("---> incoming message", index)
+	log.Printf("     status: %v, originator: %s, name: %s, timestamp: %s\n", status, originator, name, timestamp)
+	log.Println("    ", body)
+
+	return IncomingMessage{
+		Index:      index,
+		Status:     status,
+		Originator: originator,
+		Name:       name,
+		Timestamp:  parseTextTimestamp(timestamp),
+		Body:       body,
+	}
+}
+
+// pduMessage decodes SMS-DELIVER PDU including concatenation information
+func pduMessage(index int, status, pdu string) (*IncomingMessage, error) {
+	deliver, err := DecodeDeliver(pdu)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("---> incoming message", index)
+	log.Printf("     status: %v, originator: %s, timestamp: %s\n", status, deliver.Originator, deliver.Timestamp)
+	log.Println("    ", deliver.Text)
+
+	message := &IncomingMessage{
+		Index:      index,
+		Status:     status,
+		Originator: deliver.Originator,
+		Name:       deliver.Name(),
+		Timestamp:  deliver.Timestamp,
+		Body:       deliver.Text,
+	}
+	if ref, parts, part, ok := ParseConcatHeader(deliver.UDH); ok {
+		log.Printf("     part %d of %d, reference %d\n", part, parts, ref)
+		message.Reference, message.Parts, message.Part = ref, parts, part
+	}
+
+	return message, nil
 }
 
 func (m *Driver) DeleteSMS(index int) (string, error) {
@@ -216,7 +763,7 @@ func (m *Driver) log(messages... interface{}) {
 		}
 	}
 
-	log.Println(messages);
+	log.Println(messages...);
 }
 
 func ASCII2UCS2HEX(input string) string {
@@ -231,7 +778,7 @@ func UCS2HEX2ASCII(input string) string {
 		if err != nil {
 			log.Fatal(err)
 		}
-		output += string(n)
+		output += string(rune(n))
 	}
 
 	return output
@@ -245,22 +792,3 @@ func IsASCII(s string) bool {
 	}
 	return true
 }
-
-func splitString(s string, n int) *[]string {
-	sub := ""
-	subs := []string{}
-
-	runes := bytes.Runes([]byte(s))
-	l := len(runes)
-	for i, r := range runes {
-		sub = sub + string(r)
-		if (i + 1) % n == 0 {
-			subs = append(subs, sub)
-			sub = ""
-		} else if (i + 1) == l {
-			subs = append(subs, sub)
-		}
-	}
-
-	return &subs
-}
\ No newline at end of file
@@ -0,0 +1,602 @@
+package modem_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haxpax/gosms/modem"
+	"github.com/haxpax/gosms/modem/simulator"
+)
+
+// connect registers simulator under name of the test and connects driver to
+// it in given mode
+func connect(t *testing.T, sim *simulator.Modem, mode int) *modem.Driver {
+	t.Helper()
+
+	name := strings.Replace(t.Name(), "/", "-", -1)
+	simulator.Register(name, sim)
+	driver := modem.New("sim://"+name, 115200, name)
+	driver.Mode = mode
+	driver.CommandTimeout = 500 * time.Millisecond
+	driver.SendTimeout = time.Second
+	if err := driver.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	t.Cleanup(func() { driver.Close() })
+	return driver
+}
+
+// waitEvent returns first event of given type, other events are skipped
+func waitEvent(t *testing.T, events <-chan modem.Event, eventType modem.EventType) modem.Event {
+	t.Helper()
+
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event.Type == eventType {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("no event of type %d arrived", eventType)
+		}
+	}
+}
+
+var modes = []struct {
+	name string
+	mode int
+}{
+	{"text", modem.TextMode},
+	{"pdu", modem.PDUMode},
+}
+
+func TestSendSMS(t *testing.T) {
+	tests := []struct {
+		mobile, text, destination string
+	}{
+		{"+447700900123", "hello", "+447700900123"},
+		{"+44 7700 900-123", "Grüße €", "+447700900123"},
+		{"07700900123", "Привет", "07700900123"},
+		{"1234", "STOP", "1234"},
+	}
+
+	for _, mode := range modes {
+		t.Run(mode.name, func(t *testing.T) {
+			sim := simulator.New()
+			driver := connect(t, sim, mode.mode)
+
+			for i, test := range tests {
+				sent, refs, err := driver.SendSMS(test.mobile, test.text)
+				if !sent || err != nil || len(refs) != 1 || refs[0] != i {
+					t.Errorf("SendSMS(%q, %q) = %v, %v, %v", test.mobile, test.text, sent, refs, err)
+					continue
+				}
+
+				message := sim.Sent()[i]
+				if message.Destination != test.destination || message.Text != test.text || len(message.UDH) != 0 {
+					t.Errorf("SendSMS(%q, %q) sent %+v", test.mobile, test.text, message)
+				}
+				if (message.PDU != "") != (mode.mode == modem.PDUMode) {
+					t.Errorf("message was sent in wrong mode: %+v", message)
+				}
+			}
+		})
+	}
+}
+
+func TestSendSMSWithOptions(t *testing.T) {
+	options := modem.SendOptions{Class: modem.Class0, ValidityPeriod: 2 * time.Hour, StatusReport: true}
+
+	for _, mode := range modes {
+		t.Run(mode.name, func(t *testing.T) {
+			sim := simulator.New()
+			driver := connect(t, sim, mode.mode)
+
+			sent, _, err := driver.SendSMSWithOptions(context.Background(), "+447700900123", "alert", options)
+			if !sent || err != nil {
+				t.Fatalf("SendSMSWithOptions failed: %v", err)
+			}
+
+			message := sim.Sent()[0]
+			if message.Class != modem.Class0 || message.Validity != 2*time.Hour || !message.StatusReport {
+				t.Errorf("sent %+v", message)
+			}
+
+			// options hold for single message only
+			driver.SendSMS("+447700900123", "plain")
+			message = sim.Sent()[1]
+			if message.Class != modem.ClassNone || message.Validity != modem.DefaultValidityPeriod || message.StatusReport {
+				t.Errorf("sent %+v", message)
+			}
+		})
+	}
+}
+
+func TestSendLongSMS(t *testing.T) {
+	tests := []struct {
+		text  string
+		parts []int
+	}{
+		{strings.Repeat("0123456789", 30), []int{153, 147}},
+		{strings.Repeat("ж", 140), []int{67, 67, 6}},
+	}
+
+	for _, mode := range modes {
+		t.Run(mode.name, func(t *testing.T) {
+			sim := simulator.New()
+			driver := connect(t, sim, mode.mode)
+
+			sent := 0
+			for n, test := range tests {
+				ok, refs, err := driver.SendSMS("+447700900123", test.text)
+				if !ok || err != nil || len(refs) != len(test.parts) {
+					t.Fatalf("SendSMS = %v, %v, %v", ok, refs, err)
+				}
+
+				var text strings.Builder
+				for i, size := range test.parts {
+					message := sim.Sent()[sent]
+					sent++
+
+					ref, total, seq, ok := modem.ParseConcatHeader(message.UDH)
+					if !ok || ref != n || total != len(test.parts) || seq != i+1 || len([]rune(message.Text)) != size {
+						t.Errorf("part %d: header %d, %d, %d, %v, %d characters", i+1, ref, total, seq, ok, len([]rune(message.Text)))
+					}
+					text.WriteString(message.Text)
+				}
+				if text.String() != test.text {
+					t.Errorf("parts do not join to sent text: %q", text.String())
+				}
+			}
+
+			if driver.ConcatReference != uint16(len(tests)) {
+				t.Errorf("concat reference is %d, want %d", driver.ConcatReference, len(tests))
+			}
+
+			// text mode is back after long message went out as PDUs
+			driver.SendSMS("+447700900123", "short")
+			if message := sim.Sent()[sent]; (message.PDU != "") != (mode.mode == modem.PDUMode) {
+				t.Errorf("message was sent in wrong mode: %+v", message)
+			}
+		})
+	}
+}
+
+func TestSendSMSConcat16(t *testing.T) {
+	sim := simulator.New()
+	driver := connect(t, sim, modem.PDUMode)
+	driver.Concat16 = true
+	driver.ConcatReference = 0x1234
+
+	if sent, _, err := driver.SendSMS("+447700900123", strings.Repeat("a", 200)); !sent {
+		t.Fatalf("SendSMS failed: %v", err)
+	}
+
+	for _, message := range sim.Sent() {
+		if ref, _, _, ok := modem.ParseConcatHeader(message.UDH); !ok || ref != 0x1234 || message.UDH[0] != 0x08 {
+			t.Errorf("part has header % X", message.UDH)
+		}
+	}
+}
+
+func TestSendSMSFailures(t *testing.T) {
+	t.Run("network", func(t *testing.T) {
+		sim := simulator.New()
+		sim.Script(simulator.CMSError("AT+CMGS", 42))
+		driver := connect(t, sim, modem.PDUMode)
+
+		sent, _, err := driver.SendSMS("+447700900123", "hello")
+		var cms *modem.CMSError
+		if sent || !errors.As(err, &cms) || cms.Code != 42 || !modem.Retryable(err) {
+			t.Errorf("SendSMS = %v, %v", sent, err)
+		}
+	})
+
+	t.Run("long message part", func(t *testing.T) {
+		sim := simulator.New()
+		driver := connect(t, sim, modem.PDUMode)
+		sim.Script(simulator.Behaviour{Command: "AT+CMGS", Response: "+CMS ERROR: 38", Times: 1}) // first part
+
+		sent, refs, err := driver.SendSMS("+447700900123", strings.Repeat("a", 200))
+		if sent || err == nil || len(refs) != 0 || len(sim.Sent()) != 0 {
+			t.Errorf("SendSMS = %v, %v, %v, simulator sent %d", sent, refs, err, len(sim.Sent()))
+		}
+	})
+
+	t.Run("invalid number", func(t *testing.T) {
+		sim := simulator.New()
+		driver := connect(t, sim, modem.TextMode)
+
+		sent, _, err := driver.SendSMS("+0044", "hello")
+		if sent || !errors.Is(err, modem.ErrInvalidAddress) || modem.Retryable(err) || len(sim.Sent()) != 0 {
+			t.Errorf("SendSMS = %v, %v", sent, err)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		sim := simulator.New()
+		sim.Script(simulator.Timeout("AT+CMGS"))
+		driver := connect(t, sim, modem.TextMode)
+
+		sent, _, err := driver.SendSMS("+447700900123", "hello")
+		if sent || err != modem.ErrTimeout {
+			t.Errorf("SendSMS = %v, %v", sent, err)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		sim := simulator.New()
+		driver := connect(t, sim, modem.PDUMode)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		sent, _, err := driver.SendSMSContext(ctx, "+447700900123", "hello")
+		if sent || err != context.Canceled || len(sim.Sent()) != 0 {
+			t.Errorf("SendSMSContext = %v, %v", sent, err)
+		}
+	})
+
+	t.Run("unplugged", func(t *testing.T) {
+		sim := simulator.New()
+		driver := connect(t, sim, modem.PDUMode)
+
+		sim.Unplug()
+		select {
+		case <-driver.Closed():
+		case <-time.After(time.Second):
+			t.Fatal("driver did not notice lost port")
+		}
+
+		sent, _, err := driver.SendSMS("+447700900123", "hello")
+		if sent || err != modem.ErrPortClosed || driver.Connected() {
+			t.Errorf("SendSMS = %v, %v", sent, err)
+		}
+		if err := driver.Connect(); err == nil {
+			t.Error("unplugged modem connected")
+		}
+
+		sim.Plug()
+		if err := driver.Connect(); err != nil || !driver.Connected() {
+			t.Errorf("Connect after plugging back failed: %v", err)
+		}
+	})
+}
+
+func TestIncomingMessage(t *testing.T) {
+	for _, mode := range modes {
+		t.Run(mode.name, func(t *testing.T) {
+			sim := simulator.New()
+			driver := connect(t, sim, mode.mode)
+			events := driver.Subscribe()
+			defer driver.Unsubscribe(events)
+
+			sim.Receive("+447700900123", "Grüße")
+			event := waitEvent(t, events, modem.EventNewMessage)
+			if event.Index != 1 || event.Storage == "" {
+				t.Errorf("+CMTI gave %+v", event)
+			}
+
+			message, err := driver.ReadSMSAt(event.Storage, event.Index)
+			if err != nil {
+				t.Fatalf("ReadSMSAt failed: %v", err)
+			}
+			if message.Originator != "+447700900123" || message.Body != "Grüße" || message.Parts != 0 || message.Timestamp.IsZero() {
+				t.Errorf("ReadSMSAt gave %+v", *message)
+			}
+
+			driver.DeleteSMSAt(event.Storage, event.Index)
+			if sim.Stored() != 0 {
+				t.Errorf("%d messages left in storage", sim.Stored())
+			}
+		})
+	}
+}
+
+func TestReadLongSMS(t *testing.T) {
+	text := strings.Repeat("long message ", 20)
+
+	for _, mode := range modes {
+		t.Run(mode.name, func(t *testing.T) {
+			sim := simulator.New()
+			driver := connect(t, sim, mode.mode)
+
+			sim.Receive("+447700900123", "first")
+			sim.Receive("MyBank", text)
+
+			messages := driver.ReadSMS()
+			if len(messages) != 3 {
+				t.Fatalf("ReadSMS gave %d messages, want 3", len(messages))
+			}
+			if messages[0].Body != "first" || messages[0].Parts != 0 {
+				t.Errorf("got %+v", messages[0])
+			}
+
+			var body string
+			for i, message := range messages[1:] {
+				if message.Parts != 2 || message.Part != i+1 || message.Reference != messages[1].Reference || message.Name != "MyBank" {
+					t.Errorf("part %d: got %+v", i+1, message)
+				}
+				body += message.Body
+			}
+			if body != text {
+				t.Errorf("parts do not join to received text: %q", body)
+			}
+
+			for _, message := range messages {
+				driver.DeleteSMS(message.Index)
+			}
+			if sim.Stored() != 0 {
+				t.Errorf("%d messages left in storage", sim.Stored())
+			}
+		})
+	}
+}
+
+func TestStorage(t *testing.T) {
+	sim := simulator.New()
+	sim.Capacity = 4
+	driver := connect(t, sim, modem.PDUMode)
+
+	sim.Receive("+447700900123", "one")
+	sim.Receive("+447700900123", "two")
+	sim.Receive("+447700900123", "three")
+
+	status, err := driver.ReadStorage()
+	if err != nil || status.Used != 3 || status.Total != 4 || status.Usage() != 75 || status.Full() {
+		t.Fatalf("ReadStorage = %+v, %v", status, err)
+	}
+
+	// messages stay in storage until they are deleted, bulk deletion keeps
+	// the ones which were not read yet
+	if messages := driver.ReadSMS(); len(messages) != 3 || sim.Stored() != 3 {
+		t.Fatalf("ReadSMS gave %d messages, %d left in storage", len(messages), sim.Stored())
+	}
+	sim.Receive("+447700900123", "four")
+	if status, _ := driver.ReadStorage(); status == nil || !status.Full() {
+		t.Errorf("storage is not full: %+v", status)
+	}
+
+	if err := driver.DeleteReadSMS(); err != nil || sim.Stored() != 1 {
+		t.Errorf("DeleteReadSMS = %v, %d messages left in storage", err, sim.Stored())
+	}
+}
+
+func TestListSMS(t *testing.T) {
+	sim := simulator.New()
+	driver := connect(t, sim, modem.PDUMode)
+	sim.Receive("+447700900123", "one")
+
+	if messages, undecoded := driver.ListSMS(); len(messages) != 1 || undecoded != 0 {
+		t.Errorf("ListSMS gave %d messages, %d undecoded", len(messages), undecoded)
+	}
+
+	// listed message which is not a valid PDU
+	sim.Script(simulator.Behaviour{Command: "AT+CMGL", Response: "+CMGL: 7,0,,1\r\n00\r\n\r\nOK", Times: 1})
+	if messages, undecoded := driver.ListSMS(); len(messages) != 0 || undecoded != 1 {
+		t.Errorf("ListSMS gave %d messages, %d undecoded", len(messages), undecoded)
+	}
+}
+
+func TestStatusReport(t *testing.T) {
+	for _, mode := range modes {
+		t.Run(mode.name, func(t *testing.T) {
+			sim := simulator.New()
+			sim.ReportDelay = 10 * time.Millisecond
+			driver := connect(t, sim, mode.mode)
+			events := driver.Subscribe()
+			defer driver.Unsubscribe(events)
+
+			// device does not ask for reports, single message does
+			_, refs, err := driver.SendSMSWithOptions(context.Background(), "+447700900123", "hello", modem.SendOptions{StatusReport: true})
+			if err != nil {
+				t.Fatalf("SendSMSWithOptions failed: %v", err)
+			}
+
+			event := waitEvent(t, events, modem.EventStatusReport)
+			if event.Report == nil || event.Report.Reference != refs[0] || event.Report.Recipient != "+447700900123" ||
+				!event.Report.Delivered() {
+				t.Errorf("+CDS gave %+v, report %+v", event, event.Report)
+			}
+
+			sim.Report(7, "+447700900123", 0x46)
+			event = waitEvent(t, events, modem.EventStatusReport)
+			if event.Report == nil || event.Report.Reference != 7 || !event.Report.Expired() {
+				t.Errorf("+CDS gave %+v, report %+v", event, event.Report)
+			}
+		})
+	}
+}
+
+func TestPIN(t *testing.T) {
+	connectSIM := func(t *testing.T, state, pin string, behaviours ...simulator.Behaviour) (*simulator.Modem, *modem.Driver, error) {
+		name := strings.Replace(t.Name(), "/", "-", -1)
+		sim := simulator.New()
+		sim.SIM, sim.PIN = state, "1234"
+		sim.Script(behaviours...)
+		simulator.Register(name, sim)
+
+		driver := modem.New("sim://"+name, 115200, name)
+		driver.PIN = pin
+		driver.CommandTimeout = 200 * time.Millisecond
+		err := driver.Connect()
+		t.Cleanup(func() { driver.Close() })
+		return sim, driver, err
+	}
+
+	t.Run("accepted", func(t *testing.T) {
+		_, driver, err := connectSIM(t, "SIM PIN", "1234")
+		if err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		if status, _ := driver.SIMStatus(); status != "READY" {
+			t.Errorf("SIM is %s", status)
+		}
+	})
+
+	t.Run("not needed", func(t *testing.T) {
+		if _, _, err := connectSIM(t, "READY", ""); err != nil {
+			t.Errorf("Connect failed: %v", err)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		_, _, err := connectSIM(t, "SIM PIN", "")
+		var sim *modem.SIMError
+		if !errors.As(err, &sim) {
+			t.Errorf("Connect = %v, want SIMError", err)
+		}
+	})
+
+	t.Run("PUK", func(t *testing.T) {
+		_, _, err := connectSIM(t, "SIM PUK", "1234")
+		var sim *modem.SIMError
+		if !errors.As(err, &sim) || sim.State != "SIM PUK" {
+			t.Errorf("Connect = %v, want SIMError", err)
+		}
+	})
+
+	t.Run("not inserted", func(t *testing.T) {
+		_, _, err := connectSIM(t, "", "1234")
+		var sim *modem.SIMError
+		if !errors.As(err, &sim) {
+			t.Errorf("Connect = %v, want SIMError", err)
+		}
+	})
+
+	t.Run("changed", func(t *testing.T) {
+		_, driver, err := connectSIM(t, "SIM PIN", "0000")
+		if err == nil {
+			t.Fatal("wrong PIN was accepted")
+		}
+
+		driver.Close()
+		driver.PIN = "1234"
+		if err := driver.Connect(); err != nil {
+			t.Errorf("Connect with changed PIN failed: %v", err)
+		}
+	})
+
+	// failed entry must not be repeated, three attempts would lock the SIM
+	failures := []struct {
+		name      string
+		behaviour []simulator.Behaviour
+		pin       string
+	}{
+		{"refused", nil, "0000"},
+		{"error", []simulator.Behaviour{simulator.Fail("AT+CPIN=", "ERROR")}, "1234"},
+		{"timeout", []simulator.Behaviour{simulator.Timeout("AT+CPIN=")}, "1234"},
+	}
+	for _, failure := range failures {
+		t.Run(failure.name, func(t *testing.T) {
+			sim, driver, err := connectSIM(t, "SIM PIN", failure.pin, failure.behaviour...)
+			var simErr *modem.SIMError
+			if !errors.As(err, &simErr) {
+				t.Fatalf("Connect = %v, want SIMError", err)
+			}
+
+			for i := 0; i < 3; i++ {
+				driver.Close()
+				if err := driver.Connect(); !errors.As(err, &simErr) || !strings.Contains(simErr.State, "failed before") {
+					t.Fatalf("reconnect %d = %v", i+1, err)
+				}
+			}
+
+			// SIM did not get to PUK, PIN works after restart
+			sim.Reset()
+			driver.Close()
+			restarted := modem.New(driver.ComPort, 115200, driver.DeviceId)
+			restarted.PIN = "1234"
+			if err := restarted.Connect(); err != nil {
+				t.Errorf("Connect with correct PIN failed: %v", err)
+			}
+			restarted.Close()
+		})
+	}
+}
+
+func TestUSSD(t *testing.T) {
+	t.Run("balance", func(t *testing.T) {
+		driver := connect(t, simulator.New(), modem.TextMode)
+
+		response, err := driver.USSD(context.Background(), "*100#")
+		if err != nil || response.Text != "Balance: 10.00" || response.More() {
+			t.Errorf("USSD = %+v, %v", response, err)
+		}
+	})
+
+	t.Run("menu", func(t *testing.T) {
+		sim := simulator.New()
+		var codes []string
+		sim.USSD = func(code string) (string, bool) {
+			codes = append(codes, code)
+			if code == "*123#" {
+				return "1. Balance\n2. Top up", true
+			}
+			return "Top up with voucher", false
+		}
+		driver := connect(t, sim, modem.PDUMode)
+
+		response, err := driver.USSD(context.Background(), "*123#")
+		if err != nil || response.Text != "1. Balance\n2. Top up" || !response.More() {
+			t.Errorf("USSD = %+v, %v", response, err)
+		}
+		response, err = driver.USSD(context.Background(), "2")
+		if err != nil || response.Text != "Top up with voucher" || response.More() {
+			t.Errorf("USSD reply = %+v, %v", response, err)
+		}
+		if strings.Join(codes, " ") != "*123# 2" {
+			t.Errorf("network got %q", codes)
+		}
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		sim := simulator.New()
+		sim.Script(simulator.CMEError("AT+CUSD=1", 4))
+		driver := connect(t, sim, modem.TextMode)
+
+		if response, err := driver.USSD(context.Background(), "*100#"); err == nil {
+			t.Errorf("USSD = %+v, want error", response)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		sim := simulator.New()
+		sim.Script(simulator.Behaviour{Command: "AT+CUSD=1", Response: "OK"}) // network never answers
+		driver := connect(t, sim, modem.TextMode)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		if response, err := driver.USSD(ctx, "*100#"); err != context.DeadlineExceeded {
+			t.Errorf("USSD = %+v, %v", response, err)
+		}
+	})
+}
+
+func TestClose(t *testing.T) {
+	driver := connect(t, simulator.New(), modem.TextMode)
+
+	// Close may come from other goroutine while command is sent
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			driver.Exec("AT\r\n")
+		}
+	}()
+	driver.Close()
+	<-done
+
+	if driver.Connected() {
+		t.Error("closed driver is connected")
+	}
+	if _, err := driver.Exec("AT\r\n"); err != modem.ErrPortClosed {
+		t.Errorf("Exec on closed port = %v", err)
+	}
+	if err := driver.Close(); err != nil {
+		t.Errorf("second Close = %v", err)
+	}
+}
@@ -0,0 +1,203 @@
+package modem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrPortClosed is returned when modem port was lost, e.g. modem was unplugged
+var ErrPortClosed = errors.New("port closed")
+
+// ErrTimeout is returned when modem did not give final result code in time
+var ErrTimeout = errors.New("modem did not respond")
+
+// ErrCommandFailed is plain ERROR result code which carries no reason
+var ErrCommandFailed = errors.New("ERROR")
+
+// ErrInvalidAddress means number can not be used, e.g. it has letters or
+// too many digits, sending it again would fail the same way
+var ErrInvalidAddress = errors.New("invalid address")
+
+// SIMError means SIM card is not usable, State is AT+CPIN? answer, e.g.
+// SIM PUK, or reason why the card could not be unlocked
+type SIMError struct {
+	State string
+}
+
+func (e *SIMError) Error() string {
+	return "SIM not ready: " + e.State
+}
+
+// CMSError is message service failure reported as +CMS ERROR, codes are
+// listed in 3GPP TS 27.005 3.2.5, codes below 128 are network causes from
+// 3GPP TS 24.011
+type CMSError struct {
+	Code    int // -1 when modem gave text only
+	Message string
+}
+
+func (e *CMSError) Error() string {
+	return fmt.Sprintf("+CMS ERROR: %d %s", e.Code, e.Message)
+}
+
+// CMEError is equipment failure reported as +CME ERROR, codes are listed in
+// 3GPP TS 27.007 9.2
+type CMEError struct {
+	Code    int // -1 when modem gave text only
+	Message string
+}
+
+func (e *CMEError) Error() string {
+	return fmt.Sprintf("+CME ERROR: %d %s", e.Code, e.Message)
+}
+
+var cmsMessages = map[int]string{
+	1:   "unassigned number",
+	8:   "operator determined barring",
+	10:  "call barred",
+	21:  "short message transfer rejected",
+	27:  "destination out of service",
+	28:  "unidentified subscriber",
+	29:  "facility rejected",
+	30:  "unknown subscriber",
+	38:  "network out of order",
+	41:  "temporary failure",
+	42:  "congestion",
+	47:  "resources unavailable",
+	50:  "requested facility not subscribed",
+	69:  "requested facility not implemented",
+	81:  "invalid short message transfer reference value",
+	95:  "invalid message",
+	96:  "invalid mandatory information",
+	97:  "message type non-existent or not implemented",
+	98:  "message not compatible with short message protocol state",
+	99:  "information element non-existent or not implemented",
+	111: "protocol error",
+	127: "interworking unspecified",
+	300: "ME failure",
+	301: "SMS service of ME reserved",
+	302: "operation not allowed",
+	303: "operation not supported",
+	304: "invalid PDU mode parameter",
+	305: "invalid text mode parameter",
+	310: "SIM not inserted",
+	311: "SIM PIN required",
+	312: "PH-SIM PIN required",
+	313: "SIM failure",
+	314: "SIM busy",
+	315: "SIM wrong",
+	316: "SIM PUK required",
+	317: "SIM PIN2 required",
+	318: "SIM PUK2 required",
+	320: "memory failure",
+	321: "invalid memory index",
+	322: "memory full",
+	330: "SMSC address unknown",
+	331: "no network service",
+	332: "network timeout",
+	340: "no +CNMA acknowledgement expected",
+	500: "unknown error",
+}
+
+var cmeMessages = map[int]string{
+	0:   "phone failure",
+	1:   "no connection to phone",
+	3:   "operation not allowed",
+	4:   "operation not supported",
+	5:   "PH-SIM PIN required",
+	10:  "SIM not inserted",
+	11:  "SIM PIN required",
+	12:  "SIM PUK required",
+	13:  "SIM failure",
+	14:  "SIM busy",
+	15:  "SIM wrong",
+	16:  "incorrect password",
+	17:  "SIM PIN2 required",
+	18:  "SIM PUK2 required",
+	20:  "memory full",
+	21:  "invalid index",
+	22:  "not found",
+	23:  "memory failure",
+	30:  "no network service",
+	31:  "network timeout",
+	32:  "network not allowed - emergency calls only",
+	100: "unknown",
+}
+
+// codes which will fail the same way however many times message is sent,
+// anything else is expected to pass later, e.g. network congestion
+var cmsPermanent = map[int]bool{
+	1: true, 8: true, 10: true, 21: true, 28: true, 29: true, 30: true, 50: true, 69: true,
+	95: true, 96: true, 97: true, 99: true,
+	301: true, 302: true, 303: true, 304: true, 305: true,
+	310: true, 311: true, 312: true, 313: true, 315: true, 316: true, 317: true, 318: true,
+	330: true,
+}
+
+var cmePermanent = map[int]bool{
+	3: true, 4: true, 5: true, 10: true, 11: true, 12: true, 13: true, 15: true, 16: true, 17: true, 18: true,
+}
+
+// Retryable reports whether sending may succeed when tried again, e.g. after
+// timeout, cancellation or network congestion. Invalid destination, blocked
+// SIM and errors which did not come from modem are permanent
+func Retryable(err error) bool {
+	switch e := err.(type) {
+	case *CMSError:
+		return !cmsPermanent[e.Code]
+	case *CMEError:
+		return !cmePermanent[e.Code]
+	}
+	return err == ErrTimeout || err == ErrPortClosed || err == ErrCommandFailed ||
+		err == context.Canceled || err == context.DeadlineExceeded
+}
+
+// final result codes which end response to a command
+var finalResults = []string{"OK\r\n", "ERROR\r\n", "+CMS ERROR:", "+CME ERROR:"}
+
+var resultLine = regexp.MustCompile(`\+(CMS|CME) ERROR: *([^\r\n]*)`)
+
+// resultError returns error carried by final result code of output, nil
+// when command succeeded
+func resultError(output string) error {
+	if strings.HasSuffix(output, "OK\r\n") {
+		return nil
+	}
+
+	if match := resultLine.FindStringSubmatch(output); match != nil {
+		value := strings.TrimSpace(match[2])
+		messages := cmsMessages
+		if match[1] == "CME" {
+			messages = cmeMessages
+		}
+
+		code, err := strconv.Atoi(value)
+		if err != nil {
+			// verbose result codes, AT+CMEE=2
+			code = -1
+			for c, message := range messages {
+				if strings.EqualFold(message, value) {
+					code = c
+				}
+			}
+		} else if message, ok := messages[code]; ok {
+			value = message
+		} else {
+			value = "unknown"
+		}
+
+		if match[1] == "CME" {
+			return &CMEError{Code: code, Message: value}
+		}
+		return &CMSError{Code: code, Message: value}
+	}
+
+	if strings.Contains(output, "ERROR") {
+		return ErrCommandFailed
+	}
+	return ErrTimeout
+}
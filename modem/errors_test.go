@@ -0,0 +1,81 @@
+package modem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestResultError(t *testing.T) {
+	tests := []struct {
+		output string
+		want   error
+	}{
+		{"\r\nOK\r\n", nil},
+		{"\r\n+CSQ: 21,0\r\n\r\nOK\r\n", nil},
+		{"\r\nERROR\r\n", ErrCommandFailed},
+		{"\r\n+CMS ERROR: 42\r\n", &CMSError{Code: 42, Message: "congestion"}},
+		{"\r\n+CMS ERROR: 500\r\n", &CMSError{Code: 500, Message: "unknown error"}},
+		{"\r\n+CMS ERROR: 999\r\n", &CMSError{Code: 999, Message: "unknown"}},
+		{"\r\n+CME ERROR: 16\r\n", &CMEError{Code: 16, Message: "incorrect password"}},
+		{"\r\n+CME ERROR: incorrect password\r\n", &CMEError{Code: 16, Message: "incorrect password"}},
+		{"\r\n+CMS ERROR: Network timeout\r\n", &CMSError{Code: 332, Message: "Network timeout"}},
+		{"\r\n+CME ERROR: something odd\r\n", &CMEError{Code: -1, Message: "something odd"}},
+		{"", ErrTimeout},
+		{"\r\n+CSQ: 21,0\r\n", ErrTimeout},
+	}
+
+	for _, test := range tests {
+		err := resultError(test.output)
+		if fmt.Sprintf("%#v", err) != fmt.Sprintf("%#v", test.want) {
+			t.Errorf("resultError(%q) = %#v, want %#v", test.output, err, test.want)
+		}
+	}
+}
+
+func TestErrorMessages(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&CMSError{Code: 42, Message: "congestion"}, "+CMS ERROR: 42 congestion"},
+		{&CMEError{Code: 10, Message: "SIM not inserted"}, "+CME ERROR: 10 SIM not inserted"},
+		{&SIMError{State: "SIM PUK"}, "SIM not ready: SIM PUK"},
+	}
+
+	for _, test := range tests {
+		if got := test.err.Error(); got != test.want {
+			t.Errorf("Error() = %q, want %q", got, test.want)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{ErrTimeout, true},
+		{ErrPortClosed, true},
+		{ErrCommandFailed, true},
+		{context.Canceled, true},
+		{context.DeadlineExceeded, true},
+		{&CMSError{Code: 42}, true},   // congestion
+		{&CMSError{Code: 332}, true},  // network timeout
+		{&CMSError{Code: 1}, false},   // unassigned number
+		{&CMSError{Code: 316}, false}, // SIM PUK required
+		{&CMEError{Code: 14}, true},   // SIM busy
+		{&CMEError{Code: 16}, false},  // incorrect password
+		{ErrInvalidAddress, false},
+		{fmt.Errorf("%w: +0", ErrInvalidAddress), false},
+		{&SIMError{State: "SIM PUK"}, false},
+		{errors.New("message too long"), false},
+	}
+
+	for _, test := range tests {
+		if got := Retryable(test.err); got != test.want {
+			t.Errorf("Retryable(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
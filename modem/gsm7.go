@@ -0,0 +1,132 @@
+package modem
+
+import (
+	"errors"
+	"strings"
+)
+
+// GSM 03.38 default alphabet, indexed by septet value
+var gsm7Basic = []rune("@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞ\x1bÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà")
+
+// GSM 03.38 basic extension table, reached through the 0x1B escape septet
+var gsm7Extension = map[rune]byte{
+	'\f': 0x0A,
+	'^':  0x14,
+	'{':  0x28,
+	'}':  0x29,
+	'\\': 0x2F,
+	'[':  0x3C,
+	'~':  0x3D,
+	']':  0x3E,
+	'|':  0x40,
+	'€':  0x65,
+}
+
+const gsm7Escape = 0x1B
+
+var gsm7BasicIndex = make(map[rune]byte)
+var gsm7ExtensionIndex = make(map[byte]rune)
+
+func init() {
+	for i, r := range gsm7Basic {
+		if i != gsm7Escape {
+			gsm7BasicIndex[r] = byte(i)
+		}
+	}
+	for r, b := range gsm7Extension {
+		gsm7ExtensionIndex[b] = r
+	}
+}
+
+var errNotGSM7 = errors.New("text can not be encoded in GSM 7-bit alphabet")
+
+// EncodeGSM7 converts text to unpacked septets, characters from the extension
+// table take two septets
+func EncodeGSM7(text string) ([]byte, error) {
+	septets := make([]byte, 0, len(text))
+	for _, r := range text {
+		if b, ok := gsm7BasicIndex[r]; ok {
+			septets = append(septets, b)
+		} else if b, ok := gsm7Extension[r]; ok {
+			septets = append(septets, gsm7Escape, b)
+		} else {
+			return nil, errNotGSM7
+		}
+	}
+	return septets, nil
+}
+
+// DecodeGSM7 converts unpacked septets back to text
+func DecodeGSM7(septets []byte) string {
+	var output strings.Builder
+	for i := 0; i < len(septets); i++ {
+		s := septets[i] & 0x7F
+		if s == gsm7Escape && i+1 < len(septets) {
+			i++
+			if r, ok := gsm7ExtensionIndex[septets[i]&0x7F]; ok {
+				output.WriteRune(r)
+			} else {
+				// unknown extension, 03.38 says to display the basic character
+				output.WriteRune(gsm7Basic[septets[i]&0x7F])
+			}
+			continue
+		}
+		output.WriteRune(gsm7Basic[s])
+	}
+	return output.String()
+}
+
+// IsGSM7 reports whether text fits into GSM 7-bit alphabet
+func IsGSM7(text string) bool {
+	for _, r := range text {
+		if _, ok := gsm7BasicIndex[r]; ok {
+			continue
+		}
+		if _, ok := gsm7Extension[r]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// PackSeptets packs septets into octets, fill is number of zero bits put in
+// front so the text starts on a septet boundary after user data header
+func PackSeptets(septets []byte, fill int) []byte {
+	bits := fill + 7*len(septets)
+	packed := make([]byte, (bits+7)/8)
+
+	bit := fill
+	for _, s := range septets {
+		for i := uint(0); i < 7; i++ {
+			if s&(1<<i) != 0 {
+				packed[bit/8] |= 1 << uint(bit%8)
+			}
+			bit++
+		}
+	}
+
+	return packed
+}
+
+// UnpackSeptets is reverse of PackSeptets, count is number of septets to
+// read, negative count reads nothing
+func UnpackSeptets(packed []byte, count int, fill int) []byte {
+	if count < 0 {
+		return nil
+	}
+	septets := make([]byte, 0, count)
+
+	bit := fill
+	for len(septets) < count && bit+7 <= len(packed)*8 {
+		var s byte
+		for i := uint(0); i < 7; i++ {
+			if packed[bit/8]&(1<<uint(bit%8)) != 0 {
+				s |= 1 << i
+			}
+			bit++
+		}
+		septets = append(septets, s)
+	}
+
+	return septets
+}
@@ -0,0 +1,110 @@
+package modem
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestGSM7RoundTrip(t *testing.T) {
+	tests := []struct {
+		text    string
+		septets int
+	}{
+		{"hello", 5},
+		{"@£$¥èéùìòÇ", 10},
+		{"ΔΦΓΛΩΠΨΣΘΞ", 10},
+		{"price 5€", 9},       // € is in extension table
+		{"{[~|^]}\\", 16},     // every character takes escape septet
+		{"line\nbreak\r", 11}, // CR and LF are basic characters
+	}
+
+	for _, test := range tests {
+		septets, err := EncodeGSM7(test.text)
+		if err != nil {
+			t.Errorf("EncodeGSM7(%q) failed: %v", test.text, err)
+			continue
+		}
+		if len(septets) != test.septets {
+			t.Errorf("EncodeGSM7(%q) gave %d septets, want %d", test.text, len(septets), test.septets)
+		}
+		if text := DecodeGSM7(septets); text != test.text {
+			t.Errorf("DecodeGSM7(EncodeGSM7(%q)) = %q", test.text, text)
+		}
+	}
+}
+
+func TestEncodeGSM7Rejects(t *testing.T) {
+	for _, text := range []string{"Привет", "emoji 😀", "ć", "`"} {
+		if _, err := EncodeGSM7(text); err == nil {
+			t.Errorf("EncodeGSM7(%q) did not fail", text)
+		}
+	}
+}
+
+func TestDecodeGSM7UnknownExtension(t *testing.T) {
+	// 03.38 says to show basic character of unknown extension
+	if text := DecodeGSM7([]byte{gsm7Escape, 0x41}); text != "A" {
+		t.Errorf("got %q, want A", text)
+	}
+}
+
+func TestIsGSM7(t *testing.T) {
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"", true},
+		{"Hello, world!", true},
+		{"ÄÖÑÜ§¿äöñüà", true},
+		{"[€]", true},
+		{"naïve", false},
+		{"日本", false},
+	}
+
+	for _, test := range tests {
+		if got := IsGSM7(test.text); got != test.want {
+			t.Errorf("IsGSM7(%q) = %v, want %v", test.text, got, test.want)
+		}
+	}
+}
+
+func TestPackSeptets(t *testing.T) {
+	tests := []struct {
+		text   string
+		fill   int
+		packed string
+	}{
+		{"hellohello", 0, "E8329BFD4697D9EC37"}, // 3GPP TS 23.038 example
+		{"A", 0, "41"},
+		{"A", 1, "82"},
+		{"12345678", 0, "31D98C56B3DD70"},
+	}
+
+	for _, test := range tests {
+		septets, _ := EncodeGSM7(test.text)
+		packed := strings.ToUpper(hex.EncodeToString(PackSeptets(septets, test.fill)))
+		if packed != test.packed {
+			t.Errorf("PackSeptets(%q, %d) = %s, want %s", test.text, test.fill, packed, test.packed)
+		}
+
+		unpacked := UnpackSeptets(PackSeptets(septets, test.fill), len(septets), test.fill)
+		if !bytes.Equal(unpacked, septets) {
+			t.Errorf("UnpackSeptets(PackSeptets(%q, %d)) = %v, want %v", test.text, test.fill, unpacked, septets)
+		}
+	}
+}
+
+func TestUnpackSeptetsShort(t *testing.T) {
+	// count larger than data must not read past the end
+	if septets := UnpackSeptets([]byte{0x41}, 5, 0); len(septets) != 1 {
+		t.Errorf("got %d septets, want 1", len(septets))
+	}
+}
+
+func TestUnpackSeptetsNegative(t *testing.T) {
+	if septets := UnpackSeptets([]byte{0x41}, -3, 0); len(septets) != 0 {
+		t.Errorf("got %d septets, want none", len(septets))
+	}
+}
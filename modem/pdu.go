@@ -0,0 +1,654 @@
+package modem
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// SMS PDU handling as described in 3GPP TS 23.040
+
+// data coding scheme alphabets
+const (
+	AlphabetGSM7 = iota
+	Alphabet8Bit
+	AlphabetUCS2
+)
+
+// maximum size of user data in one PDU
+const (
+	maxSeptets = 160
+	maxOctets  = 140
+)
+
+var errInvalidPDU = errors.New("invalid PDU")
+
+// message classes of data coding scheme, 3GPP TS 23.038 4, zero value
+// leaves the class out and handset stores the message as usual
+const (
+	ClassNone = iota
+	Class0    // flash message, shown right away and not stored
+	Class1    // stored in handset
+	Class2    // stored in SIM
+	Class3    // passed to terminal equipment
+)
+
+// DefaultValidityPeriod is how long service centre keeps trying to deliver
+// message which does not give its own period
+const DefaultValidityPeriod = 24 * time.Hour
+
+// Submit is SMS-SUBMIT message sent from modem to the network
+type Submit struct {
+	Destination string
+	Text        string
+	UDH         []byte // user data header without its length octet
+
+	StatusReport   bool
+	Class          int
+	ValidityPeriod time.Duration // zero means DefaultValidityPeriod
+}
+
+// Encode returns hex encoded PDU prefixed with empty SMSC information, so the
+// modem uses its default service centre, and TPDU length as AT+CMGS expects it
+func (s *Submit) Encode() (pdu string, length int, err error) {
+	destination, err := recipient(s.Destination)
+	if err != nil {
+		return "", 0, err
+	}
+
+	alphabet := AlphabetGSM7
+	septets, err := EncodeGSM7(s.Text)
+	if err != nil {
+		alphabet = AlphabetUCS2
+	}
+
+	firstOctet := byte(0x11) // SMS-SUBMIT, relative validity period
+	if len(s.UDH) > 0 {
+		firstOctet |= 0x40 // UDHI
+	}
+	if s.StatusReport {
+		firstOctet |= 0x20 // SRR
+	}
+
+	tpdu := []byte{
+		firstOctet,
+		0x00, // message reference is set by modem
+	}
+	tpdu = append(tpdu, encodeAddress(destination)...)
+	tpdu = append(tpdu, 0x00) // protocol identifier
+
+	tpdu = append(tpdu, encodeDCS(alphabet, s.Class))
+
+	var udl int
+	var ud []byte
+	if alphabet == AlphabetGSM7 {
+		udl, ud = encodeUserData7(s.UDH, septets)
+		if udl > maxSeptets {
+			return "", 0, fmt.Errorf("message too long: %d septets", udl)
+		}
+	} else {
+		udl, ud = encodeUserData8(s.UDH, encodeUCS2(s.Text))
+		if udl > maxOctets {
+			return "", 0, fmt.Errorf("message too long: %d octets", udl)
+		}
+	}
+
+	tpdu = append(tpdu, EncodeValidity(s.ValidityPeriod))
+	tpdu = append(tpdu, byte(udl))
+	tpdu = append(tpdu, ud...)
+
+	return "00" + strings.ToUpper(hex.EncodeToString(tpdu)), len(tpdu), nil
+}
+
+// ConcatHeader returns user data header with concatenated short message
+// information element, 8-bit reference (IEI 0x00) or 16-bit reference (IEI 0x08)
+func ConcatHeader(ref uint16, total, seq int, ref16 bool) []byte {
+	if ref16 {
+		return []byte{0x08, 0x04, byte(ref >> 8), byte(ref), byte(total), byte(seq)}
+	}
+	return []byte{0x00, 0x03, byte(ref), byte(total), byte(seq)}
+}
+
+// ParseConcatHeader looks for concatenated short message information element
+// in user data header
+func ParseConcatHeader(udh []byte) (ref, total, seq int, ok bool) {
+	for i := 0; i+1 < len(udh); i += 2 + int(udh[i+1]) {
+		iei, length := udh[i], int(udh[i+1])
+		if i+2+length > len(udh) {
+			break
+		}
+		ie := udh[i+2 : i+2+length]
+
+		switch {
+		case iei == 0x00 && length == 3:
+			ref, total, seq = int(ie[0]), int(ie[1]), int(ie[2])
+		case iei == 0x08 && length == 4:
+			ref, total, seq = int(ie[0])<<8|int(ie[1]), int(ie[2]), int(ie[3])
+		default:
+			continue
+		}
+
+		if total > 1 && seq >= 1 && seq <= total {
+			return ref, total, seq, true
+		}
+	}
+
+	return 0, 0, 0, false
+}
+
+// SplitMessage splits text into parts which fit into single PDU together with
+// concatenation header, extension characters and surrogate pairs are never
+// split between two parts
+func SplitMessage(text string, ref16 bool) []string {
+	headerSize := 6 // UDHL + IEI 0x00
+	if ref16 {
+		headerSize = 7 // UDHL + IEI 0x08
+	}
+
+	var limit, size int
+	var unitSize func(r rune) int
+
+	if IsGSM7(text) {
+		limit = maxSeptets - (headerSize*8+6)/7
+		unitSize = func(r rune) int {
+			if _, ok := gsm7Extension[r]; ok {
+				return 2
+			}
+			return 1
+		}
+		septets, _ := EncodeGSM7(text)
+		size = len(septets)
+		if size <= maxSeptets {
+			return []string{text}
+		}
+	} else {
+		limit = (maxOctets - headerSize) / 2
+		unitSize = func(r rune) int {
+			if r > 0xFFFF {
+				return 2
+			}
+			return 1
+		}
+		size = len(utf16.Encode([]rune(text)))
+		if size*2 <= maxOctets {
+			return []string{text}
+		}
+	}
+
+	var parts []string
+	var part []rune
+	used := 0
+	for _, r := range text {
+		n := unitSize(r)
+		if used+n > limit {
+			parts = append(parts, string(part))
+			part = nil
+			used = 0
+		}
+		part = append(part, r)
+		used += n
+	}
+	if len(part) > 0 {
+		parts = append(parts, string(part))
+	}
+
+	return parts
+}
+
+// Deliver is SMS-DELIVER message received by modem
+type Deliver struct {
+	Originator string
+	Timestamp  time.Time
+	Text       string
+	UDH        []byte
+}
+
+// Name returns originator when it is alphanumeric sender name
+func (d *Deliver) Name() string {
+	if address, err := ParseAddress(d.Originator); err == nil && address.Kind == AddressAlphanumeric {
+		return d.Originator
+	}
+	return ""
+}
+
+// DecodeDeliver parses hex PDU as listed by AT+CMGL in PDU mode
+func DecodeDeliver(pdu string) (*Deliver, error) {
+	data, err := hex.DecodeString(strings.TrimSpace(pdu))
+	if err != nil {
+		return nil, err
+	}
+
+	r := &pduReader{data: data}
+	r.skip(int(r.byte())) // SMSC information
+
+	firstOctet := r.byte()
+	if firstOctet&0x03 != 0x00 {
+		return nil, fmt.Errorf("not SMS-DELIVER PDU: message type %d", firstOctet&0x03)
+	}
+
+	d := &Deliver{}
+	d.Originator = r.address()
+	r.byte() // protocol identifier
+	dcs := r.byte()
+	d.Timestamp = decodeTimestamp(r.bytes(7))
+	udl := int(r.byte())
+	ud := r.rest()
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	d.UDH, d.Text, err = decodeUserData(ud, udl, dcs, firstOctet&0x40 != 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Encode returns hex encoded PDU as modem lists it, with empty SMSC
+// information, and TPDU length
+func (d *Deliver) Encode() (pdu string, length int, err error) {
+	originator, err := ParseAddress(d.Originator)
+	if err != nil {
+		return "", 0, err
+	}
+
+	alphabet := AlphabetGSM7
+	septets, err := EncodeGSM7(d.Text)
+	if err != nil {
+		alphabet = AlphabetUCS2
+	}
+
+	firstOctet := byte(0x04) // SMS-DELIVER, no more messages to send
+	if len(d.UDH) > 0 {
+		firstOctet |= 0x40 // UDHI
+	}
+
+	tpdu := []byte{firstOctet}
+	tpdu = append(tpdu, encodeAddress(originator)...)
+	tpdu = append(tpdu, 0x00) // protocol identifier
+
+	var udl int
+	var ud []byte
+	if alphabet == AlphabetGSM7 {
+		tpdu = append(tpdu, 0x00)
+		udl, ud = encodeUserData7(d.UDH, septets)
+	} else {
+		tpdu = append(tpdu, 0x08)
+		udl, ud = encodeUserData8(d.UDH, encodeUCS2(d.Text))
+	}
+
+	tpdu = append(tpdu, encodeTimestamp(d.Timestamp)...)
+	tpdu = append(tpdu, byte(udl))
+	tpdu = append(tpdu, ud...)
+
+	return "00" + strings.ToUpper(hex.EncodeToString(tpdu)), len(tpdu), nil
+}
+
+// DecodeSubmit parses hex PDU as given to AT+CMGS, reverse of Submit.Encode
+func DecodeSubmit(pdu string) (*Submit, error) {
+	data, err := hex.DecodeString(strings.TrimSpace(pdu))
+	if err != nil {
+		return nil, err
+	}
+
+	r := &pduReader{data: data}
+	r.skip(int(r.byte())) // SMSC information
+
+	firstOctet := r.byte()
+	if firstOctet&0x03 != 0x01 {
+		return nil, fmt.Errorf("not SMS-SUBMIT PDU: message type %d", firstOctet&0x03)
+	}
+
+	s := &Submit{StatusReport: firstOctet&0x20 != 0}
+	r.byte() // message reference
+	s.Destination = r.address()
+	r.byte() // protocol identifier
+	dcs := r.byte()
+	s.Class = dcsClass(dcs)
+
+	switch firstOctet & 0x18 { // validity period format
+	case 0x10:
+		s.ValidityPeriod = DecodeValidity(r.byte()) // relative
+	case 0x08, 0x18:
+		r.skip(7) // enhanced or absolute
+	}
+
+	udl := int(r.byte())
+	ud := r.rest()
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	s.UDH, s.Text, err = decodeUserData(ud, udl, dcs, firstOctet&0x40 != 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// encodeUserData7 packs septets after optional user data header, returned
+// length is in septets as TP-UDL requires for 7-bit alphabet
+func encodeUserData7(udh []byte, septets []byte) (int, []byte) {
+	if len(udh) == 0 {
+		return len(septets), PackSeptets(septets, 0)
+	}
+
+	headerBits := (len(udh) + 1) * 8
+	fill := (7 - headerBits%7) % 7
+	headerSeptets := (headerBits + fill) / 7
+
+	ud := append([]byte{byte(len(udh))}, udh...)
+	ud = append(ud, PackSeptets(septets, fill)...)
+
+	return headerSeptets + len(septets), ud
+}
+
+func encodeUserData8(udh []byte, data []byte) (int, []byte) {
+	var ud []byte
+	if len(udh) > 0 {
+		ud = append([]byte{byte(len(udh))}, udh...)
+	}
+	ud = append(ud, data...)
+	return len(ud), ud
+}
+
+func decodeUserData(ud []byte, udl int, dcs byte, hasHeader bool) (udh []byte, text string, err error) {
+	alphabet := dcsAlphabet(dcs)
+
+	offset := 0
+	if hasHeader {
+		if len(ud) == 0 || int(ud[0])+1 > len(ud) {
+			return nil, "", errInvalidPDU
+		}
+		udh = ud[1 : ud[0]+1]
+		offset = len(udh) + 1
+	}
+
+	if offset > len(ud) || (alphabet != AlphabetGSM7 && offset > udl) {
+		return nil, "", errInvalidPDU
+	}
+
+	switch alphabet {
+	case AlphabetGSM7:
+		fill := 0
+		count := udl
+		if hasHeader {
+			headerBits := offset * 8
+			fill = (7 - headerBits%7) % 7
+			count -= (headerBits + fill) / 7
+		}
+		if count < 0 {
+			return nil, "", errInvalidPDU // length is shorter than header
+		}
+		text = DecodeGSM7(UnpackSeptets(ud[offset:], count, fill))
+	case AlphabetUCS2:
+		if udl > len(ud) {
+			udl = len(ud)
+		}
+		text = decodeUCS2(ud[offset:udl])
+	default:
+		if udl > len(ud) {
+			udl = len(ud)
+		}
+		text = string(ud[offset:udl])
+	}
+
+	return udh, text, nil
+}
+
+// encodeDCS returns data coding scheme of alphabet with optional class
+func encodeDCS(alphabet, class int) byte {
+	dcs := byte(0x00)
+	if alphabet == AlphabetUCS2 {
+		dcs = 0x08
+	}
+	if class != ClassNone {
+		dcs |= 0x10 | byte(class-Class0)
+	}
+	return dcs
+}
+
+// dcsClass returns message class given by data coding scheme
+func dcsClass(dcs byte) int {
+	switch {
+	case dcs&0xC0 == 0x00, dcs&0xC0 == 0x40: // general data coding
+		if dcs&0x10 != 0 {
+			return Class0 + int(dcs&0x03)
+		}
+	case dcs&0xF0 == 0xF0: // data coding/message class
+		return Class0 + int(dcs&0x03)
+	}
+	return ClassNone
+}
+
+// EncodeValidity returns relative validity period as used in PDU and
+// AT+CSMP, 3GPP TS 23.040 9.2.3.12.1. Periods are rounded up to the next
+// step the format has, up to 63 weeks, zero means DefaultValidityPeriod
+func EncodeValidity(period time.Duration) byte {
+	if period <= 0 {
+		period = DefaultValidityPeriod
+	}
+
+	minutes := int((period + time.Minute - 1) / time.Minute)
+	switch {
+	case minutes <= 12*60: // 5 minute steps
+		return byte((minutes+4)/5 - 1)
+	case minutes <= 24*60: // 30 minute steps
+		return byte(143 + (minutes-12*60+29)/30)
+	case minutes <= 30*24*60: // days
+		return byte(166 + (minutes+24*60-1)/(24*60))
+	}
+
+	weeks := (minutes + 7*24*60 - 1) / (7 * 24 * 60)
+	if weeks > 63 {
+		weeks = 63
+	}
+	return byte(192 + weeks)
+}
+
+// DecodeValidity returns period given by relative validity period
+func DecodeValidity(vp byte) time.Duration {
+	switch {
+	case vp <= 143:
+		return time.Duration(vp+1) * 5 * time.Minute
+	case vp <= 167:
+		return 12*time.Hour + time.Duration(vp-143)*30*time.Minute
+	case vp <= 196:
+		return time.Duration(vp-166) * 24 * time.Hour
+	}
+	return time.Duration(vp-192) * 7 * 24 * time.Hour
+}
+
+// dcsAlphabet extracts alphabet from data coding scheme (3GPP TS 23.038)
+func dcsAlphabet(dcs byte) int {
+	switch {
+	case dcs&0xC0 == 0x00, dcs&0xC0 == 0x40: // general data coding
+		switch (dcs >> 2) & 0x03 {
+		case 0x01:
+			return Alphabet8Bit
+		case 0x02:
+			return AlphabetUCS2
+		}
+		return AlphabetGSM7
+	case dcs&0xF0 == 0xE0: // message waiting, UCS2
+		return AlphabetUCS2
+	case dcs&0xF0 == 0xF0: // data coding/message class
+		if dcs&0x04 != 0 {
+			return Alphabet8Bit
+		}
+		return AlphabetGSM7
+	}
+	return AlphabetGSM7
+}
+
+func encodeUCS2(text string) []byte {
+	units := utf16.Encode([]rune(text))
+	data := make([]byte, 0, len(units)*2)
+	for _, u := range units {
+		data = append(data, byte(u>>8), byte(u))
+	}
+	return data
+}
+
+func decodeUCS2(data []byte) string {
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		units = append(units, uint16(data[i])<<8|uint16(data[i+1]))
+	}
+	return string(utf16.Decode(units))
+}
+
+// encodeAddress returns address field with length in digits, type of address
+// and semi-octet encoded number, names are packed GSM 7-bit and their length
+// is in semi-octets
+func encodeAddress(address Address) []byte {
+	if address.Kind == AddressAlphanumeric {
+		septets, _ := EncodeGSM7(address.Value)
+		return append([]byte{byte((len(septets)*7 + 3) / 4), TypeAlphanumeric}, PackSeptets(septets, 0)...)
+	}
+
+	return append([]byte{byte(len(address.Value)), byte(address.Type())}, encodeSemiOctets(address.Value)...)
+}
+
+func encodeSemiOctets(digits string) []byte {
+	if len(digits)%2 == 1 {
+		digits += "F"
+	}
+
+	octets := make([]byte, 0, len(digits)/2)
+	for i := 0; i < len(digits); i += 2 {
+		octets = append(octets, semiOctet(digits[i+1])<<4|semiOctet(digits[i]))
+	}
+	return octets
+}
+
+func semiOctet(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c == '*':
+		return 0x0A
+	case c == '#':
+		return 0x0B
+	}
+	return 0x0F
+}
+
+func decodeSemiOctets(octets []byte) string {
+	const digits = "0123456789*#abc"
+
+	var output strings.Builder
+	for _, o := range octets {
+		for _, n := range []byte{o & 0x0F, o >> 4} {
+			if n == 0x0F {
+				break
+			}
+			output.WriteByte(digits[n])
+		}
+	}
+	return output.String()
+}
+
+// decodeTimestamp parses service centre time stamp, timezone is given in
+// quarters of an hour
+func decodeTimestamp(octets []byte) time.Time {
+	if len(octets) < 7 {
+		return time.Time{}
+	}
+
+	var values [6]int
+	for i := 0; i < 6; i++ {
+		values[i] = int(octets[i]&0x0F)*10 + int(octets[i]>>4)
+	}
+
+	tz := int(octets[6]&0x07)*10 + int(octets[6]>>4)
+	if octets[6]&0x08 != 0 {
+		tz = -tz
+	}
+
+	location := time.FixedZone("", tz*15*60)
+	return time.Date(2000+values[0], time.Month(values[1]), values[2], values[3], values[4], values[5], 0, location)
+}
+
+func encodeTimestamp(t time.Time) []byte {
+	_, offset := t.Zone()
+	tz := offset / (15 * 60)
+	sign := byte(0)
+	if tz < 0 {
+		sign = 0x08
+		tz = -tz
+	}
+
+	values := []int{t.Year() % 100, int(t.Month()), t.Day(), t.Hour(), t.Minute(), t.Second(), tz}
+	octets := make([]byte, len(values))
+	for i, v := range values {
+		octets[i] = byte(v%10)<<4 | byte(v/10)
+	}
+	octets[6] |= sign
+	return octets
+}
+
+// pduReader reads PDU fields in order and remembers first overflow
+type pduReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *pduReader) bytes(n int) []byte {
+	if r.err != nil || r.pos+n > len(r.data) {
+		r.err = errInvalidPDU
+		return nil
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *pduReader) byte() byte {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *pduReader) skip(n int) {
+	r.bytes(n)
+}
+
+func (r *pduReader) rest() []byte {
+	if r.err != nil {
+		return nil
+	}
+	b := r.data[r.pos:]
+	r.pos = len(r.data)
+	return b
+}
+
+// address reads originator or destination address field
+func (r *pduReader) address() string {
+	length := int(r.byte())
+	toa := r.byte()
+	value := r.bytes((length + 1) / 2)
+	if r.err != nil {
+		return ""
+	}
+
+	if toa&0x70 == 0x50 { // alphanumeric, length is in semi-octets
+		return DecodeGSM7(UnpackSeptets(value, length*4/7, 0))
+	}
+
+	number := decodeSemiOctets(value)
+	if toa&0x70 == 0x10 {
+		number = "+" + number
+	}
+	return number
+}
@@ -0,0 +1,298 @@
+package modem
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubmitEncode(t *testing.T) {
+	tests := []struct {
+		submit Submit
+		pdu    string
+		length int
+	}{
+		{
+			Submit{Destination: "+46708251358", Text: "hellohello", ValidityPeriod: 4 * 24 * time.Hour},
+			"0011000B916407281553F80000AA0AE8329BFD4697D9EC37", 23,
+		},
+		{
+			Submit{Destination: "0612345678", Text: "hi", StatusReport: true},
+			"0031000A8160214365870000A702E834", 15,
+		},
+		{
+			Submit{Destination: "+46708251358", Text: "hi", Class: Class0, ValidityPeriod: 5 * time.Minute},
+			"0011000B916407281553F800100002E834", 16,
+		},
+		{
+			Submit{Destination: "+46708251358", Text: "Жж"},
+			"0011000B916407281553F80008A70404160436", 18,
+		},
+	}
+
+	for _, test := range tests {
+		pdu, length, err := test.submit.Encode()
+		if err != nil {
+			t.Errorf("Encode(%+v) failed: %v", test.submit, err)
+			continue
+		}
+		if pdu != test.pdu || length != test.length {
+			t.Errorf("Encode(%+v) = %s, %d, want %s, %d", test.submit, pdu, length, test.pdu, test.length)
+		}
+	}
+}
+
+func TestSubmitRoundTrip(t *testing.T) {
+	tests := []Submit{
+		{Destination: "+447700900123", Text: "plain text", ValidityPeriod: DefaultValidityPeriod},
+		{Destination: "+447700900123", Text: "with header", UDH: ConcatHeader(7, 2, 1, false), ValidityPeriod: time.Hour},
+		{Destination: "+447700900123", Text: "16-bit ref", UDH: ConcatHeader(0x1234, 3, 3, true), ValidityPeriod: time.Hour},
+		{Destination: "+447700900123", Text: "ünïcödé ✓", UDH: ConcatHeader(1, 2, 2, false), ValidityPeriod: time.Hour},
+		{Destination: "1234", Text: "{€}", StatusReport: true, Class: Class1, ValidityPeriod: 7 * 24 * time.Hour},
+	}
+
+	for _, submit := range tests {
+		pdu, _, err := submit.Encode()
+		if err != nil {
+			t.Errorf("Encode(%+v) failed: %v", submit, err)
+			continue
+		}
+
+		decoded, err := DecodeSubmit(pdu)
+		if err != nil {
+			t.Errorf("DecodeSubmit(%s) failed: %v", pdu, err)
+			continue
+		}
+		if decoded.Destination != submit.Destination || decoded.Text != submit.Text || !bytes.Equal(decoded.UDH, submit.UDH) ||
+			decoded.StatusReport != submit.StatusReport || decoded.Class != submit.Class || decoded.ValidityPeriod != submit.ValidityPeriod {
+			t.Errorf("DecodeSubmit(Encode(%+v)) = %+v", submit, *decoded)
+		}
+	}
+}
+
+func TestSubmitEncodeErrors(t *testing.T) {
+	tests := []Submit{
+		{Destination: "", Text: "hi"},
+		{Destination: "+0123456789", Text: "hi"},
+		{Destination: "Bank", Text: "hi"},
+		{Destination: "+447700900123", Text: strings.Repeat("a", 161)},
+		{Destination: "+447700900123", Text: strings.Repeat("ж", 71)},
+	}
+
+	for _, submit := range tests {
+		if pdu, _, err := submit.Encode(); err == nil {
+			t.Errorf("Encode(%+v) = %s, want error", submit, pdu)
+		}
+	}
+}
+
+func TestDecodeSubmitErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"00C100000000000000",                     // header indicated but missing
+		"00410000000000" + "01" + "050003010201", // data shorter than header
+	}
+
+	for _, pdu := range tests {
+		if submit, err := DecodeSubmit(pdu); err == nil {
+			t.Errorf("DecodeSubmit(%q) = %+v, want error", pdu, *submit)
+		}
+	}
+}
+
+func TestDecodeDeliver(t *testing.T) {
+	deliver, err := DecodeDeliver("07911326040000F0040B911346610089F60000208062917314800CC8F71D14969741F977FD07")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timestamp := time.Date(2002, 8, 26, 19, 37, 41, 0, time.FixedZone("", 2*60*60))
+	if deliver.Originator != "+31641600986" || deliver.Text != "How are you?" || !deliver.Timestamp.Equal(timestamp) {
+		t.Errorf("got %+v", *deliver)
+	}
+	if _, offset := deliver.Timestamp.Zone(); offset != 2*60*60 {
+		t.Errorf("got zone offset %d, want service centre zone +2h", offset)
+	}
+	if deliver.Name() != "" {
+		t.Errorf("number gave name %q", deliver.Name())
+	}
+}
+
+func TestDeliverRoundTrip(t *testing.T) {
+	timestamp := time.Date(2015, 1, 23, 11, 15, 2, 0, time.FixedZone("", -5*60*60))
+	tests := []Deliver{
+		{Originator: "+447700900123", Text: "hello", Timestamp: timestamp},
+		{Originator: "0612345678", Text: "Grüße €", Timestamp: timestamp},
+		{Originator: "MyBank", Text: "code 1234", Timestamp: timestamp},
+		{Originator: "+447700900123", Text: "Привет", UDH: ConcatHeader(200, 2, 1, false), Timestamp: timestamp},
+		{Originator: "+447700900123", Text: "part", UDH: ConcatHeader(300, 2, 2, true), Timestamp: timestamp},
+	}
+
+	for _, deliver := range tests {
+		pdu, _, err := deliver.Encode()
+		if err != nil {
+			t.Errorf("Encode(%+v) failed: %v", deliver, err)
+			continue
+		}
+
+		decoded, err := DecodeDeliver(pdu)
+		if err != nil {
+			t.Errorf("DecodeDeliver(%s) failed: %v", pdu, err)
+			continue
+		}
+		if decoded.Originator != deliver.Originator || decoded.Text != deliver.Text || !bytes.Equal(decoded.UDH, deliver.UDH) ||
+			!decoded.Timestamp.Equal(deliver.Timestamp) {
+			t.Errorf("DecodeDeliver(Encode(%+v)) = %+v", deliver, *decoded)
+		}
+	}
+
+	named := Deliver{Originator: "MyBank"}
+	if named.Name() != "MyBank" {
+		t.Errorf("alphanumeric originator gave name %q", named.Name())
+	}
+}
+
+func TestDecodeDeliverErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"not hex",
+		"0011000B916407281553F80000AA0AE8329BFD4697D9EC37", // SMS-SUBMIT
+		"07911326040000F0040B91134661",                     // cut in address
+		"0040",                                             // header indicated but missing
+		"0044" + "0B914477009001F3" + "0000" + "52107251806000" + "00" + "050003010201", // data shorter than header
+	}
+
+	for _, pdu := range tests {
+		if deliver, err := DecodeDeliver(pdu); err == nil {
+			t.Errorf("DecodeDeliver(%q) = %+v, want error", pdu, *deliver)
+		}
+	}
+}
+
+func TestConcatHeader(t *testing.T) {
+	tests := []struct {
+		ref        uint16
+		total, seq int
+		ref16      bool
+		header     []byte
+		wantRef    int
+	}{
+		{0x12, 3, 1, false, []byte{0x00, 0x03, 0x12, 0x03, 0x01}, 0x12},
+		{0x1234, 3, 2, false, []byte{0x00, 0x03, 0x34, 0x03, 0x02}, 0x34}, // 8-bit keeps low byte
+		{0x1234, 2, 2, true, []byte{0x08, 0x04, 0x12, 0x34, 0x02, 0x02}, 0x1234},
+	}
+
+	for _, test := range tests {
+		header := ConcatHeader(test.ref, test.total, test.seq, test.ref16)
+		if !bytes.Equal(header, test.header) {
+			t.Errorf("ConcatHeader(%d, %d, %d, %v) = % X, want % X", test.ref, test.total, test.seq, test.ref16, header, test.header)
+		}
+
+		ref, total, seq, ok := ParseConcatHeader(header)
+		if !ok || ref != test.wantRef || total != test.total || seq != test.seq {
+			t.Errorf("ParseConcatHeader(% X) = %d, %d, %d, %v", header, ref, total, seq, ok)
+		}
+	}
+}
+
+func TestParseConcatHeader(t *testing.T) {
+	tests := []struct {
+		udh             []byte
+		ref, total, seq int
+		ok              bool
+	}{
+		{[]byte{0x0A, 0x02, 0x01, 0x02, 0x00, 0x03, 0x05, 0x02, 0x01}, 5, 2, 1, true}, // other element first
+		{[]byte{0x00, 0x03, 0x05, 0x01, 0x01}, 0, 0, 0, false},                        // single part
+		{[]byte{0x00, 0x03, 0x05, 0x02, 0x03}, 0, 0, 0, false},                        // part out of range
+		{[]byte{0x00, 0x03, 0x05, 0x02}, 0, 0, 0, false},                              // truncated
+		{[]byte{0x00, 0x04, 0x05, 0x02, 0x01, 0x00}, 0, 0, 0, false},                  // wrong length
+		{nil, 0, 0, 0, false},
+	}
+
+	for _, test := range tests {
+		ref, total, seq, ok := ParseConcatHeader(test.udh)
+		if ref != test.ref || total != test.total || seq != test.seq || ok != test.ok {
+			t.Errorf("ParseConcatHeader(% X) = %d, %d, %d, %v, want %d, %d, %d, %v",
+				test.udh, ref, total, seq, ok, test.ref, test.total, test.seq, test.ok)
+		}
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		ref16 bool
+		sizes []int // characters in each part
+	}{
+		{"short", "hello", false, []int{5}},
+		{"160 septets", strings.Repeat("a", 160), false, []int{160}},
+		{"161 septets", strings.Repeat("a", 161), false, []int{153, 8}},
+		{"16-bit reference", strings.Repeat("a", 161), true, []int{152, 9}},
+		{"extension characters", strings.Repeat("€", 80), false, []int{80}},
+		{"escape not split", strings.Repeat("a", 152) + "€" + strings.Repeat("a", 10), false, []int{152, 11}},
+		{"70 UCS2", strings.Repeat("ж", 70), false, []int{70}},
+		{"71 UCS2", strings.Repeat("ж", 71), false, []int{67, 4}},
+		{"surrogate pair not split", strings.Repeat("ж", 66) + "😀" + strings.Repeat("ж", 3), false, []int{66, 4}},
+	}
+
+	for _, test := range tests {
+		parts := SplitMessage(test.text, test.ref16)
+		var sizes []int
+		for _, part := range parts {
+			sizes = append(sizes, len([]rune(part)))
+		}
+		if strings.Join(parts, "") != test.text || len(sizes) != len(test.sizes) {
+			t.Errorf("%s: got part sizes %v, want %v", test.name, sizes, test.sizes)
+			continue
+		}
+		for i := range sizes {
+			if sizes[i] != test.sizes[i] {
+				t.Errorf("%s: got part sizes %v, want %v", test.name, sizes, test.sizes)
+				break
+			}
+		}
+
+		// every part fits into PDU together with concatenation header
+		if len(parts) > 1 {
+			for i, part := range parts {
+				submit := Submit{Destination: "+447700900123", Text: part, UDH: ConcatHeader(1, len(parts), i+1, test.ref16)}
+				if _, _, err := submit.Encode(); err != nil {
+					t.Errorf("%s: part %d does not fit: %v", test.name, i+1, err)
+				}
+			}
+		}
+	}
+}
+
+func TestValidity(t *testing.T) {
+	tests := []struct {
+		period  time.Duration
+		vp      byte
+		decoded time.Duration
+	}{
+		{0, 167, 24 * time.Hour},
+		{time.Minute, 0, 5 * time.Minute},
+		{5 * time.Minute, 0, 5 * time.Minute},
+		{6 * time.Minute, 1, 10 * time.Minute},
+		{12 * time.Hour, 143, 12 * time.Hour},
+		{13 * time.Hour, 145, 13 * time.Hour},
+		{24 * time.Hour, 167, 24 * time.Hour},
+		{25 * time.Hour, 168, 2 * 24 * time.Hour},
+		{30 * 24 * time.Hour, 196, 30 * 24 * time.Hour},
+		{31 * 24 * time.Hour, 197, 5 * 7 * 24 * time.Hour},
+		{63 * 7 * 24 * time.Hour, 255, 63 * 7 * 24 * time.Hour},
+		{100 * 7 * 24 * time.Hour, 255, 63 * 7 * 24 * time.Hour},
+	}
+
+	for _, test := range tests {
+		vp := EncodeValidity(test.period)
+		if vp != test.vp {
+			t.Errorf("EncodeValidity(%v) = %d, want %d", test.period, vp, test.vp)
+		}
+		if decoded := DecodeValidity(vp); decoded != test.decoded {
+			t.Errorf("DecodeValidity(%d) = %v, want %v", vp, decoded, test.decoded)
+		}
+	}
+}
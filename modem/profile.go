@@ -0,0 +1,137 @@
+package modem
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Profile describes what differs between modem vendors, everything else is
+// standard 3GPP TS 27.005/27.007. Long messages are concatenated the same way
+// on every modem, size of reference is set per device with Concat16
+type Profile struct {
+	Name string
+
+	// Init is sent after standard setup, failures are logged and ignored
+	Init []string
+
+	// Storage is preferred message storage for AT+CPMS, SM is used when the
+	// modem refuses it
+	Storage string
+
+	// PacketRegistration is query for packet switched registration, LTE
+	// modules report it with AT+CEREG?
+	PacketRegistration string
+
+	// USSDPacked means USSD strings are hex of packed GSM 7-bit septets
+	// whatever AT+CSCS says
+	USSDPacked bool
+}
+
+var (
+	ProfileGeneric = &Profile{
+		Name:               "generic",
+		Storage:            "MT",
+		PacketRegistration: "AT+CGREG?",
+	}
+	ProfileWavecom = &Profile{
+		Name:               "wavecom",
+		Init:               []string{"AT+WIND=0"}, // disable unsolicited indications
+		Storage:            "MT",
+		PacketRegistration: "AT+CGREG?",
+	}
+	ProfileHuawei = &Profile{
+		Name:               "huawei",
+		Init:               []string{"AT^CURC=0"}, // disable periodic ^RSSI, ^MODE and ^BOOT reports
+		Storage:            "SM",
+		PacketRegistration: "AT+CGREG?",
+		USSDPacked:         true,
+	}
+	ProfileSIM800 = &Profile{
+		Name:               "sim800",
+		Storage:            "SM",
+		PacketRegistration: "AT+CGREG?",
+	}
+	ProfileSIM7600 = &Profile{
+		Name:               "sim7600",
+		Storage:            "ME",
+		PacketRegistration: "AT+CEREG?",
+	}
+	ProfileQuectel = &Profile{
+		Name:               "quectel",
+		Init:               []string{`AT+QINDCFG="all",0`}, // disable +QIND reports
+		Storage:            "ME",
+		PacketRegistration: "AT+CEREG?",
+	}
+	ProfileCinterion = &Profile{
+		Name:               "cinterion",
+		Storage:            "MT",
+		PacketRegistration: "AT+CGREG?",
+	}
+)
+
+// Profiles are built-in profiles by name, as used in PROFILE setting
+var Profiles = map[string]*Profile{}
+
+func init() {
+	for _, p := range []*Profile{ProfileGeneric, ProfileWavecom, ProfileHuawei, ProfileSIM800, ProfileSIM7600, ProfileQuectel, ProfileCinterion} {
+		Profiles[p.Name] = p
+	}
+}
+
+// LookupProfile returns built-in profile by case insensitive name
+func LookupProfile(name string) (*Profile, error) {
+	if p, ok := Profiles[strings.ToLower(strings.TrimSpace(name))]; ok {
+		return p, nil
+	}
+
+	var names []string
+	for name := range Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown modem profile %s, use one of %s", name, strings.Join(names, ", "))
+}
+
+// DetectProfile picks profile from AT+CGMI manufacturer and AT+CGMM model,
+// unknown modems get generic profile
+func DetectProfile(manufacturer, model string) *Profile {
+	manufacturer = strings.ToUpper(manufacturer)
+	model = strings.ToUpper(model)
+
+	switch {
+	case strings.Contains(manufacturer, "HUAWEI"):
+		return ProfileHuawei
+	case strings.Contains(manufacturer, "SIMCOM"):
+		if strings.Contains(model, "SIM7") {
+			return ProfileSIM7600
+		}
+		return ProfileSIM800
+	case strings.Contains(manufacturer, "QUECTEL"):
+		return ProfileQuectel
+	case strings.Contains(manufacturer, "CINTERION"), strings.Contains(manufacturer, "SIEMENS"),
+		strings.Contains(manufacturer, "GEMALTO"), strings.Contains(manufacturer, "THALES"):
+		return ProfileCinterion
+	case strings.Contains(manufacturer, "WAVECOM"):
+		return ProfileWavecom
+	}
+	return ProfileGeneric
+}
+
+// detectProfile asks modem who made it
+func (m *Driver) detectProfile() *Profile {
+	manufacturer, err := m.query("AT+CGMI", "")
+	if err != nil {
+		m.log("--- Profile:", err.Error())
+		return ProfileGeneric
+	}
+	model, err := m.query("AT+CGMM", "")
+	if err != nil {
+		m.log("--- Profile:", err.Error())
+	}
+
+	profile := DetectProfile(strings.TrimPrefix(manufacturer, "+CGMI: "), strings.TrimPrefix(model, "+CGMM: "))
+	log.Printf("--- Profile: %s detected for %s %s\n", profile.Name, manufacturer, model)
+	return profile
+}
@@ -0,0 +1,134 @@
+package modem
+
+import (
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatusReport is SMS-STATUS-REPORT telling what happened to sent message
+type StatusReport struct {
+	Reference  int
+	Recipient  string
+	Status     int       // TP-Status as defined in 3GPP TS 23.040 9.2.3.15
+	Timestamp  time.Time // when service centre received the message
+	Discharged time.Time // when message was delivered or given up
+}
+
+// Delivered reports whether the message reached the recipient
+func (r *StatusReport) Delivered() bool {
+	return r.Status < 0x20
+}
+
+// Pending reports whether service centre is still trying to deliver
+func (r *StatusReport) Pending() bool {
+	return r.Status >= 0x20 && r.Status < 0x40
+}
+
+// Expired reports whether validity period expired before delivery
+func (r *StatusReport) Expired() bool {
+	return r.Status == 0x46
+}
+
+// DecodeStatusReport parses hex PDU of SMS-STATUS-REPORT
+func DecodeStatusReport(pdu string) (*StatusReport, error) {
+	data, err := hex.DecodeString(strings.TrimSpace(pdu))
+	if err != nil {
+		return nil, err
+	}
+
+	r := &pduReader{data: data}
+	r.skip(int(r.byte())) // SMSC information
+
+	firstOctet := r.byte()
+	if firstOctet&0x03 != 0x02 {
+		return nil, fmt.Errorf("not SMS-STATUS-REPORT PDU: message type %d", firstOctet&0x03)
+	}
+
+	report := &StatusReport{}
+	report.Reference = int(r.byte())
+	report.Recipient = r.address()
+	report.Timestamp = decodeTimestamp(r.bytes(7))
+	report.Discharged = decodeTimestamp(r.bytes(7))
+	report.Status = int(r.byte())
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	return report, nil
+}
+
+// Encode returns hex encoded PDU as modem shows it after +CDS:, with empty
+// SMSC information, and TPDU length
+func (r *StatusReport) Encode() (pdu string, length int) {
+	tpdu := []byte{
+		0x06, // SMS-STATUS-REPORT, no more messages to send
+		byte(r.Reference),
+	}
+	recipient, _ := ParseAddress(r.Recipient)
+	tpdu = append(tpdu, encodeAddress(recipient)...)
+	tpdu = append(tpdu, encodeTimestamp(r.Timestamp)...)
+	tpdu = append(tpdu, encodeTimestamp(r.Discharged)...)
+	tpdu = append(tpdu, byte(r.Status))
+
+	return "00" + strings.ToUpper(hex.EncodeToString(tpdu)), len(tpdu)
+}
+
+/*
+1. first octet
+2. message reference
+3. recipient
+4. type of address
+5. service centre timestamp
+6. discharge time
+7. status
+*/
+var textStatusReport = regexp.MustCompile(`^(\d+),(\d+),"?([^",]*)"?,(\d*),"([^"]+)","([^"]+)",(\d+)`)
+
+// parseTextStatusReport parses status report fields as modem shows them
+// after +CDS: in text mode
+func parseTextStatusReport(fields string, ucs2 bool) (*StatusReport, error) {
+	match := textStatusReport.FindStringSubmatch(strings.TrimSpace(fields))
+	if match == nil {
+		return nil, fmt.Errorf("invalid status report: %s", fields)
+	}
+
+	report := &StatusReport{}
+	report.Reference, _ = strconv.Atoi(match[2])
+	report.Recipient = match[3]
+	if ucs2 {
+		report.Recipient = decodeUCS2Field(report.Recipient)
+	}
+	report.Recipient = numberWithType(report.Recipient, match[4])
+	report.Timestamp = parseTextTimestamp(match[5])
+	report.Discharged = parseTextTimestamp(match[6])
+	report.Status, _ = strconv.Atoi(match[7])
+
+	return report, nil
+}
+
+// parseTextTimestamp parses "yy/MM/dd,hh:mm:ss±zz" where zone is in quarters
+// of an hour
+func parseTextTimestamp(value string) time.Time {
+	var year, month, day, hour, minute, second, zone int
+	var sign byte
+	_, err := fmt.Sscanf(value, "%d/%d/%d,%d:%d:%d%c%d", &year, &month, &day, &hour, &minute, &second, &sign, &zone)
+	if err != nil {
+		return time.Time{}
+	}
+	if sign == '-' {
+		zone = -zone
+	}
+
+	location := time.FixedZone("", zone*15*60)
+	return time.Date(2000+year, time.Month(month), day, hour, minute, second, 0, location)
+}
+
+func isHex(value string) bool {
+	_, err := hex.DecodeString(value)
+	return err == nil
+}
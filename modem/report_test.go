@@ -0,0 +1,155 @@
+package modem
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatusReportStates(t *testing.T) {
+	tests := []struct {
+		status                      int
+		delivered, pending, expired bool
+	}{
+		{0x00, true, false, false},  // received by recipient
+		{0x02, true, false, false},  // replaced by service centre
+		{0x20, false, true, false},  // congestion, still trying
+		{0x30, false, true, false},  // recipient busy, still trying
+		{0x41, false, false, false}, // incompatible destination
+		{0x46, false, false, true},  // validity period expired
+		{0x60, false, false, false}, // congestion, given up
+	}
+
+	for _, test := range tests {
+		report := StatusReport{Status: test.status}
+		if report.Delivered() != test.delivered || report.Pending() != test.pending || report.Expired() != test.expired {
+			t.Errorf("status 0x%02X: delivered %v pending %v expired %v", test.status, report.Delivered(), report.Pending(), report.Expired())
+		}
+	}
+}
+
+func TestDecodeStatusReport(t *testing.T) {
+	// reference 42 to +447700900123, delivered
+	report, err := DecodeStatusReport("00062A0C91447700091032511060111580805110601115908000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zone := time.FixedZone("", 2*60*60)
+	if report.Reference != 42 || report.Recipient != "+447700900123" || report.Status != 0 ||
+		!report.Timestamp.Equal(time.Date(2015, 1, 6, 11, 51, 8, 0, zone)) ||
+		!report.Discharged.Equal(time.Date(2015, 1, 6, 11, 51, 9, 0, zone)) {
+		t.Errorf("got %+v", *report)
+	}
+}
+
+func TestStatusReportRoundTrip(t *testing.T) {
+	zone := time.FixedZone("", -3*60*60-30*60)
+	tests := []StatusReport{
+		{Reference: 0, Recipient: "+447700900123", Status: 0x00},
+		{Reference: 255, Recipient: "07700900123", Status: 0x46},
+		{Reference: 17, Recipient: "1234", Status: 0x30},
+	}
+
+	for _, report := range tests {
+		report.Timestamp = time.Date(2015, 1, 23, 10, 15, 2, 0, zone)
+		report.Discharged = time.Date(2015, 1, 23, 10, 17, 40, 0, zone)
+
+		pdu, length := report.Encode()
+		if length != len(pdu)/2-1 {
+			t.Errorf("Encode(%+v) gave length %d for %s", report, length, pdu)
+		}
+
+		decoded, err := DecodeStatusReport(pdu)
+		if err != nil {
+			t.Errorf("DecodeStatusReport(%s) failed: %v", pdu, err)
+			continue
+		}
+		if decoded.Reference != report.Reference || decoded.Recipient != report.Recipient || decoded.Status != report.Status ||
+			!decoded.Timestamp.Equal(report.Timestamp) || !decoded.Discharged.Equal(report.Discharged) {
+			t.Errorf("DecodeStatusReport(Encode(%+v)) = %+v", report, *decoded)
+		}
+	}
+}
+
+func TestDecodeStatusReportErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"zz",
+		"0011000B916407281553F80000AA0AE8329BFD4697D9EC37", // SMS-SUBMIT
+		"00062A0C91447707", // cut in recipient
+	}
+
+	for _, pdu := range tests {
+		if report, err := DecodeStatusReport(pdu); err == nil {
+			t.Errorf("DecodeStatusReport(%q) = %+v, want error", pdu, *report)
+		}
+	}
+}
+
+func TestParseTextStatusReport(t *testing.T) {
+	tests := []struct {
+		fields string
+		ucs2   bool
+		want   StatusReport
+	}{
+		{
+			` 6,42,"+447700900123",145,"15/01/23,10:15:02+04","15/01/23,10:17:40+04",0`, false,
+			StatusReport{Reference: 42, Recipient: "+447700900123", Status: 0},
+		},
+		{
+			`6,7,"447700900123",145,"15/01/23,10:15:02+04","15/01/23,10:17:40+04",70`, false,
+			StatusReport{Reference: 7, Recipient: "+447700900123", Status: 70},
+		},
+		{
+			`6,8,,,"15/01/23,10:15:02+04","15/01/23,10:17:40+04",48`, false,
+			StatusReport{Reference: 8, Recipient: "", Status: 48},
+		},
+		{
+			`6,9,"002B003400340037003700300030003900300030003100320033",145,"15/01/23,10:15:02+04","15/01/23,10:17:40+04",0`, true,
+			StatusReport{Reference: 9, Recipient: "+447700900123", Status: 0},
+		},
+	}
+
+	zone := time.FixedZone("", 60*60)
+	for _, test := range tests {
+		report, err := parseTextStatusReport(test.fields, test.ucs2)
+		if err != nil {
+			t.Errorf("parseTextStatusReport(%q) failed: %v", test.fields, err)
+			continue
+		}
+		if report.Reference != test.want.Reference || report.Recipient != test.want.Recipient || report.Status != test.want.Status ||
+			!report.Timestamp.Equal(time.Date(2015, 1, 23, 10, 15, 2, 0, zone)) ||
+			!report.Discharged.Equal(time.Date(2015, 1, 23, 10, 17, 40, 0, zone)) {
+			t.Errorf("parseTextStatusReport(%q) = %+v", test.fields, *report)
+		}
+	}
+
+	if report, err := parseTextStatusReport(`6,42`, false); err == nil {
+		t.Errorf("incomplete status report was accepted: %+v", *report)
+	}
+}
+
+func TestParseTextTimestamp(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{"15/01/23,10:15:02+04", time.Date(2015, 1, 23, 10, 15, 2, 0, time.FixedZone("", 60*60))},
+		{"15/01/23,10:15:02-20", time.Date(2015, 1, 23, 10, 15, 2, 0, time.FixedZone("", -5*60*60))},
+		{"15/01/23,10:15:02+00", time.Date(2015, 1, 23, 10, 15, 2, 0, time.UTC)},
+		{"", time.Time{}},
+		{"garbage", time.Time{}},
+	}
+
+	for _, test := range tests {
+		got := parseTextTimestamp(test.value)
+		if !got.Equal(test.want) {
+			t.Errorf("parseTextTimestamp(%q) = %v, want %v", test.value, got, test.want)
+		}
+		if _, offset := got.Zone(); !got.IsZero() {
+			if _, want := test.want.Zone(); offset != want {
+				t.Errorf("parseTextTimestamp(%q) has zone offset %d, want %d", test.value, offset, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package modem
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Telnet commands and options, RFC 854, 856, 858 and 2217
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	optionBinary  = 0
+	optionSGA     = 3
+	optionComPort = 44
+
+	comSetBaudRate = 1
+	comSetDataSize = 2
+	comSetParity   = 3
+	comSetStopSize = 4
+	comSetControl  = 5
+)
+
+// states of telnet stream decoder
+const (
+	telnetData = iota
+	telnetCommand
+	telnetOption
+	telnetSubnegotiation
+	telnetSubnegotiationIAC
+)
+
+func init() {
+	RegisterTransport("rfc2217", dialRFC2217)
+}
+
+// rfc2217Port is serial port of device server speaking Telnet COM Port
+// Control Option, line is set to given baud rate, 8N1 without flow control
+type rfc2217Port struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+
+	buffer  []byte
+	pending []byte // decoded data not returned by Read yet
+
+	state   int
+	verb    byte   // WILL, WONT, DO or DONT waiting for option
+	sub     []byte // subnegotiation being received
+	comPort bool   // server agreed to COM port control
+	refused bool   // server refused COM port control
+}
+
+func dialRFC2217(address string, baudRate int) (Transport, error) {
+	conn, err := dialConn(address)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &rfc2217Port{conn: conn, buffer: make([]byte, 256)}
+	if err := p.negotiate(baudRate); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// negotiate enables COM port control and configures serial line
+func (p *rfc2217Port) negotiate(baudRate int) error {
+	err := p.write([]byte{
+		telnetIAC, telnetWILL, optionBinary, telnetIAC, telnetDO, optionBinary,
+		telnetIAC, telnetWILL, optionSGA, telnetIAC, telnetDO, optionSGA,
+		telnetIAC, telnetWILL, optionComPort,
+	})
+	if err != nil {
+		return err
+	}
+
+	p.conn.SetReadDeadline(time.Now().Add(dialTimeout))
+	for !p.comPort {
+		n, err := p.conn.Read(p.buffer)
+		p.pending = append(p.pending, p.decode(p.buffer[:n])...)
+		if p.refused {
+			return errors.New("server does not support RFC 2217 COM port control")
+		}
+		if err != nil && !p.comPort {
+			return fmt.Errorf("RFC 2217 negotiation failed: %v", err)
+		}
+	}
+	p.conn.SetReadDeadline(time.Time{})
+
+	baud := make([]byte, 4)
+	binary.BigEndian.PutUint32(baud, uint32(baudRate))
+
+	var settings []byte
+	settings = append(settings, comPortCommand(comSetBaudRate, baud...)...)
+	settings = append(settings, comPortCommand(comSetDataSize, 8)...)
+	settings = append(settings, comPortCommand(comSetParity, 1)...)   // none
+	settings = append(settings, comPortCommand(comSetStopSize, 1)...) // one stop bit
+	settings = append(settings, comPortCommand(comSetControl, 1)...)  // no flow control
+	return p.write(settings)
+}
+
+func comPortCommand(command byte, value ...byte) []byte {
+	sb := []byte{telnetIAC, telnetSB, optionComPort, command}
+	sb = append(sb, escapeIAC(value)...)
+	return append(sb, telnetIAC, telnetSE)
+}
+
+func escapeIAC(data []byte) []byte {
+	return bytes.Replace(data, []byte{telnetIAC}, []byte{telnetIAC, telnetIAC}, -1)
+}
+
+func (p *rfc2217Port) Read(b []byte) (int, error) {
+	for len(p.pending) == 0 {
+		n, err := p.conn.Read(p.buffer)
+		p.pending = append(p.pending, p.decode(p.buffer[:n])...)
+
+		if err != nil && len(p.pending) == 0 {
+			if err == io.EOF {
+				err = ErrPortClosed // there is no read timeout, EOF means server hung up
+			}
+			return 0, err
+		}
+	}
+
+	n := copy(b, p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
+
+func (p *rfc2217Port) Write(b []byte) (int, error) {
+	if err := p.write(escapeIAC(b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (p *rfc2217Port) Close() error {
+	return p.conn.Close()
+}
+
+func (p *rfc2217Port) write(b []byte) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	_, err := p.conn.Write(b)
+	return err
+}
+
+// decode strips telnet commands from received bytes and returns the data,
+// state is kept between calls as commands may be split across reads
+func (p *rfc2217Port) decode(received []byte) []byte {
+	var data []byte
+
+	for _, c := range received {
+		switch p.state {
+		case telnetData:
+			if c == telnetIAC {
+				p.state = telnetCommand
+			} else {
+				data = append(data, c)
+			}
+		case telnetCommand:
+			switch c {
+			case telnetIAC:
+				data = append(data, c) // escaped 0xFF
+				p.state = telnetData
+			case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+				p.verb = c
+				p.state = telnetOption
+			case telnetSB:
+				p.sub = p.sub[:0]
+				p.state = telnetSubnegotiation
+			default:
+				p.state = telnetData // NOP, GA and friends carry nothing
+			}
+		case telnetOption:
+			p.option(p.verb, c)
+			p.state = telnetData
+		case telnetSubnegotiation:
+			if c == telnetIAC {
+				p.state = telnetSubnegotiationIAC
+			} else {
+				p.sub = append(p.sub, c)
+			}
+		case telnetSubnegotiationIAC:
+			if c == telnetIAC {
+				p.sub = append(p.sub, c)
+				p.state = telnetSubnegotiation
+			} else {
+				// SE, line and modem state notifications and answers to
+				// our settings are not needed
+				p.state = telnetData
+			}
+		}
+	}
+
+	return data
+}
+
+// option answers option negotiation, everything except options we asked for
+// is refused
+func (p *rfc2217Port) option(verb, option byte) {
+	ours := option == optionBinary || option == optionSGA || option == optionComPort
+
+	switch verb {
+	case telnetDO:
+		if option == optionComPort {
+			p.comPort = true
+		}
+		if !ours {
+			p.write([]byte{telnetIAC, telnetWONT, option})
+		}
+	case telnetDONT:
+		if option == optionComPort {
+			p.refused = true
+		}
+	case telnetWILL:
+		if option != optionBinary && option != optionSGA {
+			p.write([]byte{telnetIAC, telnetDONT, option})
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package modem
+
+import (
+	"io"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+// number of empty reads in a row after which port is considered hung up
+const hangupReads = 10
+
+func init() {
+	RegisterTransport("serial", dialSerial)
+}
+
+// serialPort is local serial port, tarm/serial returns io.EOF both on read
+// timeout and when USB device is unplugged, only the timeout takes a while
+type serialPort struct {
+	*serial.Port
+	hangups int
+}
+
+func dialSerial(address string, baudRate int) (Transport, error) {
+	config := &serial.Config{Name: address, Baud: baudRate, ReadTimeout: time.Second * 5} // read timeout should not happen if modem will behave nicely
+	port, err := serial.OpenPort(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &serialPort{Port: port}, nil
+}
+
+func (p *serialPort) Read(b []byte) (int, error) {
+	start := time.Now()
+	n, err := p.Port.Read(b)
+
+	if err == io.EOF && n == 0 && time.Since(start) < time.Millisecond*100 {
+		p.hangups++
+	} else {
+		p.hangups = 0
+	}
+	if p.hangups >= hangupReads {
+		return 0, ErrPortClosed
+	}
+
+	return n, err
+}
@@ -0,0 +1,72 @@
+package simulator
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// ListenPTY serves simulator on pseudo terminal and returns its path, e.g.
+// /dev/pts/3, which can be used as COMPORT of a serial device
+func (m *Modem) ListenPTY() (string, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+
+	var unlock int32
+	if err := ioctl(master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		master.Close()
+		return "", err
+	}
+
+	var number uint32
+	if err := ioctl(master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&number))); err != nil {
+		master.Close()
+		return "", err
+	}
+	path := fmt.Sprintf("/dev/pts/%d", number)
+
+	// reading master fails while no one has the terminal open, so we keep
+	// it open ourselves, in raw mode as a serial line would be
+	slave, err := os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return "", err
+	}
+	if err := makeRaw(slave.Fd()); err != nil {
+		slave.Close()
+		master.Close()
+		return "", err
+	}
+
+	go func() {
+		m.Serve(master)
+		slave.Close()
+	}()
+
+	return path, nil
+}
+
+func makeRaw(fd uintptr) error {
+	var termios syscall.Termios
+	if err := ioctl(fd, syscall.TCGETS, uintptr(unsafe.Pointer(&termios))); err != nil {
+		return err
+	}
+
+	termios.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	termios.Oflag &^= syscall.OPOST
+	termios.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	termios.Cflag &^= syscall.CSIZE | syscall.PARENB
+	termios.Cflag |= syscall.CS8
+
+	return ioctl(fd, syscall.TCSETS, uintptr(unsafe.Pointer(&termios)))
+}
+
+func ioctl(fd, request, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
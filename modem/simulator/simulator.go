@@ -0,0 +1,820 @@
+package simulator
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/haxpax/gosms/modem"
+)
+
+// Software GSM modem answering the AT commands modem.Driver uses, so the
+// gateway can be run and tested without hardware
+
+// Behaviour changes how the simulator answers commands starting with Command,
+// e.g. AT+CMGS. Message sending is answered after the message body arrives
+type Behaviour struct {
+	Command  string
+	Response string        // final result code given instead of normal answer, e.g. +CMS ERROR: 38
+	Delay    time.Duration // pause before answering
+	Silent   bool          // command is never answered, driver runs into its timeout
+	Times    int           // number of commands affected, zero for all following
+}
+
+// Fail answers command with given final result code, e.g. ERROR
+func Fail(command, response string) Behaviour {
+	return Behaviour{Command: command, Response: response}
+}
+
+// CMSError answers command with message service failure
+func CMSError(command string, code int) Behaviour {
+	return Fail(command, fmt.Sprintf("+CMS ERROR: %d", code))
+}
+
+// CMEError answers command with equipment failure
+func CMEError(command string, code int) Behaviour {
+	return Fail(command, fmt.Sprintf("+CME ERROR: %d", code))
+}
+
+// Timeout never answers command
+func Timeout(command string) Behaviour {
+	return Behaviour{Command: command, Silent: true}
+}
+
+// Sent is message the simulator was asked to send
+type Sent struct {
+	Destination  string
+	Text         string
+	UDH          []byte
+	StatusReport bool
+	Class        int
+	Validity     time.Duration
+	Reference    int
+	PDU          string // empty in text mode
+}
+
+// Modem is simulated modem, it serves one connection at a time and keeps
+// its state, e.g. stored messages, between connections
+type Modem struct {
+	Manufacturer string
+	Model        string
+	IMEI         string
+	IMSI         string
+	Operator     string
+	SIM          string // AT+CPIN? answer, empty when SIM is not inserted
+	PIN          string // accepted by AT+CPIN, three wrong attempts need PUK
+	Signal       int
+	Registration int
+	Capacity     int // number of messages storage can hold
+
+	// USSD answers USSD code or menu reply, more keeps the session open,
+	// nil answers every code with fixed balance. It is called with simulator
+	// locked and must not call its methods
+	USSD func(code string) (text string, more bool)
+
+	// ReportDelay is how long after sending a requested status report
+	// arrives, zero disables automatic reports, ReportStatus is its TP-Status
+	ReportDelay  time.Duration
+	ReportStatus int
+
+	mu         sync.Mutex
+	writeMu    sync.Mutex
+	port       io.ReadWriteCloser
+	unplugged  bool
+	behaviours []Behaviour
+	echo       bool
+	pduMode    bool
+	ucs2       bool
+	storage    string
+	messages   []*stored
+	nextIndex  int
+	reference  int
+	concat     uint16
+	smsp       int // first octet set by AT+CSMP
+	smspVP     int
+	smspClass  int
+	pinErrors  int
+	cnmiMT     int
+	cnmiDS     int
+	ringing    bool
+	sent       []Sent
+}
+
+type stored struct {
+	index   int
+	read    bool
+	deliver *modem.Deliver
+	report  *modem.StatusReport
+}
+
+// New returns simulator of registered, healthy modem with empty storage
+func New() *Modem {
+	return &Modem{
+		Manufacturer: "GOSMS",
+		Model:        "SIMULATOR",
+		IMEI:         "356938035643809",
+		IMSI:         "234150999999999",
+		Operator:     "Simulated",
+		SIM:          "READY",
+		Signal:       21,
+		Registration: modem.RegisteredHome,
+		Capacity:     30,
+		echo:         true,
+		storage:      "MT",
+		nextIndex:    1,
+		smsp:         17,
+		smspVP:       167,
+	}
+}
+
+// Script adds behaviours, earlier behaviours for the same command win
+func (m *Modem) Script(behaviours ...Behaviour) {
+	m.mu.Lock()
+	m.behaviours = append(m.behaviours, behaviours...)
+	m.mu.Unlock()
+}
+
+// Reset removes all scripted behaviours
+func (m *Modem) Reset() {
+	m.mu.Lock()
+	m.behaviours = nil
+	m.mu.Unlock()
+}
+
+// Sent returns all messages sent so far
+func (m *Modem) Sent() []Sent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Sent(nil), m.sent...)
+}
+
+// Stored returns number of messages waiting in storage
+func (m *Modem) Stored() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.messages)
+}
+
+// Serve answers commands read from port until reading fails or the modem
+// is hung up, previous connection is closed
+func (m *Modem) Serve(port io.ReadWriteCloser) error {
+	m.mu.Lock()
+	if m.port != nil {
+		m.port.Close()
+	}
+	m.port = port
+	m.echo = true
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		if m.port == port {
+			m.port = nil
+		}
+		m.mu.Unlock()
+		port.Close()
+	}()
+
+	reader := bufio.NewReader(port)
+	var line []byte
+	for {
+		c, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		m.mu.Lock()
+		echo := m.echo
+		m.mu.Unlock()
+		if echo {
+			m.write(string(c))
+		}
+
+		if c != '\r' && c != '\n' {
+			line = append(line, c)
+			continue
+		}
+
+		command := strings.TrimSpace(string(line))
+		line = line[:0]
+		if command == "" {
+			continue
+		}
+
+		if err := m.command(command, reader); err != nil {
+			return err
+		}
+	}
+}
+
+// Hangup drops current connection as if modem was unplugged and plugged
+// back, the driver notices the port is closed
+func (m *Modem) Hangup() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.port != nil {
+		m.port.Close()
+		m.port = nil
+	}
+}
+
+// Unplug hangs up and refuses new connections until Plug
+func (m *Modem) Unplug() {
+	m.mu.Lock()
+	m.unplugged = true
+	m.mu.Unlock()
+	m.Hangup()
+}
+
+func (m *Modem) Plug() {
+	m.mu.Lock()
+	m.unplugged = false
+	m.mu.Unlock()
+}
+
+// Receive stores incoming message as if it arrived from the network and
+// announces it according to AT+CNMI, long text arrives in concatenated parts
+func (m *Modem) Receive(originator, text string) error {
+	parts := modem.SplitMessage(text, false)
+
+	m.mu.Lock()
+	ref := m.concat
+	if len(parts) > 1 {
+		m.concat++
+	}
+	m.mu.Unlock()
+
+	for i, part := range parts {
+		deliver := &modem.Deliver{Originator: originator, Text: part, Timestamp: time.Now().Truncate(time.Second)}
+		if len(parts) > 1 {
+			deliver.UDH = modem.ConcatHeader(ref, len(parts), i+1, false)
+		}
+		if err := m.ReceivePDU(deliver); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReceivePDU stores single SMS-DELIVER, error is returned when storage is full
+func (m *Modem) ReceivePDU(deliver *modem.Deliver) error {
+	m.mu.Lock()
+
+	if m.cnmiMT == 2 {
+		urc := m.cmt(deliver)
+		m.mu.Unlock()
+		m.write(urc)
+		return nil
+	}
+
+	if len(m.messages) >= m.Capacity {
+		m.mu.Unlock()
+		return errors.New("storage full")
+	}
+
+	s := &stored{index: m.allocate(), deliver: deliver}
+	m.messages = append(m.messages, s)
+	urc := ""
+	if m.cnmiMT == 1 {
+		urc = fmt.Sprintf("\r\n+CMTI: %s,%d\r\n", m.quote(m.storage), s.index)
+	}
+	m.mu.Unlock()
+
+	m.write(urc)
+	return nil
+}
+
+// Report sends status report for message with given reference according to
+// AT+CNMI, status is TP-Status, 0 means delivered
+func (m *Modem) Report(reference int, recipient string, status int) {
+	now := time.Now().Truncate(time.Second)
+	report := &modem.StatusReport{
+		Reference:  reference,
+		Recipient:  recipient,
+		Status:     status,
+		Timestamp:  now,
+		Discharged: now,
+	}
+
+	m.mu.Lock()
+	var urc string
+	switch m.cnmiDS {
+	case 1:
+		urc = m.cds(report)
+	case 2:
+		if len(m.messages) < m.Capacity {
+			s := &stored{index: m.allocate(), report: report}
+			m.messages = append(m.messages, s)
+			urc = fmt.Sprintf("\r\n+CDSI: %s,%d\r\n", m.quote(m.storage), s.index)
+		}
+	}
+	m.mu.Unlock()
+
+	m.write(urc)
+}
+
+// Ring announces incoming call with caller identification, call rings
+// until ATH
+func (m *Modem) Ring(number string) {
+	m.mu.Lock()
+	m.ringing = true
+	clip := fmt.Sprintf("\r\nRING\r\n\r\n+CLIP: %s,%d\r\n", m.quote(number), typeOfAddress(number))
+	m.mu.Unlock()
+	m.write(clip)
+}
+
+// Ringing reports whether call announced by Ring was not rejected yet
+func (m *Modem) Ringing() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ringing
+}
+
+// SetRegistration changes network registration and announces it with +CREG
+func (m *Modem) SetRegistration(stat int) {
+	m.mu.Lock()
+	m.Registration = stat
+	m.mu.Unlock()
+	m.write(fmt.Sprintf("\r\n+CREG: %d\r\n", stat))
+}
+
+// allocate returns free storage index, must be called with mu held
+func (m *Modem) allocate() int {
+	for {
+		index := m.nextIndex
+		m.nextIndex++
+		if m.find(index) == nil {
+			return index
+		}
+	}
+}
+
+func (m *Modem) find(index int) *stored {
+	for _, s := range m.messages {
+		if s.index == index {
+			return s
+		}
+	}
+	return nil
+}
+
+func (m *Modem) write(output string) {
+	if output == "" {
+		return
+	}
+
+	m.mu.Lock()
+	port := m.port
+	m.mu.Unlock()
+	if port == nil {
+		return
+	}
+
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	if _, err := port.Write([]byte(output)); err != nil {
+		log.Println("--- Simulator write failed:", err)
+	}
+}
+
+// behaviour returns scripted behaviour for command and uses it up
+func (m *Modem) behaviour(command string) *Behaviour {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, b := range m.behaviours {
+		if !strings.HasPrefix(strings.ToUpper(command), strings.ToUpper(b.Command)) {
+			continue
+		}
+		if b.Times > 0 {
+			m.behaviours[i].Times--
+			if m.behaviours[i].Times == 0 {
+				m.behaviours = append(m.behaviours[:i], m.behaviours[i+1:]...)
+			}
+		}
+		return &b
+	}
+	return nil
+}
+
+// command answers single command line, message body of AT+CMGS is read
+// from reader
+func (m *Modem) command(command string, reader *bufio.Reader) error {
+	b := m.behaviour(command)
+
+	upper := strings.ToUpper(command)
+	if strings.HasPrefix(upper, "AT+CMGS=") {
+		m.write("\r\n> ")
+		body, err := reader.ReadString(0x1a)
+		if err != nil {
+			return err
+		}
+		body = strings.TrimSpace(strings.TrimSuffix(body, "\x1a"))
+		if m.answer(b) {
+			m.write(m.send(command[len("AT+CMGS="):], body))
+		}
+		return nil
+	}
+
+	if m.answer(b) {
+		m.write(m.execute(command))
+	}
+	return nil
+}
+
+// answer applies behaviour, false means normal answer must not be given
+func (m *Modem) answer(b *Behaviour) bool {
+	if b == nil {
+		return true
+	}
+
+	time.Sleep(b.Delay)
+	if b.Silent {
+		return false
+	}
+	if b.Response != "" {
+		m.write("\r\n" + b.Response + "\r\n")
+		return false
+	}
+	return true
+}
+
+func ok(lines ...string) string {
+	if len(lines) == 0 {
+		return "\r\nOK\r\n"
+	}
+	return "\r\n" + strings.Join(lines, "\r\n") + "\r\n\r\nOK\r\n"
+}
+
+const errorResponse = "\r\nERROR\r\n"
+
+func cmsError(code int) string {
+	return fmt.Sprintf("\r\n+CMS ERROR: %d\r\n", code)
+}
+
+// execute returns answer to command, name is the part up to = or ?
+func (m *Modem) execute(command string) string {
+	upper := strings.ToUpper(command)
+	if !strings.HasPrefix(upper, "AT") {
+		return errorResponse
+	}
+
+	name, args := upper[2:], ""
+	if i := strings.IndexAny(name, "=?"); i >= 0 {
+		name, args = name[:i], command[2+i:]
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch name {
+	case "", "Z", "+CMEE", "+WIND", "^SCMS", "+CLIP":
+		return ok()
+	case "H":
+		m.ringing = false
+		return ok()
+	case "E0", "E1":
+		m.echo = name == "E1"
+		return ok()
+	case "I":
+		return ok(m.Manufacturer + " " + m.Model)
+	case "+CGMI":
+		return ok(m.Manufacturer)
+	case "+CGMM":
+		return ok(m.Model)
+	case "+CGSN":
+		return ok(m.IMEI)
+	case "+CIMI":
+		return ok(m.IMSI)
+	case "+CSQ":
+		return ok(fmt.Sprintf("+CSQ: %d,0", m.Signal))
+	case "+CREG", "+CGREG", "+CEREG":
+		if args == "?" {
+			return ok(fmt.Sprintf("%s: 1,%d", name, m.Registration))
+		}
+		return ok()
+	case "+COPS":
+		if m.Operator == "" || !(m.Registration == modem.RegisteredHome || m.Registration == modem.RegisteredRoaming) {
+			return ok("+COPS: 0")
+		}
+		return ok(fmt.Sprintf("+COPS: 0,0,%s", m.quote(m.Operator)))
+	case "+CPIN":
+		if m.SIM == "" {
+			return "\r\n+CME ERROR: 10\r\n"
+		}
+		if args == "?" {
+			return ok("+CPIN: " + m.SIM)
+		}
+		if m.SIM != "SIM PIN" {
+			return "\r\n+CME ERROR: 3\r\n" // operation not allowed
+		}
+		if strings.Trim(strings.TrimPrefix(args, "="), `"`) != m.PIN {
+			m.pinErrors++
+			if m.pinErrors >= 3 {
+				m.SIM = "SIM PUK"
+			}
+			return "\r\n+CME ERROR: 16\r\n"
+		}
+		m.SIM, m.pinErrors = "READY", 0
+		return ok()
+	case "+CMGF":
+		if args == "?" {
+			return ok(fmt.Sprintf("+CMGF: %d", boolInt(m.pduMode)))
+		}
+		m.pduMode = strings.TrimPrefix(args, "=") == "0"
+		return ok()
+	case "+CSCS":
+		m.ucs2 = strings.Contains(strings.ToUpper(args), "UCS2")
+		return ok()
+	case "+CSMP":
+		values := strings.Split(strings.TrimPrefix(args, "="), ",")
+		if fo, err := strconv.Atoi(strings.TrimSpace(values[0])); err == nil {
+			m.smsp = fo
+		}
+		if len(values) > 3 {
+			m.smspVP, _ = strconv.Atoi(strings.TrimSpace(values[1]))
+			dcs, _ := strconv.Atoi(strings.TrimSpace(values[3]))
+			m.smspClass = modem.ClassNone
+			if dcs&0x10 != 0 {
+				m.smspClass = modem.Class0 + dcs&0x03
+			}
+		}
+		return ok()
+	case "+CNMI":
+		values := strings.Split(strings.TrimPrefix(args, "="), ",")
+		if len(values) > 1 {
+			m.cnmiMT, _ = strconv.Atoi(strings.TrimSpace(values[1]))
+		}
+		if len(values) > 3 {
+			m.cnmiDS, _ = strconv.Atoi(strings.TrimSpace(values[3]))
+		}
+		return ok()
+	case "+CPMS":
+		if args != "?" {
+			storage := strings.Trim(strings.Split(strings.TrimPrefix(args, "="), ",")[0], `"`)
+			if m.ucs2 {
+				storage = decodeField(storage)
+			}
+			m.storage = storage
+		}
+		used, total := len(m.messages), m.Capacity
+		if args == "?" {
+			s := m.quote(m.storage)
+			return ok(fmt.Sprintf("+CPMS: %s,%d,%d,%s,%d,%d,%s,%d,%d", s, used, total, s, used, total, s, used, total))
+		}
+		return ok(fmt.Sprintf("+CPMS: %d,%d,%d,%d,%d,%d", used, total, used, total, used, total))
+	case "+CUSD":
+		return m.ussd(strings.TrimPrefix(args, "="))
+	case "+CMGL":
+		return m.list(strings.TrimPrefix(args, "="))
+	case "+CMGR":
+		index, err := strconv.Atoi(strings.TrimPrefix(args, "="))
+		s := m.find(index)
+		if err != nil || s == nil {
+			return cmsError(321) // invalid memory index
+		}
+		return ok(m.entry("+CMGR: ", s, false)...)
+	case "+CMGD":
+		values := strings.Split(strings.TrimPrefix(args, "="), ",")
+		index, err := strconv.Atoi(values[0])
+		if err != nil {
+			return errorResponse
+		}
+		if len(values) > 1 && strings.TrimSpace(values[1]) != "0" {
+			// delete flag, 1-3 remove read messages together with sent and
+			// unsent ones which the simulator does not store, 4 removes all
+			var kept []*stored
+			for _, s := range m.messages {
+				if !s.read && strings.TrimSpace(values[1]) != "4" {
+					kept = append(kept, s)
+				}
+			}
+			m.messages = kept
+			return ok()
+		}
+		for i, s := range m.messages {
+			if s.index == index {
+				m.messages = append(m.messages[:i], m.messages[i+1:]...)
+				break
+			}
+		}
+		return ok()
+	}
+
+	return errorResponse
+}
+
+// ussd answers AT+CUSD=1,"code",15 with OK followed by +CUSD carrying the
+// network answer, must be called with mu held
+func (m *Modem) ussd(args string) string {
+	values := strings.Split(args, ",")
+	if len(values) < 2 || strings.TrimSpace(values[0]) != "1" {
+		return ok() // cancel or presentation setting
+	}
+
+	code := strings.Trim(values[1], `"`)
+	if m.ucs2 {
+		code = decodeField(code)
+	}
+
+	text, more := "Balance: 10.00", false
+	if m.USSD != nil {
+		text, more = m.USSD(code)
+	}
+
+	dcs := 15
+	if m.ucs2 {
+		dcs = 72
+	}
+	return ok() + fmt.Sprintf("\r\n+CUSD: %d,%s,%d\r\n", boolInt(more), m.quote(text), dcs)
+}
+
+// list answers AT+CMGL, stat is "ALL", "REC UNREAD", "REC READ" in text
+// mode or 4, 0, 1 in PDU mode
+func (m *Modem) list(stat string) string {
+	stat = strings.Trim(stat, `"`)
+	if m.ucs2 {
+		stat = decodeField(stat)
+	}
+
+	var lines []string
+	for _, s := range m.messages {
+		if s.deliver == nil {
+			continue
+		}
+		switch stat {
+		case "REC UNREAD", "0":
+			if s.read {
+				continue
+			}
+		case "REC READ", "1":
+			if !s.read {
+				continue
+			}
+		}
+		lines = append(lines, m.entry("+CMGL: ", s, true)...)
+	}
+
+	return ok(lines...)
+}
+
+// entry returns header and data lines of stored message as listed by
+// AT+CMGL or read by AT+CMGR, message is marked read
+func (m *Modem) entry(prefix string, s *stored, listed bool) []string {
+	status := "REC UNREAD"
+	if s.read {
+		status = "REC READ"
+	}
+	s.read = true
+
+	index := ""
+	if listed {
+		index = fmt.Sprintf("%d,", s.index)
+	}
+
+	if s.report != nil {
+		if m.pduMode {
+			pdu, length := s.report.Encode()
+			return []string{fmt.Sprintf("%s%s%d,,%d", prefix, index, boolInt(status == "REC READ"), length), pdu}
+		}
+		return []string{fmt.Sprintf("%s%s\"%s\",%s", prefix, index, status, m.textReport(s.report))}
+	}
+
+	if m.pduMode {
+		pdu, length, _ := s.deliver.Encode()
+		return []string{fmt.Sprintf("%s%s%d,,%d", prefix, index, boolInt(status == "REC READ"), length), pdu}
+	}
+
+	return []string{
+		fmt.Sprintf("%s%s\"%s\",%s,,\"%s\"", prefix, index, status, m.quote(s.deliver.Originator), textTimestamp(s.deliver.Timestamp)),
+		m.text(s.deliver.Text),
+	}
+}
+
+// send handles message given to AT+CMGS, destination is the number in text
+// mode and TPDU length in PDU mode
+func (m *Modem) send(destination, body string) string {
+	m.mu.Lock()
+
+	sent := Sent{}
+	if m.pduMode {
+		submit, err := modem.DecodeSubmit(body)
+		if err != nil {
+			m.mu.Unlock()
+			return cmsError(304) // invalid PDU mode parameter
+		}
+		sent.Destination, sent.Text, sent.UDH, sent.StatusReport = submit.Destination, submit.Text, submit.UDH, submit.StatusReport
+		sent.Class, sent.Validity = submit.Class, submit.ValidityPeriod
+		sent.PDU = body
+	} else {
+		values := strings.Split(destination, ",")
+		sent.Destination = strings.Trim(values[0], `"`)
+		sent.Text = body
+		if m.ucs2 {
+			sent.Destination = decodeField(sent.Destination)
+			sent.Text = decodeField(body)
+		}
+		if len(values) > 1 && strings.TrimSpace(values[1]) == "145" && !strings.HasPrefix(sent.Destination, "+") {
+			sent.Destination = "+" + sent.Destination
+		}
+		sent.StatusReport = m.smsp&0x20 != 0
+		sent.Class, sent.Validity = m.smspClass, modem.DecodeValidity(byte(m.smspVP))
+	}
+
+	if sent.Destination == "" {
+		m.mu.Unlock()
+		return cmsError(304)
+	}
+
+	sent.Reference = m.reference
+	m.reference = (m.reference + 1) % 256
+	m.sent = append(m.sent, sent)
+	delay, status := m.ReportDelay, m.ReportStatus
+	m.mu.Unlock()
+
+	if sent.StatusReport && delay > 0 {
+		time.AfterFunc(delay, func() {
+			m.Report(sent.Reference, sent.Destination, status)
+		})
+	}
+
+	return ok(fmt.Sprintf("+CMGS: %d", sent.Reference))
+}
+
+// cmt returns message routed directly to terminal, must be called with mu held
+func (m *Modem) cmt(deliver *modem.Deliver) string {
+	if m.pduMode {
+		pdu, length, _ := deliver.Encode()
+		return fmt.Sprintf("\r\n+CMT: ,%d\r\n%s\r\n", length, pdu)
+	}
+	return fmt.Sprintf("\r\n+CMT: %s,,\"%s\"\r\n%s\r\n", m.quote(deliver.Originator), textTimestamp(deliver.Timestamp), m.text(deliver.Text))
+}
+
+// cds returns status report routed directly to terminal, must be called
+// with mu held
+func (m *Modem) cds(report *modem.StatusReport) string {
+	if m.pduMode {
+		pdu, length := report.Encode()
+		return fmt.Sprintf("\r\n+CDS: %d\r\n%s\r\n", length, pdu)
+	}
+	return fmt.Sprintf("\r\n+CDS: %s\r\n", m.textReport(report))
+}
+
+// textReport returns status report fields as shown in text mode
+func (m *Modem) textReport(report *modem.StatusReport) string {
+	return fmt.Sprintf("6,%d,%s,%d,\"%s\",\"%s\",%d", report.Reference, m.quote(report.Recipient), typeOfAddress(report.Recipient),
+		textTimestamp(report.Timestamp), textTimestamp(report.Discharged), report.Status)
+}
+
+// quote returns string parameter in charset selected by AT+CSCS
+func (m *Modem) quote(value string) string {
+	return `"` + m.text(value) + `"`
+}
+
+func (m *Modem) text(value string) string {
+	if m.ucs2 {
+		return strings.ToUpper(modem.ASCII2UCS2HEX(value))
+	}
+	return value
+}
+
+// decodeField decodes UCS2 hex parameter, anything else is returned as is
+func decodeField(value string) string {
+	if _, err := hex.DecodeString(value); err != nil || len(value)%4 != 0 {
+		return value
+	}
+	return modem.UCS2HEX2ASCII(value)
+}
+
+func typeOfAddress(number string) int {
+	address, _ := modem.ParseAddress(number)
+	return address.Type()
+}
+
+// textTimestamp formats time as "yy/MM/dd,hh:mm:ss±zz", zone in quarters of
+// an hour
+func textTimestamp(t time.Time) string {
+	_, offset := t.Zone()
+	sign := '+'
+	if offset < 0 {
+		sign = '-'
+		offset = -offset
+	}
+	return fmt.Sprintf("%02d/%02d/%02d,%02d:%02d:%02d%c%02d", t.Year()%100, t.Month(), t.Day(),
+		t.Hour(), t.Minute(), t.Second(), sign, offset/(15*60))
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
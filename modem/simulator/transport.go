@@ -0,0 +1,76 @@
+package simulator
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/haxpax/gosms/modem"
+)
+
+func init() {
+	modem.RegisterTransport("sim", dialSim)
+}
+
+var (
+	modemsMu sync.Mutex
+	modems   = make(map[string]*Modem)
+)
+
+// Register makes simulator reachable as COMPORT sim://name
+func Register(name string, m *Modem) {
+	modemsMu.Lock()
+	defer modemsMu.Unlock()
+
+	modems[name] = m
+}
+
+// Lookup returns simulator registered under name, unknown names get a new
+// simulator which confirms delivery of every message, so sim://anything
+// works in conf.ini for demos
+func Lookup(name string) *Modem {
+	modemsMu.Lock()
+	defer modemsMu.Unlock()
+
+	m, ok := modems[name]
+	if !ok {
+		m = New()
+		m.ReportDelay = 2 * time.Second
+		modems[name] = m
+	}
+	return m
+}
+
+func dialSim(address string, baudRate int) (modem.Transport, error) {
+	return Lookup(address).Dial()
+}
+
+// Dial connects to simulator through in-memory pipe
+func (m *Modem) Dial() (modem.Transport, error) {
+	m.mu.Lock()
+	unplugged := m.unplugged
+	m.mu.Unlock()
+	if unplugged {
+		return nil, errors.New("simulated modem is unplugged")
+	}
+
+	client, server := net.Pipe()
+	go m.Serve(server)
+
+	return &pipePort{Conn: client}, nil
+}
+
+// pipePort is driver end of the pipe, EOF means simulator hung up
+type pipePort struct {
+	net.Conn
+}
+
+func (p *pipePort) Read(b []byte) (int, error) {
+	n, err := p.Conn.Read(b)
+	if err == io.EOF {
+		err = modem.ErrPortClosed
+	}
+	return n, err
+}
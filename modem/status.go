@@ -0,0 +1,225 @@
+package modem
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// network registration states reported by AT+CREG?, AT+CGREG? and AT+CEREG?
+const (
+	NotRegistered = iota
+	RegisteredHome
+	Searching
+	RegistrationDenied
+	RegistrationUnknown
+	RegisteredRoaming
+)
+
+// Status is a snapshot of modem health, fields which could not be read keep
+// their zero value, Signal and BitErrorRate are 99 when unknown
+type Status struct {
+	Signal           int // RSSI 0-31 as reported by AT+CSQ
+	BitErrorRate     int
+	Registration     int
+	GPRSRegistration int
+	Operator         string
+	SIM              string // AT+CPIN? answer, e.g. READY or SIM PIN
+	IMEI             string
+	IMSI             string
+}
+
+// Registered reports whether modem is registered to home or roaming network
+func (s *Status) Registered() bool {
+	return s.Registration == RegisteredHome || s.Registration == RegisteredRoaming
+}
+
+// SignalDBm converts RSSI to dBm, zero means unknown
+func (s *Status) SignalDBm() int {
+	if s.Signal < 0 || s.Signal > 31 {
+		return 0
+	}
+	return -113 + 2*s.Signal
+}
+
+// ReadStatus samples all health indicators, failures are logged and leave
+// the field empty so one unsupported command does not hide the others
+func (m *Driver) ReadStatus() Status {
+	status := Status{Signal: 99, BitErrorRate: 99, Registration: RegistrationUnknown, GPRSRegistration: RegistrationUnknown}
+	var err error
+
+	if status.Signal, status.BitErrorRate, err = m.SignalQuality(); err != nil {
+		m.log("--- Status:", err.Error())
+	}
+	if status.Registration, err = m.Registration(); err != nil {
+		m.log("--- Status:", err.Error())
+	}
+	if status.GPRSRegistration, err = m.GPRSRegistration(); err != nil {
+		m.log("--- Status:", err.Error())
+	}
+	if status.Operator, err = m.Operator(); err != nil {
+		m.log("--- Status:", err.Error())
+	}
+	if status.SIM, err = m.SIMStatus(); err != nil {
+		m.log("--- Status:", err.Error())
+	}
+	if status.IMEI, err = m.IMEI(); err != nil {
+		m.log("--- Status:", err.Error())
+	}
+	if status.IMSI, err = m.IMSI(); err != nil {
+		m.log("--- Status:", err.Error())
+	}
+
+	return status
+}
+
+// SignalQuality returns RSSI (0-31, 99 unknown) and bit error rate (0-7, 99 unknown)
+func (m *Driver) SignalQuality() (rssi, ber int, err error) {
+	fields, err := m.query("AT+CSQ", "+CSQ")
+	if err != nil {
+		return 99, 99, err
+	}
+
+	values := strings.Split(fields, ",")
+	if len(values) != 2 {
+		return 99, 99, fmt.Errorf("invalid +CSQ response: %s", fields)
+	}
+
+	rssi, _ = strconv.Atoi(strings.TrimSpace(values[0]))
+	ber, _ = strconv.Atoi(strings.TrimSpace(values[1]))
+	return rssi, ber, nil
+}
+
+// Registration returns circuit switched network registration state
+func (m *Driver) Registration() (int, error) {
+	return m.registration("AT+CREG?", "+CREG")
+}
+
+// GPRSRegistration returns packet switched network registration state, for
+// LTE modules it is EPS registration
+func (m *Driver) GPRSRegistration() (int, error) {
+	command := m.ActiveProfile().PacketRegistration
+	return m.registration(command, strings.TrimSuffix(command[2:], "?"))
+}
+
+func (m *Driver) registration(command, prefix string) (int, error) {
+	fields, err := m.query(command, prefix)
+	if err != nil {
+		return RegistrationUnknown, err
+	}
+
+	// <n>,<stat>[,<lac>,<ci>]
+	values := strings.Split(fields, ",")
+	if len(values) < 2 {
+		return RegistrationUnknown, fmt.Errorf("invalid %s response: %s", prefix, fields)
+	}
+
+	stat, err := strconv.Atoi(strings.TrimSpace(values[1]))
+	if err != nil {
+		return RegistrationUnknown, fmt.Errorf("invalid %s response: %s", prefix, fields)
+	}
+	return stat, nil
+}
+
+// Operator returns name of network modem is registered to
+func (m *Driver) Operator() (string, error) {
+	fields, err := m.query("AT+COPS?", "+COPS")
+	if err != nil {
+		return "", err
+	}
+
+	// <mode>[,<format>,<oper>[,<AcT>]]
+	values := strings.SplitN(fields, ",", 3)
+	if len(values) < 3 {
+		return "", nil // not registered
+	}
+
+	operator := strings.Trim(strings.Split(values[2], "\",")[0], `"`)
+	return decodeUCS2Field(operator), nil
+}
+
+// SIMStatus returns SIM state as reported by AT+CPIN?, READY when SIM is usable
+func (m *Driver) SIMStatus() (string, error) {
+	return m.query("AT+CPIN?", "+CPIN")
+}
+
+// unlockSIM enters PIN when SIM asks for it, *SIMError is returned when SIM
+// stays locked. PIN is entered at most once unless it is accepted, failed or
+// unanswered entry may have cost an attempt as well, modems which do not
+// support AT+CPIN? are let through
+func (m *Driver) unlockSIM() error {
+	state, err := m.SIMStatus()
+	if err != nil {
+		var cme *CMEError
+		if errors.As(err, &cme) && (cme.Code == 10 || cme.Code == 13 || cme.Code == 15) {
+			return &SIMError{State: cme.Message}
+		}
+		m.log("--- SIM:", err.Error())
+		return nil
+	}
+
+	switch {
+	case state == "READY":
+		return nil
+	case state != "SIM PIN":
+		return &SIMError{State: state} // PUK, PIN2 or network lock need a human
+	case m.PIN == "":
+		return &SIMError{State: "SIM PIN required but PIN is not configured"}
+	case m.PIN == m.RejectedPIN:
+		return &SIMError{State: "SIM PIN required, configured PIN failed before"}
+	}
+
+	if _, err := m.Exec(fmt.Sprintf("AT+CPIN=\"%s\"\r\n", m.PIN)); err != nil {
+		m.RejectedPIN = m.PIN // until PIN is changed, whatever went wrong
+		var cme *CMEError
+		if errors.As(err, &cme) && cme.Code == 16 { // incorrect password
+			return &SIMError{State: "SIM PIN refused"}
+		}
+		return &SIMError{State: "SIM PIN entry failed: " + err.Error()}
+	}
+
+	// SIM is busy for a while after unlocking
+	for i := 0; i < 10; i++ {
+		if state, err = m.SIMStatus(); err == nil && state == "READY" {
+			log.Println("--- SIM unlocked:", m.DeviceId)
+			return nil
+		}
+		time.Sleep(time.Second)
+	}
+	return &SIMError{State: "SIM not ready after PIN entry"}
+}
+
+func (m *Driver) IMEI() (string, error) {
+	return m.query("AT+CGSN", "")
+}
+
+func (m *Driver) IMSI() (string, error) {
+	return m.query("AT+CIMI", "")
+}
+
+// query sends command and returns parameters of its prefix: response line,
+// for commands without prefix the first line of the response is returned
+func (m *Driver) query(command, prefix string) (string, error) {
+	output, err := m.Exec(command + "\r\n")
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %w", command, err)
+	}
+
+	for _, line := range strings.Split(output, "\r\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line == "OK" {
+			continue
+		}
+		if prefix == "" {
+			return line, nil
+		}
+		if strings.HasPrefix(line, prefix+":") {
+			return strings.TrimSpace(line[len(prefix)+1:]), nil
+		}
+	}
+
+	return "", fmt.Errorf("%s: no %s in response", command, prefix)
+}
@@ -0,0 +1,97 @@
+package modem
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// StorageStatus is usage of message storage as reported by AT+CPMS
+type StorageStatus struct {
+	Storage string // e.g. SM for SIM, ME for modem memory, MT for both
+	Used    int
+	Total   int
+}
+
+// Usage returns used part of storage in percent
+func (s *StorageStatus) Usage() int {
+	if s.Total <= 0 {
+		return 0
+	}
+	return s.Used * 100 / s.Total
+}
+
+// Full reports whether storage can take no more messages, network keeps
+// incoming messages until there is space again
+func (s *StorageStatus) Full() bool {
+	return s.Total > 0 && s.Used >= s.Total
+}
+
+// selectStorage makes storage used for reading, writing and receiving
+// messages and keeps its usage from +CPMS response
+func (m *Driver) selectStorage(storage string) error {
+	fields, err := m.query(fmt.Sprintf(`AT+CPMS="%s","%s","%s"`, storage, storage, storage), "+CPMS")
+	if err != nil {
+		return err
+	}
+	m.setStorage(storage)
+
+	// <used1>,<total1>,<used2>,<total2>,<used3>,<total3>
+	values := strings.Split(fields, ",")
+	if len(values) >= 2 {
+		used, _ := strconv.Atoi(strings.TrimSpace(values[0]))
+		total, _ := strconv.Atoi(strings.TrimSpace(values[1]))
+		m.log("--- Storage:", storage, used, "of", total)
+	}
+	return nil
+}
+
+// ReadStorage returns usage of storage messages are read from
+func (m *Driver) ReadStorage() (*StorageStatus, error) {
+	fields, err := m.query("AT+CPMS?", "+CPMS")
+	if err != nil {
+		return nil, err
+	}
+
+	// <mem1>,<used1>,<total1>,<mem2>,...
+	values := strings.Split(fields, ",")
+	if len(values) < 3 {
+		return nil, fmt.Errorf("invalid +CPMS response: %s", fields)
+	}
+
+	status := &StorageStatus{Storage: decodeUCS2Field(strings.Trim(strings.TrimSpace(values[0]), `"`))}
+	if status.Used, err = strconv.Atoi(strings.TrimSpace(values[1])); err != nil {
+		return nil, fmt.Errorf("invalid +CPMS response: %s", fields)
+	}
+	if status.Total, err = strconv.Atoi(strings.TrimSpace(values[2])); err != nil {
+		return nil, fmt.Errorf("invalid +CPMS response: %s", fields)
+	}
+	return status, nil
+}
+
+// DeleteReadSMS removes all read messages from storage at once, messages
+// listed by ReadSMS or read by ReadSMSAt are read, so they must be stored
+// elsewhere first. Modems which do not support it answer with error
+func (m *Driver) DeleteReadSMS() error {
+	_, err := m.Exec("AT+CMGD=1,1\r\n")
+	return err
+}
+
+// DeleteSMSAt removes single message, switching to given storage first if
+// needed
+func (m *Driver) DeleteSMSAt(storage string, index int) {
+	m.deleteAt(storage, index)
+}
+
+// activeStorage returns storage selected on connect
+func (m *Driver) activeStorage() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.storage
+}
+
+func (m *Driver) setStorage(storage string) {
+	m.mu.Lock()
+	m.storage = storage
+	m.mu.Unlock()
+}
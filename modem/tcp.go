@@ -0,0 +1,53 @@
+package modem
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// time allowed to establish connection to serial device server
+const dialTimeout = 10 * time.Second
+
+func init() {
+	RegisterTransport("tcp", dialTCP)
+}
+
+// tcpPort is raw TCP socket of serial device server, serial line settings
+// are configured on the server itself
+type tcpPort struct {
+	net.Conn
+}
+
+func dialTCP(address string, baudRate int) (Transport, error) {
+	conn, err := dialConn(address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tcpPort{Conn: conn}, nil
+}
+
+func (p *tcpPort) Read(b []byte) (int, error) {
+	n, err := p.Conn.Read(b)
+	if err == io.EOF {
+		err = ErrPortClosed // there is no read timeout, EOF means server hung up
+	}
+	return n, err
+}
+
+// dialConn connects with keep alive so dead server is noticed even when
+// modem is idle
+func dialConn(address string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", address, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetKeepAlive(true)
+		tcp.SetKeepAlivePeriod(30 * time.Second)
+	}
+
+	return conn, nil
+}
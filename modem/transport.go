@@ -0,0 +1,50 @@
+package modem
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Transport is connection to modem. Read returns io.EOF when nothing arrived
+// within read timeout, any other error means the connection is lost.
+type Transport interface {
+	io.ReadWriteCloser
+}
+
+// Dialer opens transport to address, which is COMPORT with scheme removed
+type Dialer func(address string, baudRate int) (Transport, error)
+
+var (
+	transportsMu sync.Mutex
+	transports   = make(map[string]Dialer)
+)
+
+// RegisterTransport makes transport available for COMPORT URLs with given
+// scheme, e.g. tcp for tcp://10.0.0.5:4001
+func RegisterTransport(scheme string, dial Dialer) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+
+	transports[strings.ToLower(scheme)] = dial
+}
+
+// Dial opens transport for COMPORT, plain device names like COM10 or
+// /dev/ttyUSB0 are local serial ports
+func Dial(comPort string, baudRate int) (Transport, error) {
+	scheme, address := "serial", comPort
+	if i := strings.Index(comPort, "://"); i > 0 {
+		scheme, address = strings.ToLower(comPort[:i]), comPort[i+3:]
+	}
+
+	transportsMu.Lock()
+	dial, ok := transports[scheme]
+	transportsMu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown transport %s in %s", scheme, comPort)
+	}
+
+	return dial(address, baudRate)
+}
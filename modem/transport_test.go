@@ -0,0 +1,276 @@
+package modem_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/haxpax/gosms/modem"
+	"github.com/haxpax/gosms/modem/simulator"
+)
+
+// serve accepts connections on local port and passes them to handler, it
+// stands in for serial device server
+func serve(t *testing.T, handler func(conn net.Conn)) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handler(conn)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	optionComPort = 44
+)
+
+// telnetConn is server end of RFC 2217 connection, telnet commands are
+// taken out of received data and COM port settings are recorded
+type telnetConn struct {
+	net.Conn
+	reader *bufio.Reader
+	refuse bool // answer COM port option with DONT
+
+	mu       sync.Mutex
+	settings [][]byte
+}
+
+func newTelnetConn(conn net.Conn, refuse bool) *telnetConn {
+	return &telnetConn{Conn: conn, reader: bufio.NewReader(conn), refuse: refuse}
+}
+
+func (c *telnetConn) Read(b []byte) (int, error) {
+	for {
+		data, err := c.reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if data != telnetIAC {
+			b[0] = data
+			return 1, nil
+		}
+
+		command, err := c.reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch command {
+		case telnetIAC:
+			b[0] = telnetIAC
+			return 1, nil
+		case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+			option, err := c.reader.ReadByte()
+			if err != nil {
+				return 0, err
+			}
+			if command == telnetWILL && option == optionComPort {
+				answer := byte(telnetDO)
+				if c.refuse {
+					answer = telnetDONT
+				}
+				c.Conn.Write([]byte{telnetIAC, answer, optionComPort})
+			}
+		case telnetSB:
+			if err := c.subnegotiation(); err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+// subnegotiation reads COM port command up to IAC SE
+func (c *telnetConn) subnegotiation() error {
+	var sub []byte
+	for {
+		data, err := c.reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		if data == telnetIAC {
+			if data, err = c.reader.ReadByte(); err != nil {
+				return err
+			}
+			if data == telnetSE {
+				break
+			}
+		}
+		sub = append(sub, data)
+	}
+
+	c.mu.Lock()
+	c.settings = append(c.settings, sub)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *telnetConn) Write(b []byte) (int, error) {
+	if _, err := c.Conn.Write(bytes.Replace(b, []byte{telnetIAC}, []byte{telnetIAC, telnetIAC}, -1)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// setting returns value of COM port command, nil when it did not arrive
+func (c *telnetConn) setting(command byte) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, sub := range c.settings {
+		if len(sub) > 1 && sub[0] == optionComPort && sub[1] == command {
+			return sub[2:]
+		}
+	}
+	return nil
+}
+
+// sendThrough connects driver to the server and sends message through it
+func sendThrough(t *testing.T, sim *simulator.Modem, comPort string) *modem.Driver {
+	t.Helper()
+
+	driver := modem.New(comPort, 115200, "remote")
+	driver.CommandTimeout = time.Second
+	if err := driver.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	t.Cleanup(func() { driver.Close() })
+
+	if sent, _, err := driver.SendSMS("+447700900123", "over network"); !sent {
+		t.Fatalf("SendSMS failed: %v", err)
+	}
+	if messages := sim.Sent(); len(messages) != 1 || messages[0].Text != "over network" {
+		t.Errorf("simulator sent %+v", messages)
+	}
+	return driver
+}
+
+// waitClosed fails unless driver notices that server hung up
+func waitClosed(t *testing.T, driver *modem.Driver) {
+	t.Helper()
+
+	select {
+	case <-driver.Closed():
+	case <-time.After(2 * time.Second):
+		t.Fatal("driver did not notice lost connection")
+	}
+	if _, err := driver.Exec("AT\r\n"); err != modem.ErrPortClosed {
+		t.Errorf("Exec after hangup = %v", err)
+	}
+}
+
+func TestTCPTransport(t *testing.T) {
+	sim := simulator.New()
+	address := serve(t, func(conn net.Conn) { sim.Serve(conn) })
+
+	driver := sendThrough(t, sim, "tcp://"+address)
+
+	sim.Hangup()
+	waitClosed(t, driver)
+}
+
+func TestRFC2217Transport(t *testing.T) {
+	sim := simulator.New()
+	conns := make(chan *telnetConn, 1)
+	address := serve(t, func(conn net.Conn) {
+		telnet := newTelnetConn(conn, false)
+		conns <- telnet
+		sim.Serve(telnet)
+	})
+
+	driver := sendThrough(t, sim, "RFC2217://"+address)
+
+	telnet := <-conns
+	tests := []struct {
+		command byte
+		value   []byte
+	}{
+		{1, []byte{0x00, 0x01, 0xC2, 0x00}}, // 115200 baud
+		{2, []byte{8}},                      // data bits
+		{3, []byte{1}},                      // no parity
+		{4, []byte{1}},                      // one stop bit
+		{5, []byte{1}},                      // no flow control
+	}
+	for _, test := range tests {
+		if value := telnet.setting(test.command); !bytes.Equal(value, test.value) {
+			t.Errorf("COM port command %d set % X, want % X", test.command, value, test.value)
+		}
+	}
+
+	sim.Hangup()
+	waitClosed(t, driver)
+}
+
+func TestRFC2217Escaping(t *testing.T) {
+	address := serve(t, func(conn net.Conn) {
+		telnet := newTelnetConn(conn, false)
+		io.Copy(telnet, telnet) // echo
+	})
+
+	port, err := modem.Dial("rfc2217://"+address, 9600)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer port.Close()
+
+	data := []byte{'a', telnetIAC, 'b', telnetIAC, telnetIAC}
+	if _, err := port.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	echo := make([]byte, len(data))
+	if _, err := io.ReadFull(port, echo); err != nil || !bytes.Equal(echo, data) {
+		t.Errorf("got % X, %v, want % X", echo, err, data)
+	}
+}
+
+func TestRFC2217Refused(t *testing.T) {
+	address := serve(t, func(conn net.Conn) {
+		telnet := newTelnetConn(conn, true)
+		io.Copy(io.Discard, telnet)
+	})
+
+	if port, err := modem.Dial("rfc2217://"+address, 9600); err == nil || !strings.Contains(err.Error(), "RFC 2217") {
+		t.Errorf("Dial = %v, %v, want refusal", port, err)
+	}
+}
+
+func TestDialErrors(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := listener.Addr().String()
+	listener.Close()
+
+	for _, comPort := range []string{"foo://10.0.0.5:4001", "tcp://" + closed, "rfc2217://" + closed} {
+		if port, err := modem.Dial(comPort, 115200); err == nil {
+			port.Close()
+			t.Errorf("Dial(%q) did not fail", comPort)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package modem
+
+import (
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Unsolicited result codes (URC) are lines modem sends on its own, reader
+// separates them from command responses and publishes them as events
+
+type EventType int
+
+const (
+	EventNewMessage        EventType = iota // +CMTI: new message stored at Storage/Index
+	EventMessage                            // +CMT: message routed directly, see Message
+	EventStatusReport                       // +CDS: status report routed directly, see Report
+	EventStatusReportIndex                  // +CDSI: status report stored at Storage/Index
+	EventRing                               // RING or +CRING: incoming call
+	EventCallerID                           // +CLIP: caller identification, see Number
+	EventRegistration                       // +CREG:, +CGREG: or +CEREG: network registration changed, see Status
+	EventUSSD                               // +CUSD: USSD answer or network initiated USSD, see USSD
+	EventCallEnded                          // NO CARRIER: caller hung up
+)
+
+type Event struct {
+	Type     EventType
+	DeviceId string
+	Line     string
+	Data     string
+	Storage  string
+	Index    int
+	Number   string
+	Status   int
+	Report   *StatusReport
+	Message  *IncomingMessage
+	USSD     *USSDResponse
+}
+
+// URCs which are also responses to query commands, e.g. AT+CREG? answers
+// with +CREG: line which must not be taken as notification
+var solicited = []string{"+CREG", "+CGREG", "+CEREG", "+CLIP"}
+
+var storageIndex = regexp.MustCompile(`^"?([^",]*)"?,\s*(\d+)`)
+
+// Subscribe returns channel receiving all URC events of this modem, events
+// are dropped when subscriber does not keep up
+func (m *Driver) Subscribe() <-chan Event {
+	events := make(chan Event, 16)
+
+	m.mu.Lock()
+	m.subscribers = append(m.subscribers, events)
+	m.mu.Unlock()
+
+	return events
+}
+
+func (m *Driver) Unsubscribe(events <-chan Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, subscriber := range m.subscribers {
+		if subscriber == events {
+			m.subscribers = append(m.subscribers[:i], m.subscribers[i+1:]...)
+			close(subscriber)
+			return
+		}
+	}
+}
+
+func (m *Driver) publish(event *Event) {
+	event.DeviceId = m.DeviceId
+	m.log("--- URC:", event.Line, event.Data)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, subscriber := range m.subscribers {
+		select {
+		case subscriber <- *event:
+		default:
+			m.log("--- URC dropped, subscriber is busy:", event.Line)
+		}
+	}
+}
+
+// readLoop reads port until it fails, response lines are passed to Expect
+// through responses channel which is closed together with done when the
+// port is gone
+func (m *Driver) readLoop(port io.Reader, responses chan string, done chan struct{}) {
+	defer close(done)
+	defer close(responses)
+
+	buffer := make([]byte, 128)
+	var pending string
+	var urc *Event // URC waiting for its second line
+
+	for {
+		c, err := port.Read(buffer)
+		pending += string(buffer[:c])
+
+		for {
+			i := strings.IndexByte(pending, '\n')
+			if i < 0 {
+				break
+			}
+			line := strings.TrimRight(pending[:i], "\r")
+			pending = pending[i+1:]
+
+			urc = m.handleLine(line, urc, responses)
+		}
+
+		// prompt for message body is not terminated by new line
+		if strings.TrimSpace(pending) == ">" {
+			m.respond(responses, pending)
+			pending = ""
+		}
+
+		if err != nil && err != io.EOF { // EOF is read timeout, see Transport
+			m.log("--- Port closed:", err.Error())
+			return
+		}
+	}
+}
+
+func (m *Driver) handleLine(line string, urc *Event, responses chan string) *Event {
+	if urc != nil {
+		urc.Data = line
+		m.completeURC(urc)
+		m.publish(urc)
+		return nil
+	}
+
+	event, twoLines := m.parseURC(line)
+	if event == nil {
+		m.respond(responses, line+"\r\n")
+		return nil
+	}
+
+	if twoLines {
+		return event
+	}
+
+	m.publish(event)
+	return nil
+}
+
+func (m *Driver) respond(responses chan string, output string) {
+	select {
+	case responses <- output:
+	default:
+		m.log("--- Response dropped, nobody is waiting:", output)
+	}
+}
+
+// parseURC returns nil for lines which are not URCs, twoLines is set when
+// the URC continues on next line
+func (m *Driver) parseURC(line string) (event *Event, twoLines bool) {
+	name, fields := line, ""
+	if i := strings.Index(line, ":"); i > 0 {
+		name, fields = line[:i], strings.TrimSpace(line[i+1:])
+	}
+
+	for _, prefix := range solicited {
+		if name == prefix && strings.HasPrefix(m.currentCommand(), "AT"+prefix) {
+			return nil, false
+		}
+	}
+
+	event = &Event{Line: line}
+
+	switch name {
+	case "+CMTI", "+CDSI":
+		event.Type = EventNewMessage
+		if name == "+CDSI" {
+			event.Type = EventStatusReportIndex
+		}
+		if match := storageIndex.FindStringSubmatch(fields); match != nil {
+			event.Storage = decodeUCS2Field(match[1])
+			event.Index, _ = strconv.Atoi(match[2])
+		}
+	case "+CMT":
+		event.Type = EventMessage
+		return event, true
+	case "+CDS":
+		event.Type = EventStatusReport
+		if _, err := strconv.Atoi(fields); err == nil {
+			return event, true // PDU follows
+		}
+		m.completeURC(event)
+	case "RING", "+CRING":
+		event.Type = EventRing
+	case "NO CARRIER":
+		event.Type = EventCallEnded
+	case "+CLIP":
+		event.Type = EventCallerID
+		values := strings.Split(fields, ",")
+		event.Number = decodeUCS2Field(strings.Trim(values[0], `"`))
+		if len(values) > 1 {
+			event.Number = numberWithType(event.Number, values[1])
+		}
+	case "+CREG", "+CGREG", "+CEREG":
+		event.Type = EventRegistration
+		event.Status, _ = strconv.Atoi(strings.Split(fields, ",")[0])
+	case "+CUSD":
+		event.Type = EventUSSD
+		m.completeURC(event)
+	default:
+		return nil, false
+	}
+
+	return event, false
+}
+
+/*
+1. originator
+2. name
+3. timestamp
+*/
+var cmtHeader = regexp.MustCompile(`^\+CMT: "([0-9a-fA-F+]*)",([^,]*),"([^"]+)"`)
+
+// completeURC decodes content of URCs which carry message data
+func (m *Driver) completeURC(event *Event) {
+	var err error
+
+	switch event.Type {
+	case EventStatusReport:
+		if event.Data != "" {
+			event.Report, err = DecodeStatusReport(event.Data)
+		} else {
+			event.Report, err = parseTextStatusReport(strings.TrimPrefix(event.Line, "+CDS:"), true)
+		}
+	case EventUSSD:
+		event.USSD, err = parseUSSD(event.Line, m.ActiveProfile().USSDPacked)
+		if event.USSD != nil {
+			event.Status = event.USSD.Status
+		}
+	case EventMessage:
+		if match := cmtHeader.FindStringSubmatch(event.Line); match != nil {
+			message := textMessage(-1, "REC UNREAD", match[1], match[2], match[3], event.Data)
+			event.Message = &message
+		} else {
+			event.Message, err = pduMessage(-1, "REC UNREAD", event.Data)
+		}
+	}
+
+	if err != nil {
+		m.log("--- Unable to decode:", event.Line, event.Data, err.Error())
+	}
+}
+
+func (m *Driver) currentCommand() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.command
+}
+
+func (m *Driver) setCommand(command string) {
+	m.mu.Lock()
+	m.command = command
+	m.mu.Unlock()
+}
+
+// decodeUCS2Field decodes string parameter like phone number or storage name
+// which modem sends UCS2 encoded because of AT+CSCS="UCS2"
+func decodeUCS2Field(value string) string {
+	if len(value) == 0 || len(value)%4 != 0 || !isHex(value) {
+		return value
+	}
+
+	for i := 0; i < len(value); i += 4 {
+		if value[i:i+2] != "00" {
+			return value
+		}
+	}
+
+	return UCS2HEX2ASCII(value)
+}
@@ -0,0 +1,137 @@
+package modem
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// USSD session states reported in +CUSD
+const (
+	USSDDone         = iota // no further action required
+	USSDMore                // network waits for reply, e.g. menu selection
+	USSDTerminated          // session terminated by network
+	USSDOtherClient         // other local client has responded
+	USSDNotSupported        // operation not supported
+	USSDTimeout             // network did not respond
+)
+
+// DefaultUSSDTimeout bounds waiting for network answer
+const DefaultUSSDTimeout = 30 * time.Second
+
+// USSDResponse is decoded +CUSD
+type USSDResponse struct {
+	Status int
+	Text   string
+	DCS    int // cell broadcast data coding scheme, 3GPP TS 23.038 5
+}
+
+// More reports whether session continues and network waits for reply
+func (r *USSDResponse) More() bool {
+	return r.Status == USSDMore
+}
+
+// USSD sends code, e.g. *100#, or reply to menu of running session and waits
+// for network answer
+func (m *Driver) USSD(ctx context.Context, code string) (*USSDResponse, error) {
+	m.ussdMu.Lock()
+	defer m.ussdMu.Unlock()
+
+	events := m.Subscribe()
+	defer m.Unsubscribe(events)
+
+	value := ASCII2UCS2HEX(code)
+	if m.ActiveProfile().USSDPacked {
+		septets, err := EncodeGSM7(code)
+		if err != nil {
+			return nil, err
+		}
+		value = hex.EncodeToString(PackSeptets(septets, 0))
+	}
+
+	if _, err := m.SendCommandContext(ctx, fmt.Sprintf("AT+CUSD=1,\"%s\",15\r\n", strings.ToUpper(value)), 0); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(DefaultUSSDTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case event := <-events:
+			if event.Type == EventUSSD && event.USSD != nil {
+				if event.USSD.Status == USSDNotSupported || event.USSD.Status == USSDTimeout {
+					return event.USSD, fmt.Errorf("USSD %s failed with status %d", code, event.USSD.Status)
+				}
+				return event.USSD, nil
+			}
+		case <-m.Closed():
+			return nil, ErrPortClosed
+		case <-timer.C:
+			m.CancelUSSD()
+			return nil, ErrTimeout
+		case <-ctx.Done():
+			m.CancelUSSD()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// CancelUSSD ends running session
+func (m *Driver) CancelUSSD() error {
+	_, err := m.Exec("AT+CUSD=2\r\n")
+	return err
+}
+
+/*
+1. status
+2. text
+3. data coding scheme
+*/
+var cusdLine = regexp.MustCompile(`^\+CUSD:\s*(\d+)(?:,\s*"([^"]*)"(?:,\s*(\d+))?)?`)
+
+// parseUSSD decodes +CUSD, text is hex of UCS2 or packed GSM 7-bit
+// septets depending on modem and data coding scheme, plain text otherwise
+func parseUSSD(line string, packed bool) (*USSDResponse, error) {
+	match := cusdLine.FindStringSubmatch(line)
+	if match == nil {
+		return nil, fmt.Errorf("invalid USSD response: %s", line)
+	}
+
+	response := &USSDResponse{DCS: 15}
+	response.Status, _ = strconv.Atoi(match[1])
+	if match[3] != "" {
+		response.DCS, _ = strconv.Atoi(match[3])
+	}
+
+	text := match[2]
+	data, err := hex.DecodeString(text)
+	if text == "" || err != nil {
+		response.Text = text
+		return response, nil
+	}
+
+	alphabet := dcsAlphabet(byte(response.DCS))
+	if response.DCS == 0x11 { // UCS2 preceded by language
+		alphabet = AlphabetUCS2
+		if len(data) >= 2 {
+			data = data[2:]
+		}
+	}
+
+	switch {
+	case alphabet == AlphabetUCS2 || (!packed && len(text)%4 == 0):
+		// modem converts text to UCS2 selected by AT+CSCS
+		response.Text = decodeUCS2(data)
+	case alphabet == AlphabetGSM7:
+		septets := UnpackSeptets(data, len(data)*8/7, 0)
+		response.Text = strings.TrimSuffix(DecodeGSM7(septets), "\r") // CR pads last octet
+	default:
+		response.Text = string(data)
+	}
+
+	return response, nil
+}
@@ -0,0 +1,109 @@
+package gosms
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/haxpax/gosms/modem"
+)
+
+// Route sends messages whose destination starts with Prefix or matches
+// Pattern through Target, which is device id or group name. When no device
+// of Target can take the message it goes to any device if Fallback is set,
+// otherwise it waits for Target
+type Route struct {
+	Prefix   string
+	Pattern  *regexp.Regexp
+	Target   string
+	Fallback bool
+}
+
+// Match reports whether route applies to mobile number, number is taken
+// as sent, e.g. +44 7700-900123 as +447700900123
+func (r *Route) Match(mobile string) bool {
+	if address, err := modem.ParseAddress(mobile); err == nil {
+		mobile = address.String()
+	}
+	if r.Prefix != "" && strings.HasPrefix(mobile, r.Prefix) {
+		return true
+	}
+	return r.Pattern != nil && r.Pattern.MatchString(mobile)
+}
+
+func (r *Route) String() string {
+	if r.Pattern != nil {
+		return fmt.Sprintf("%s -> %s", r.Pattern, r.Target)
+	}
+	return fmt.Sprintf("%s -> %s", r.Prefix, r.Target)
+}
+
+// HasDevice reports whether gateway has device with given id
+func (g *Gateway) HasDevice(deviceId string) bool {
+	for _, driver := range g.options.Drivers {
+		if driver.DeviceId == deviceId {
+			return true
+		}
+	}
+	return false
+}
+
+// HasGroup reports whether any device of gateway belongs to group
+func (g *Gateway) HasGroup(group string) bool {
+	return len(g.options.Groups[group]) > 0
+}
+
+// checkRoutes makes sure that every route and group leads to a device and
+// that group names are not taken by devices
+func (g *Gateway) checkRoutes() error {
+	for group, members := range g.options.Groups {
+		if g.HasDevice(group) {
+			return fmt.Errorf("group %s has the same name as a device", group)
+		}
+		for _, member := range members {
+			if !g.HasDevice(member) {
+				return fmt.Errorf("group %s has unknown device %s", group, member)
+			}
+		}
+	}
+
+	for _, route := range g.options.Routes {
+		if route.Prefix == "" && route.Pattern == nil {
+			return fmt.Errorf("route to %s has neither prefix nor pattern", route.Target)
+		}
+		if !g.HasDevice(route.Target) && !g.HasGroup(route.Target) {
+			return fmt.Errorf("route %s leads to unknown device or group", route.String())
+		}
+	}
+	return nil
+}
+
+// targetDevices returns device with given id or members of group
+func (g *Gateway) targetDevices(target string) []*Device {
+	for _, device := range g.devices {
+		if device.Driver.DeviceId == target {
+			return []*Device{device}
+		}
+	}
+
+	var devices []*Device
+	for _, member := range g.options.Groups[target] {
+		for _, device := range g.devices {
+			if device.Driver.DeviceId == member {
+				devices = append(devices, device)
+			}
+		}
+	}
+	return devices
+}
+
+// matchRoute returns first route which applies to mobile number, nil when
+// message goes to any device
+func (g *Gateway) matchRoute(mobile string) *Route {
+	for i := range g.options.Routes {
+		if g.options.Routes[i].Match(mobile) {
+			return &g.options.Routes[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package gosms
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/haxpax/gosms/modem"
+	"github.com/haxpax/gosms/modem/simulator"
+)
+
+func TestRouteMatch(t *testing.T) {
+	tests := []struct {
+		route  Route
+		mobile string
+		match  bool
+	}{
+		{Route{Prefix: "+44"}, "+447700900123", true},
+		{Route{Prefix: "+44"}, "+4930123456", false},
+		{Route{Pattern: regexp.MustCompile(`^\+49(30|40)`)}, "+4930123456", true},
+		{Route{Pattern: regexp.MustCompile(`^\+49(30|40)`)}, "+4989123456", false},
+		{Route{Prefix: "+1", Pattern: regexp.MustCompile(`^\+33`)}, "+33123456789", true},
+		{Route{}, "+447700900123", false},
+		{Route{Prefix: "+447700"}, "+44 7700-900 123", true},
+		{Route{Pattern: regexp.MustCompile(`^\+4930`)}, "+49 (30) 123456", true},
+		{Route{Prefix: "07700"}, "07700 900123", true},
+		{Route{Prefix: "+447700"}, "07700 900123", false},
+	}
+
+	for _, test := range tests {
+		if match := test.route.Match(test.mobile); match != test.match {
+			t.Errorf("%s matches %s: %v, want %v", test.route.String(), test.mobile, match, test.match)
+		}
+	}
+}
+
+func TestCheckRoutes(t *testing.T) {
+	drivers := []*modem.Driver{modem.New("sim://uk", 115200, "uk"), modem.New("sim://de", 115200, "de")}
+	tests := []struct {
+		name   string
+		groups map[string][]string
+		routes []Route
+		valid  bool
+	}{
+		{"valid", map[string][]string{"eu": {"de"}}, []Route{{Prefix: "+44", Target: "uk"}, {Prefix: "+49", Target: "eu"}}, true},
+		{"group named as device", map[string][]string{"uk": {"de"}}, nil, false},
+		{"unknown member", map[string][]string{"eu": {"fr"}}, nil, false},
+		{"no prefix nor pattern", nil, []Route{{Target: "uk"}}, false},
+		{"unknown target", nil, []Route{{Prefix: "+33", Target: "fr"}}, false},
+	}
+
+	for _, test := range tests {
+		g := NewGateway(Options{Drivers: drivers, Groups: test.groups, Routes: test.routes})
+		if err := g.checkRoutes(); (err == nil) != test.valid {
+			t.Errorf("%s: checkRoutes = %v", test.name, err)
+		}
+	}
+}
+
+func TestGatewayRoutes(t *testing.T) {
+	uk, de, spare := simulator.New(), simulator.New(), simulator.New()
+	options := testOptions(t)
+	options.Drivers = []*modem.Driver{simDriver(t, "uk", uk), simDriver(t, "de", de), simDriver(t, "spare", spare)}
+	options.Groups = map[string][]string{"eu": {"de"}}
+	options.Routes = []Route{
+		{Prefix: "+44", Target: "uk"},
+		{Pattern: regexp.MustCompile(`^\+49`), Target: "eu"},
+	}
+	g := startGateway(t, options)
+
+	tests := []struct {
+		message OutgoingSMS
+		device  string
+	}{
+		{OutgoingSMS{UUID: "uk", Mobile: "+447700900123"}, "uk"},
+		{OutgoingSMS{UUID: "de", Mobile: "+4930123456"}, "de"},
+		{OutgoingSMS{UUID: "spaced", Mobile: "+44 7700-900 123"}, "uk"},
+		{OutgoingSMS{UUID: "pinned", Mobile: "+447700900123", Target: "spare"}, "spare"},
+		{OutgoingSMS{UUID: "group", Mobile: "+447700900123", Target: "eu"}, "de"},
+	}
+
+	for _, test := range tests {
+		test.message.Body = test.message.UUID
+		if err := g.SendMessage(&test.message); err != nil {
+			t.Fatalf("SendMessage failed: %v", err)
+		}
+		if message := waitStatus(t, g, test.message.UUID, SMSProcessed); message.Device != test.device {
+			t.Errorf("message %s went through %s, want %s", message.UUID, message.Device, test.device)
+		}
+	}
+}
+
+func TestGatewayRouteFallback(t *testing.T) {
+	uk, other := simulator.New(), simulator.New()
+	uk.Unplug()
+	options := testOptions(t)
+	options.Drivers = []*modem.Driver{simDriver(t, "uk", uk), simDriver(t, "other", other)}
+	options.Routes = []Route{
+		{Prefix: "+447700", Target: "uk", Fallback: true},
+		{Prefix: "+44", Target: "uk"},
+	}
+	g := startGateway(t, options)
+
+	// route with fallback goes to any device while its device is offline
+	if err := g.SendMessage(&OutgoingSMS{UUID: "fallback", Mobile: "+447700900123", Body: "hello"}); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+	if message := waitStatus(t, g, "fallback", SMSProcessed); message.Device != "other" {
+		t.Errorf("got %+v", message)
+	}
+
+	// route without fallback waits for its device
+	if err := g.SendMessage(&OutgoingSMS{UUID: "waiting", Mobile: "+441632960123", Body: "hello"}); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if message := getMessage(t, g, "waiting"); message.Status != SMSPending || message.Retries != 0 {
+		t.Errorf("got %+v", message)
+	}
+
+	uk.Plug()
+	if message := waitStatus(t, g, "waiting", SMSProcessed); message.Device != "uk" {
+		t.Errorf("got %+v", message)
+	}
+}
+
+func TestGatewayPendingRotation(t *testing.T) {
+	sim, offline := simulator.New(), simulator.New()
+	offline.Unplug()
+	options := testOptions(t)
+	options.Drivers = []*modem.Driver{simDriver(t, "gsm0", sim), simDriver(t, "offline", offline)}
+	options.BufferSize = 2
+	options.LoaderLongTimeout = 100 * time.Millisecond
+	g := NewGateway(options)
+
+	// messages waiting for offline device fill whole buffer on every load
+	// unless they go behind the others
+	for i := 0; i < 4; i++ {
+		message := &OutgoingSMS{UUID: fmt.Sprint("pinned", i), Mobile: "+447700900123", Body: "hello", Target: "offline"}
+		if err := g.insertOutgoingMessage(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := g.insertOutgoingMessage(&OutgoingSMS{UUID: "free", Mobile: "+447700900123", Body: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer g.Stop()
+
+	waitStatus(t, g, "free", SMSProcessed)
+	if message := getMessage(t, g, "pinned0"); message.Status != SMSPending || message.Retries != 0 {
+		t.Errorf("got %+v", message)
+	}
+}
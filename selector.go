@@ -0,0 +1,167 @@
+package gosms
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DeviceSelector picks device which sends outgoing message, devices are
+// online and, unless all of them fail, not failing. nil leaves the message
+// pending
+type DeviceSelector interface {
+	Select(message OutgoingSMS, devices []*Device) *Device
+}
+
+// Selectors are built-in strategies by name, as used in SELECTOR setting,
+// weights are keyed by device id, devices without weight get 1
+var Selectors = map[string]func(weights map[string]int) DeviceSelector{
+	"roundrobin":  func(map[string]int) DeviceSelector { return &RoundRobinSelector{} },
+	"leastqueued": func(map[string]int) DeviceSelector { return &LeastQueuedSelector{} },
+	"weighted":    func(weights map[string]int) DeviceSelector { return NewWeightedSelector(weights) },
+	"health":      func(map[string]int) DeviceSelector { return &HealthSelector{} },
+}
+
+// LookupSelector returns built-in strategy by case insensitive name
+func LookupSelector(name string, weights map[string]int) (DeviceSelector, error) {
+	if selector, ok := Selectors[strings.ToLower(strings.TrimSpace(name))]; ok {
+		return selector(weights), nil
+	}
+
+	var names []string
+	for name := range Selectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown device selector %s, use one of %s", name, strings.Join(names, ", "))
+}
+
+// RoundRobinSelector passes messages to devices in turn
+type RoundRobinSelector struct {
+	mu   sync.Mutex
+	next int
+}
+
+func (s *RoundRobinSelector) Select(message OutgoingSMS, devices []*Device) *Device {
+	if len(devices) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next++
+	return devices[s.next%len(devices)]
+}
+
+// LeastQueuedSelector passes message to device with fewest messages waiting
+// or being sent, ties are taken in turn
+type LeastQueuedSelector struct {
+	RoundRobinSelector
+}
+
+func (s *LeastQueuedSelector) Select(message OutgoingSMS, devices []*Device) *Device {
+	return s.best(devices, func(d *Device) int { return -d.Queued() })
+}
+
+// best returns device with highest score, ties are taken in turn so that
+// bursts to idle devices are spread
+func (s *RoundRobinSelector) best(devices []*Device, score func(*Device) int) *Device {
+	if len(devices) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next++
+
+	var best *Device
+	var bestScore int
+	for i := range devices {
+		device := devices[(s.next+i)%len(devices)]
+		if value := score(device); best == nil || value > bestScore {
+			best, bestScore = device, value
+		}
+	}
+	return best
+}
+
+// WeightedSelector passes messages to devices in proportion of their
+// weights, e.g. more to SIM with cheaper plan, using smooth weighted round
+// robin so that heavy device does not get bursts. Devices with zero weight
+// take messages only when no other device can, then all of them in turn
+type WeightedSelector struct {
+	Weights map[string]int
+
+	mu       sync.Mutex
+	current  map[string]int
+	fallback RoundRobinSelector
+}
+
+func NewWeightedSelector(weights map[string]int) *WeightedSelector {
+	return &WeightedSelector{Weights: weights, current: map[string]int{}}
+}
+
+func (s *WeightedSelector) weight(d *Device) int {
+	if weight, ok := s.Weights[d.Driver.DeviceId]; ok {
+		return weight
+	}
+	return 1
+}
+
+func (s *WeightedSelector) Select(message OutgoingSMS, devices []*Device) *Device {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current == nil {
+		s.current = map[string]int{}
+	}
+
+	var best *Device
+	total := 0
+	for _, device := range devices {
+		weight := s.weight(device)
+		if weight <= 0 {
+			continue // device is the last resort
+		}
+		total += weight
+		s.current[device.Driver.DeviceId] += weight
+		if best == nil || s.current[device.Driver.DeviceId] > s.current[best.Driver.DeviceId] {
+			best = device
+		}
+	}
+
+	if best == nil {
+		log.Println("weighted selector: no device has weight, taking them in turn")
+		return s.fallback.Select(message, devices)
+	}
+	s.current[best.Driver.DeviceId] -= total
+	return best
+}
+
+// HealthSelector passes message to device with best signal which is
+// registered to network, recent failures and waiting messages lower the
+// score, ties are taken in turn
+type HealthSelector struct {
+	RoundRobinSelector
+}
+
+func (s *HealthSelector) Select(message OutgoingSMS, devices []*Device) *Device {
+	return s.best(devices, healthScore)
+}
+
+// healthScore is signal 0-31 less penalties, devices which were not sampled
+// yet get average signal
+func healthScore(d *Device) int {
+	score := 15
+	if status := d.Status(); status != nil {
+		score = status.Signal
+		if status.Signal == 99 {
+			score = 0 // not known or not detectable
+		}
+		if status.Registration != 1 && status.Registration != 5 {
+			score -= 100 // not registered to home network nor roaming
+		}
+	}
+	return score - 10*d.Failures() - 2*d.Queued()
+}
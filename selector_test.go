@@ -0,0 +1,194 @@
+package gosms
+
+import (
+	"testing"
+	"time"
+
+	"github.com/haxpax/gosms/modem"
+	"github.com/haxpax/gosms/modem/simulator"
+)
+
+// testDevices returns online devices which are not connected, they only
+// carry id and queue
+func testDevices(ids ...string) []*Device {
+	g := &Gateway{options: DefaultOptions()}
+
+	var devices []*Device
+	for _, id := range ids {
+		devices = append(devices, &Device{
+			Driver:  modem.New("sim://"+id, 115200, id),
+			Send:    make(chan OutgoingSMS, 10),
+			gateway: g,
+			online:  true,
+		})
+	}
+	return devices
+}
+
+// countSelected selects n times and counts picks by device id
+func countSelected(selector DeviceSelector, devices []*Device, n int) map[string]int {
+	counts := map[string]int{}
+	for i := 0; i < n; i++ {
+		if device := selector.Select(OutgoingSMS{}, devices); device != nil {
+			counts[device.Driver.DeviceId]++
+		}
+	}
+	return counts
+}
+
+func TestLookupSelector(t *testing.T) {
+	for _, name := range []string{"roundrobin", "LeastQueued", " weighted ", "health"} {
+		if selector, err := LookupSelector(name, nil); err != nil || selector == nil {
+			t.Errorf("LookupSelector(%q) = %v, %v", name, selector, err)
+		}
+	}
+	if _, err := LookupSelector("random", nil); err == nil {
+		t.Error("unknown selector was accepted")
+	}
+}
+
+func TestRoundRobinSelector(t *testing.T) {
+	devices := testDevices("a", "b", "c")
+	counts := countSelected(&RoundRobinSelector{}, devices, 9)
+	if counts["a"] != 3 || counts["b"] != 3 || counts["c"] != 3 {
+		t.Errorf("got %v", counts)
+	}
+
+	if device := (&RoundRobinSelector{}).Select(OutgoingSMS{}, nil); device != nil {
+		t.Errorf("selected %v from no devices", device)
+	}
+}
+
+func TestLeastQueuedSelector(t *testing.T) {
+	devices := testDevices("a", "b", "c")
+	devices[0].Send <- OutgoingSMS{}
+	devices[0].Send <- OutgoingSMS{}
+	devices[2].Send <- OutgoingSMS{}
+
+	selector := &LeastQueuedSelector{}
+	if device := selector.Select(OutgoingSMS{}, devices); device != devices[1] {
+		t.Errorf("selected %s", device.Driver.DeviceId)
+	}
+
+	// ties are taken in turn
+	devices[1].Send <- OutgoingSMS{}
+	counts := countSelected(selector, devices[1:], 4)
+	if counts["b"] != 2 || counts["c"] != 2 {
+		t.Errorf("got %v", counts)
+	}
+}
+
+func TestWeightedSelector(t *testing.T) {
+	devices := testDevices("a", "b", "c", "d")
+	selector := NewWeightedSelector(map[string]int{"a": 3, "b": 1, "c": 0})
+
+	// d has no weight and gets 1, c takes no messages
+	counts := countSelected(selector, devices, 10)
+	if counts["a"] != 6 || counts["b"] != 2 || counts["c"] != 0 || counts["d"] != 2 {
+		t.Errorf("got %v", counts)
+	}
+
+	// devices with zero weight are taken in turn when no other device is left
+	zero := testDevices("x", "y")
+	selector = NewWeightedSelector(map[string]int{"x": 0, "y": 0})
+	if counts := countSelected(selector, zero, 4); counts["x"] != 2 || counts["y"] != 2 {
+		t.Errorf("zero weight devices: got %v", counts)
+	}
+}
+
+func TestHealthSelector(t *testing.T) {
+	devices := testDevices("weak", "unregistered", "roaming", "unknown")
+	devices[0].status = &DeviceStatus{Signal: 10, Registration: 1}
+	devices[1].status = &DeviceStatus{Signal: 25, Registration: 0}
+	devices[2].status = &DeviceStatus{Signal: 20, Registration: 5}
+
+	selector := &HealthSelector{}
+	if device := selector.Select(OutgoingSMS{}, devices); device != devices[2] {
+		t.Errorf("selected %s", device.Driver.DeviceId)
+	}
+
+	// failures and waiting messages lower the score
+	devices[2].failures = 1
+	if device := selector.Select(OutgoingSMS{}, devices); device != devices[3] {
+		t.Errorf("selected %s", device.Driver.DeviceId)
+	}
+}
+
+func TestGatewaySelector(t *testing.T) {
+	sims := []*simulator.Modem{simulator.New(), simulator.New()}
+	options := testOptions(t)
+	options.Drivers = []*modem.Driver{simDriver(t, "gsm0", sims[0]), simDriver(t, "gsm1", sims[1])}
+	options.Selector = NewWeightedSelector(map[string]int{"gsm0": 2})
+	g := startGateway(t, options)
+
+	for _, uuid := range []string{"m0", "m1", "m2", "m3", "m4", "m5"} {
+		if err := g.SendMessage(&OutgoingSMS{UUID: uuid, Mobile: "+447700900123", Body: uuid}); err != nil {
+			t.Fatalf("SendMessage failed: %v", err)
+		}
+		waitStatus(t, g, uuid, SMSProcessed)
+	}
+
+	if len(sims[0].Sent()) != 4 || len(sims[1].Sent()) != 2 {
+		t.Errorf("devices sent %d and %d messages, want 4 and 2", len(sims[0].Sent()), len(sims[1].Sent()))
+	}
+}
+
+func TestGatewayZeroWeight(t *testing.T) {
+	main, backup0, backup1 := simulator.New(), simulator.New(), simulator.New()
+	main.Unplug()
+	options := testOptions(t)
+	options.Drivers = []*modem.Driver{simDriver(t, "main", main), simDriver(t, "backup0", backup0), simDriver(t, "backup1", backup1)}
+	options.Selector = NewWeightedSelector(map[string]int{"backup0": 0, "backup1": 0})
+	g := startGateway(t, options)
+
+	// backups share messages while main device is offline
+	for _, uuid := range []string{"m0", "m1", "m2", "m3"} {
+		if err := g.SendMessage(&OutgoingSMS{UUID: uuid, Mobile: "+447700900123", Body: uuid}); err != nil {
+			t.Fatalf("SendMessage failed: %v", err)
+		}
+		waitStatus(t, g, uuid, SMSProcessed)
+	}
+	if len(backup0.Sent()) != 2 || len(backup1.Sent()) != 2 {
+		t.Errorf("backups sent %d and %d messages, want 2 and 2", len(backup0.Sent()), len(backup1.Sent()))
+	}
+
+	// and get nothing once it is back
+	main.Plug()
+	deadline := time.Now().Add(5 * time.Second)
+	for !g.devices[0].Online() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := g.SendMessage(&OutgoingSMS{UUID: "m4", Mobile: "+447700900123", Body: "m4"}); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+	if message := waitStatus(t, g, "m4", SMSProcessed); message.Device != "main" {
+		t.Errorf("got %+v", message)
+	}
+}
+
+func TestGatewayFailingDevice(t *testing.T) {
+	good, bad := simulator.New(), simulator.New()
+	bad.Script(simulator.CMSError("AT+CMGS", 42))
+	options := testOptions(t)
+	options.Drivers = []*modem.Driver{simDriver(t, "good", good), simDriver(t, "bad", bad)}
+	options.FailureLimit = 1
+	g := startGateway(t, options)
+
+	// first message goes to bad device, it is retried on the good one and
+	// bad device is left out from then on
+	for _, uuid := range []string{"m0", "m1", "m2"} {
+		if err := g.SendMessage(&OutgoingSMS{UUID: uuid, Mobile: "+447700900123", Body: uuid}); err != nil {
+			t.Fatalf("SendMessage failed: %v", err)
+		}
+		if message := waitStatus(t, g, uuid, SMSProcessed); message.Device != "good" {
+			t.Errorf("got %+v", message)
+		}
+	}
+
+	if message := getMessage(t, g, "m0"); message.Retries != 2 {
+		t.Errorf("first message took %d attempts, want 2", message.Retries)
+	}
+	if !g.devices[1].Failing() || len(good.Sent()) != 3 {
+		t.Errorf("bad device failing %v, good device sent %d messages", g.devices[1].Failing(), len(good.Sent()))
+	}
+}
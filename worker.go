@@ -1,13 +1,17 @@
 package gosms
 
 import (
+	"context"
 	"log"
 	"time"
-	"math/rand"
 	"github.com/haxpax/gosms/modem"
 	"net/smtp"
 	"fmt"
 	"encoding/base64"
+	"strings"
+	"database/sql"
+	"sync"
+	"github.com/satori/go.uuid"
 )
 
 //TODO: should be configurable
@@ -17,33 +21,153 @@ const (
 	SMSPending   = iota // 0
 	SMSProcessed        // 1
 	SMSError            // 2
+	SMSDelivered        // 3
+	SMSExpired          // 4
+	SMSRejected         // 5
 )
 
 type OutgoingSMS struct {
+	Id          int    `json:"id"`
+	UUID        string `json:"uuid"`
+	Mobile      string `json:"mobile"`
+	Body        string `json:"body"`
+	Status      int    `json:"status"`
+	Retries     int    `json:"retries"`
+	Device      string `json:"device"`
+	CreatedAt   string `json:"created_at"`
+	UpdatedAt   string `json:"updated_at"`
+	DeliveredAt string `json:"delivered_at"`
+	Error       string `json:"error"`
+
+	// Class is message class 0-3, class 0 is flash message shown right
+	// away, nil sends message without class
+	Class *int `json:"class"`
+	// Validity is how many minutes service centre tries to deliver the
+	// message, zero means 24 hours
+	Validity int `json:"validity"`
+	// Report requests status report, nil leaves it to device setting
+	Report *bool `json:"report"`
+	// Target is device id or group name message is pinned to, empty lets
+	// routes and device selector decide
+	Target string `json:"target"`
+}
+
+// IncomingSMS is received message, Index and Status are its place and state
+// in modem storage, Index is -1 for messages which were routed directly or
+// assembled from parts. SentAt is service centre time stamp with timezone,
+// CreatedAt is when gosms read the message
+type IncomingSMS struct {
 	Id 	  int    `json:"id"`
-	UUID      string `json:"uuid"`
 	Mobile    string `json:"mobile"`
+	Name      string `json:"name"`
 	Body      string `json:"body"`
-	Status    int    `json:"status"`
-	Retries   int    `json:"retries"`
 	Device    string `json:"device"`
+	Partial   bool   `json:"partial"`
+	Index     int    `json:"index"`
+	Status    string `json:"status"`
+	SentAt    string `json:"sent_at"`
 	CreatedAt string `json:"created_at"`
-	UpdatedAt string `json:"updated_at"`
 }
 
-type IncomingSMS struct {
-	Id 	  int    `json:"id"`
+// sendOptions converts message settings to driver settings
+func (sms *OutgoingSMS) sendOptions(statusReports bool) modem.SendOptions {
+	options := modem.SendOptions{
+		ValidityPeriod: time.Duration(sms.Validity) * time.Minute,
+		StatusReport:   statusReports,
+	}
+	if sms.Class != nil {
+		options.Class = modem.Class0 + *sms.Class
+	}
+	if sms.Report != nil {
+		options.StatusReport = *sms.Report
+	}
+	return options
+}
+
+// IncomingCall is call which was rejected by device, Mobile is empty when
+// caller withheld the number
+type IncomingCall struct {
+	Id        int    `json:"id"`
 	Mobile    string `json:"mobile"`
-	Body      string `json:"body"`
 	Device    string `json:"device"`
 	CreatedAt string `json:"created_at"`
 }
 
+// DeviceStatus is a health sample of device as stored in database
+type DeviceStatus struct {
+	Device           string `json:"device"`
+	Signal           int    `json:"signal"`
+	BitErrorRate     int    `json:"ber"`
+	Registration     int    `json:"registration"`
+	GPRSRegistration int    `json:"gprs_registration"`
+	Operator         string `json:"operator"`
+	SIM              string `json:"sim"`
+	IMEI             string `json:"imei"`
+	IMSI             string `json:"imsi"`
+	CreatedAt        string `json:"created_at"`
+}
+
+// DeviceInfo is current state of device together with its recent history,
+// Reason tells why device is offline
+type DeviceInfo struct {
+	Device  string         `json:"device"`
+	Online  bool           `json:"online"`
+	Reason  string         `json:"reason"`
+	Status  *DeviceStatus  `json:"status"`
+	Storage *DeviceStorage `json:"storage"`
+	Balance *DeviceBalance `json:"balance"`
+	Usage   DeviceUsage    `json:"usage"`
+	History []DeviceStatus `json:"history"`
+}
+
+// DeviceStorage is usage of message storage of device as last read
+type DeviceStorage struct {
+	Storage string `json:"storage"`
+	Used    int    `json:"used"`
+	Total   int    `json:"total"`
+}
+
+// DeviceBalance is network answer to balance check USSD as stored in database
+type DeviceBalance struct {
+	Device    string `json:"device"`
+	Code      string `json:"code"`
+	Text      string `json:"text"`
+	CreatedAt string `json:"created_at"`
+}
+
+// BalanceCheck is USSD code, e.g. *100#, which tells prepaid balance of SIM
+type BalanceCheck struct {
+	Code     string
+	Interval time.Duration
+}
 
 type Device struct {
 	Driver *modem.Driver
 	Send   chan OutgoingSMS
 	Poll   chan bool
+	Events <-chan modem.Event
+
+	gateway *Gateway
+
+	mu     sync.Mutex
+	online bool
+	reason string
+
+	storage *DeviceStorage
+	status  *DeviceStatus
+
+	sending  bool
+	failures int // sending attempts failed in a row
+	failedAt time.Time
+
+	recent    []time.Time // parts sent in last minute
+	usageDay  string
+	sentDay   int
+	sentMonth int
+
+	ring           <-chan time.Time // waiting for caller identification
+	rejected       time.Time
+	storageAlerted bool
 }
 
 type SMTP struct {
@@ -57,224 +181,682 @@ type SMTP struct {
 	Recipient  string
 }
 
-var devices []*Device
+// Worker sends messages routed to device and handles its events until ctx
+// is done
+func (d *Device) Worker(ctx context.Context) {
+	options := &d.gateway.options
+	if !d.Online() && !d.reconnect(ctx) {
+		return
+	}
+
+	var health <-chan time.Time
+	if options.HealthInterval > 0 {
+		ticker := time.NewTicker(options.HealthInterval)
+		defer ticker.Stop()
+		health = ticker.C
+		d.checkHealth()
+	}
 
-var queue chan OutgoingSMS
-var send chan OutgoingSMS
-var poll chan bool
+	var balance <-chan time.Time
+	if check, ok := options.BalanceChecks[d.Driver.DeviceId]; ok && check.Interval > 0 {
+		ticker := time.NewTicker(check.Interval)
+		defer ticker.Stop()
+		balance = ticker.C
+		d.checkBalance()
+	}
 
-var wakeupMessageLoader chan bool
+	// parts of long messages time out on their own timer as polling may be
+	// disabled
+	var flush <-chan time.Time
+	if options.IncomingPartTimeout > 0 {
+		ticker := time.NewTicker(flushInterval(options.IncomingPartTimeout))
+		defer ticker.Stop()
+		flush = ticker.C
+	}
 
-var bufferMaxSize int
-var bufferLowCount int
-var messageCountSinceLastWakeup int
-var timeOfLastWakeup time.Time
-var messageLoaderTimeout time.Duration
-var messageLoaderCountout int
-var messageLoaderLongTimeout time.Duration
-var smtpSettings *SMTP
+	for {
+		// device over its limit per minute leaves messages waiting, events
+		// are handled meanwhile
+		send := d.Send
+		var resume <-chan time.Time
+		if wait := d.rateWait(); wait > 0 {
+			send = nil
+			resume = time.After(wait)
+		}
 
+		select {
+		case message := <- send:
+			if ctx.Err() != nil {
+				// shutting down, message waits for next start
+				d.requeue(message)
+				return
+			}
+			if d.AtQuota() {
+				log.Println("quota used up: ", d.Driver.DeviceId)
+				d.requeue(message)
+				continue
+			}
+			d.processMessage(message)
+			if len(d.Send) == 0 {
+				// messages left pending while the queue was full can come
+				d.gateway.wakeup()
+			}
+		case <- resume:
+		case <- d.Poll:
+			d.pollMessages()
+		case event := <- d.Events:
+			d.handleEvent(event)
+		case <- health:
+			d.checkHealth()
+		case <- balance:
+			d.checkBalance()
+		case <- flush:
+			d.flushMessageParts()
+		case <- d.ring:
+			d.ring = nil
+			d.rejectCall("")
+		case <- d.Driver.Closed():
+			log.Println("device offline: ", d.Driver.DeviceId)
+			d.setOnline(false, "connection lost")
+			if !d.reconnect(ctx) {
+				return
+			}
+			if options.HealthInterval > 0 {
+				d.checkHealth()
+			}
+		case <- ctx.Done():
+			return
+		}
+	}
+}
+
+func (d *Device) Online() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.online
+}
+
+// Reason returns why device is offline, e.g. SIM waits for PUK
+func (d *Device) Reason() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.reason
+}
 
-func InitWorker(drivers []*modem.Driver, bufferSize, bufferLow, loaderTimeout, countOut, loaderLongTimeout int, smtp *SMTP) {
-	log.Println("--- InitWorker")
+// Storage returns usage of message storage as last read, nil before first
+// successful reading
+func (d *Device) Storage() *DeviceStorage {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.storage
+}
 
-	bufferMaxSize = bufferSize
-	bufferLowCount = bufferLow
-	messageLoaderTimeout = time.Duration(loaderTimeout) * time.Minute
-	messageLoaderCountout = countOut
-	messageLoaderLongTimeout = time.Duration(loaderLongTimeout) * time.Minute
+// Status returns latest health sample, nil before first one
+func (d *Device) Status() *DeviceStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.status
+}
 
-	wakeupMessageLoader = make(chan bool, 1)
-	wakeupMessageLoader <- true
-	messageCountSinceLastWakeup = 0
-	timeOfLastWakeup = time.Now().Add((time.Duration(loaderTimeout) * -1) * time.Minute) //older time handles the cold start state of the system
-	smtpSettings = smtp
+// Queued returns number of messages waiting for device including the one
+// being sent
+func (d *Device) Queued() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.sending {
+		return len(d.Send) + 1
+	}
+	return len(d.Send)
+}
 
-	// init global channels
-	queue = make(chan OutgoingSMS, bufferMaxSize)
-	send = make(chan OutgoingSMS, bufferMaxSize)
-	poll = make(chan bool, 1)
+// Failures returns number of sending attempts which failed in a row,
+// failures caused by message itself, e.g. invalid number, do not count
+func (d *Device) Failures() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.failures
+}
 
-	// init all devices
-	for _, driver := range drivers {
-		err := driver.Connect()
-		if err != nil {
-			log.Fatalln("InitWorker: error connecting", driver.DeviceId, err)
+// Failing reports whether device failed too many times recently, failing
+// device is tried again after failure cooldown
+func (d *Device) Failing() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.failures >= d.gateway.options.FailureLimit && time.Since(d.failedAt) < d.gateway.options.FailureCooldown
+}
+
+func (d *Device) setSending(sending bool) {
+	d.mu.Lock()
+	d.sending = sending
+	d.mu.Unlock()
+}
+
+// countAttempt keeps track of failures in a row
+func (d *Device) countAttempt(failed bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !failed {
+		d.failures = 0
+		return
+	}
+	d.failures++
+	d.failedAt = time.Now()
+}
+
+func (d *Device) setOnline(online bool, reason string) {
+	d.mu.Lock()
+	d.online = online
+	d.reason = reason
+	d.mu.Unlock()
+}
+
+// reconnect keeps trying to connect lost modem with growing delay, messages
+// routed to the device meanwhile go back to pending. It gives up when ctx
+// is done
+func (d *Device) reconnect(ctx context.Context) bool {
+	d.setOnline(false, d.Reason())
+	d.Driver.Close()
+
+	delay := d.gateway.options.ReconnectDelay
+	for {
+		log.Println("reconnecting: ", d.Driver.DeviceId, "in", delay)
+		if !d.sleep(ctx, delay) {
+			return false
 		}
 
-		device := Device{
-			Driver: driver,
-			Send: make(chan OutgoingSMS, bufferMaxSize),
-			Poll: make(chan bool, 1),
-		};
-		devices = append(devices, &device)
+		rejected := d.Driver.RejectedPIN
+		err := d.Driver.Connect()
+		d.gateway.saveRejectedPIN(d.Driver, rejected)
+		if err == nil {
+			break
+		}
+		log.Println("reconnecting failed: ", d.Driver.DeviceId, err)
+		d.setOnline(false, err.Error())
 
-		go device.Worker()
+		delay *= 2
+		if delay > d.gateway.options.ReconnectMaxDelay {
+			delay = d.gateway.options.ReconnectMaxDelay
+		}
 	}
 
-	// init sms/poll listener
-	go func() {
-		ticker := time.NewTicker(10 * time.Second)
-		go func() {
-			for t := range ticker.C {
-				log.Println("Polling time", t)
-				poll <- true
-			}
-		}()
+	log.Println("device online: ", d.Driver.DeviceId)
+	d.setOnline(true, "")
 
-		for {
-			select {
-			case message := <- send:
-				// we select random sending device
-				rand.Seed(time.Now().Unix())
-				n := rand.Int() % len(devices)
-				devices[n].Send <- message
-			case message := <- queue:
-				// select should work at random, so if queue will be full and we will have new request
-				// for send, it should pass through nearly realtime
-				rand.Seed(time.Now().Unix())
-				n := rand.Int() % len(devices)
-				devices[n].Send <- message
-			case <- poll:
-				// poll all devices
-				for _, device := range devices {
-					device.Poll <- true
-				}
-			}
+	// messages which were waiting for a device can go now
+	d.gateway.wakeup()
+	return true
+}
+
+// sleep waits while device is offline, messages which were routed to the
+// device before it went offline are returned to pending. It returns false
+// when ctx is done before the delay passed
+func (d *Device) sleep(ctx context.Context, delay time.Duration) bool {
+	timer := time.After(delay)
+	for {
+		select {
+		case message := <- d.Send:
+			d.requeue(message)
+		case <- timer:
+			return true
+		case <- ctx.Done():
+			return false
 		}
-	}()
+	}
+}
+
+// requeue returns message which device was not able to try back to pending
+func (d *Device) requeue(message OutgoingSMS) {
+	log.Println("requeue: ", message.UUID, d.Driver.DeviceId)
+	message.Status = SMSPending
+
+	if err := d.gateway.updateOutgoingMessageStatus(message); err != nil {
+		log.Println("DB error: ", err)
+	}
+	d.gateway.release(message.UUID)
 
-	// load older messages
-	go messageLoader(bufferSize, bufferLowCount)
+	d.gateway.EnqueueMessage(&message)
 }
 
+func (d *Device) checkHealth() {
+	if !d.Driver.Connected() {
+		return
+	}
 
-func SendMessage(message *OutgoingSMS) {
-	log.Println("--- SendMessage", message)
-	err := insertOutgoingMessage(message);
-	if err != nil {
-		log.Fatalln("DB error: ", err)
+	status := d.Driver.ReadStatus()
+	log.Printf("health: %s signal %d, registration %d, operator %s, SIM %s\n",
+		d.Driver.DeviceId, status.Signal, status.Registration, status.Operator, status.SIM)
+
+	sample := DeviceStatus{
+		Device:           d.Driver.DeviceId,
+		Signal:           status.Signal,
+		BitErrorRate:     status.BitErrorRate,
+		Registration:     status.Registration,
+		GPRSRegistration: status.GPRSRegistration,
+		Operator:         status.Operator,
+		SIM:              status.SIM,
+		IMEI:             status.IMEI,
+		IMSI:             status.IMSI,
+	}
+	if err := d.gateway.insertDeviceStatus(&sample); err != nil {
+		log.Println("DB error: ", err)
 	}
 
-	// we try to send message immediately
-	send <- *message
+	d.mu.Lock()
+	d.status = &sample
+	d.mu.Unlock()
+
+	d.checkStorage()
 }
 
-func EnqueueMessage(message *OutgoingSMS) {
-	log.Println("--- EnqueueMessage: ", message)
+// checkStorage reads usage of message storage and sends alert once it gets
+// above storage alert level, next alert is sent after usage drops below it
+func (d *Device) checkStorage() {
+	status, err := d.Driver.ReadStorage()
+	if err != nil {
+		log.Println("reading storage failed: ", d.Driver.DeviceId, err)
+		return
+	}
 
-	//notify the message loader only if its been to too long
-	//or too many messages since last notification
-	messageCountSinceLastWakeup++
-	if messageCountSinceLastWakeup > messageLoaderCountout || time.Now().Sub(timeOfLastWakeup) > messageLoaderTimeout {
-		log.Println("EnqueueMessage: ", "waking up message loader")
-		wakeupMessageLoader <- true
-		messageCountSinceLastWakeup = 0
-		timeOfLastWakeup = time.Now()
+	storage := &DeviceStorage{Storage: status.Storage, Used: status.Used, Total: status.Total}
+	d.mu.Lock()
+	d.storage = storage
+	d.mu.Unlock()
+
+	level := d.gateway.options.StorageAlertLevel
+	if level <= 0 || status.Usage() < level {
+		d.storageAlerted = false
+		return
+	}
+	if d.storageAlerted {
+		return
 	}
-	log.Println("EnqueueMessage - anon: count since last wakeup: ", messageCountSinceLastWakeup)
+	d.storageAlerted = true
+
+	log.Println("storage almost full: ", d.Driver.DeviceId, status.Storage, status.Used, "of", status.Total)
+	go d.gateway.storageNotice(d.Driver.DeviceId, *storage)
 }
 
-func messageLoader(bufferSize, minFill int) {
-	// Load pending messages from database as needed
-	for {
+func (d *Device) checkBalance() {
+	check := d.gateway.options.BalanceChecks[d.Driver.DeviceId]
+	if !d.Driver.Connected() || check.Code == "" {
+		return
+	}
 
-		/*
-		   - set a fairly long timeout for wakeup
-		   - if there are very few number of messages in the system and they failed at first go,
-		   and there are no events happening to call EnqueueMessage, those messages might get
-		   stalled in the system until someone knocks on the API door
-		   - we can afford a really long polling in this case
-		*/
-		timeout := make(chan bool, 1)
-		go func() {
-			time.Sleep(messageLoaderLongTimeout)
-			timeout <- true
-		}()
-		log.Println("messageLoader: ", "waiting for wakeup call")
-		select {
-		case <-wakeupMessageLoader:
-			log.Println("messageLoader: woken up by channel call")
-		case <-timeout:
-			log.Println("messageLoader: woken up by timeout")
+	ctx, cancel := context.WithTimeout(context.Background(), modem.DefaultUSSDTimeout)
+	defer cancel()
+
+	response, err := d.Driver.USSD(ctx, check.Code)
+	if err != nil {
+		log.Println("balance check failed: ", d.Driver.DeviceId, err)
+		return
+	}
+	if response.More() {
+		d.Driver.CancelUSSD() // balance is expected right away, menus are not followed
+	}
+
+	log.Println("balance: ", d.Driver.DeviceId, response.Text)
+	err = d.gateway.insertDeviceBalance(&DeviceBalance{Device: d.Driver.DeviceId, Code: check.Code, Text: response.Text})
+	if err != nil {
+		log.Println("DB error: ", err)
+	}
+}
+
+func (d *Device) handleEvent(event modem.Event) {
+	switch event.Type {
+	case modem.EventNewMessage:
+		message, err := d.Driver.ReadSMSAt(event.Storage, event.Index)
+		if err != nil {
+			log.Println("reading new message failed: ", d.Driver.DeviceId, err)
+			d.pollMessages()
+			return
 		}
-		if len(queue) >= bufferLowCount {
-			//if we have sufficient number of messages to process,
-			//don't bother hitting the database
-			log.Println("messageLoader: ", "I have sufficient messages")
-			continue
+		if err := d.receiveIncoming(*message); err != nil {
+			log.Println("DB error: ", err) // stays in storage for next poll
+		} else {
+			d.Driver.DeleteSMSAt(event.Storage, event.Index)
 		}
-
-		countToFetch := bufferMaxSize - len(queue)
-		log.Println("messageLoader: ", "I need to fetch more messages", countToFetch)
-		pendingMsgs, err := getPendingOutgoingMessages(countToFetch)
-		if err == nil {
-			log.Println("messageLoader: ", len(pendingMsgs), " pending messages found")
-			for _, msg := range pendingMsgs {
-				queue <- msg
+		d.checkStorage()
+	case modem.EventMessage:
+		if event.Message != nil {
+			if err := d.receiveIncoming(*event.Message); err != nil {
+				log.Println("DB error: ", err)
 			}
 		}
+	case modem.EventStatusReport:
+		if event.Report != nil {
+			d.processStatusReports([]modem.StatusReport{*event.Report})
+		}
+	case modem.EventRegistration:
+		d.checkHealth()
+	case modem.EventRing:
+		// RING repeats until call is rejected, +CLIP follows each of them
+		if d.ring == nil && time.Since(d.rejected) > d.gateway.options.CallerIDWait {
+			d.ring = time.After(d.gateway.options.CallerIDWait)
+		}
+	case modem.EventCallerID:
+		if d.ring != nil || time.Since(d.rejected) > d.gateway.options.CallerIDWait {
+			d.ring = nil
+			d.rejectCall(event.Number)
+		}
+	case modem.EventStatusReportIndex:
+		report, err := d.Driver.ReadStatusReportAt(event.Storage, event.Index)
+		if err != nil {
+			log.Println("reading status report failed: ", d.Driver.DeviceId, err)
+			return
+		}
+		d.processStatusReports([]modem.StatusReport{*report})
 	}
 }
 
-func (d *Device) Worker() {
-	for {
-		select {
-		case message := <- d.Send:
-			d.processMessage(message)
-		case <- d.Poll:
-			d.pollMessages()
-		}
+// rejectCall hangs up incoming call, stores it as missed call and sends
+// call reply to the caller
+func (d *Device) rejectCall(number string) {
+	log.Println("missed call: ", d.Driver.DeviceId, number)
+	if err := d.Driver.Hangup(); err != nil {
+		log.Println("rejecting call failed: ", d.Driver.DeviceId, err)
+	}
+	d.rejected = time.Now()
+
+	call := IncomingCall{Device: d.Driver.DeviceId, Mobile: number}
+	if err := d.gateway.insertIncomingCall(&call); err != nil {
+		log.Println("DB error: ", err)
+	}
+
+	go d.gateway.callNotice(call)
+
+	if reply := d.gateway.options.CallReply; reply != "" && number != "" {
+		// dispatcher may be waiting for this device, so we do not wait for it
+		go func() {
+			if err := d.gateway.SendMessage(&OutgoingSMS{UUID: uuid.NewV1().String(), Mobile: number, Body: reply}); err != nil {
+				log.Println("DB error: ", err)
+			}
+		}()
 	}
 }
 
 func (d *Device) processMessage(message OutgoingSMS) {
 	log.Println("processing: ", message.UUID, d.Driver.DeviceId)
-	sent, err := d.Driver.SendSMS(message.Mobile, message.Body)
+	d.setSending(true)
+	defer d.setSending(false)
+
+	ref := d.Driver.ConcatReference
+	sent, refs, err := d.Driver.SendSMSWithOptions(d.gateway.sendCtx, message.Mobile, message.Body, message.sendOptions(d.Driver.StatusReports))
+
+	if ref != d.Driver.ConcatReference {
+		if err := d.gateway.updateConcatReference(d.Driver.DeviceId, d.Driver.ConcatReference); err != nil {
+			log.Println("DB error: ", err)
+		}
+	}
 
+	if parts := len(refs); sent || parts > 0 {
+		if parts == 0 {
+			parts = 1
+		}
+		d.countSent(parts)
+	}
+
+	if !sent && (!d.Driver.Connected() || d.gateway.sendCtx.Err() != nil) {
+		// modem was lost or sending was aborted on shutdown, attempt does
+		// not count as retry. Parts of long message which went out already
+		// are sent again as the whole message gets new concatenation
+		// reference, the recipient gets them twice but sees the message
+		// complete
+		d.requeue(message)
+		return
+	}
+
+	message.Error = ""
 	if sent == true {
 		message.Status = SMSProcessed
-	} else if err == nil {
+	} else if err == nil || modem.Retryable(err) {
 		message.Status = SMSPending
 	} else {
-		message.Status = SMSError
+		message.Status = SMSError // it would fail again, e.g. invalid number
+	}
+	d.countAttempt(message.Status == SMSPending)
+	if err != nil {
+		message.Error = err.Error()
+		log.Println("sending failed: ", message.UUID, d.Driver.DeviceId, err)
 	}
 
 	message.Device = d.Driver.DeviceId
 	message.Retries++
 
-	if err := updateOutgoingMessageStatus(message); err != nil {
-		log.Fatalln("DB error: ", err)
+	// loader may take the message again once database tells how it went
+	err = d.gateway.updateOutgoingMessageStatus(message)
+	d.gateway.release(message.UUID)
+	if err != nil {
+		log.Println("DB error: ", err)
+		return // message stays as it was in database, loader picks it up again
+	}
+
+	if sent && len(refs) > 0 {
+		if err := d.gateway.insertMessageReferences(message.UUID, d.Driver.DeviceId, refs); err != nil {
+			log.Println("DB error: ", err) // status reports of message are ignored
+		}
 	}
 
-	if message.Status != SMSProcessed && message.Retries < SMSRetryLimit {
+	if message.Status == SMSPending && message.Retries < SMSRetryLimit {
 		// push message back to queue until either it is sent successfully or
 		// retry count is reached
 		// I can't push it to channel directly. Doing so may cause the sms to be in
 		// the queue twice. I don't want that
-		EnqueueMessage(&message)
+		d.gateway.EnqueueMessage(&message)
+	}
+}
+
+// processStatusReports maps status reports back to sent messages, message is
+// delivered when all its parts are delivered and fails when any part fails
+func (d *Device) processStatusReports(reports []modem.StatusReport) {
+	for _, report := range reports {
+		if report.Pending() {
+			continue // service centre is still trying
+		}
+
+		status := SMSDelivered
+		if report.Expired() {
+			status = SMSExpired
+		} else if !report.Delivered() {
+			status = SMSRejected
+		}
+
+		uuid, delivered, err := d.gateway.updateMessageReference(d.Driver.DeviceId, report.Reference, status)
+		if err == sql.ErrNoRows {
+			log.Println("status report for unknown message: ", d.Driver.DeviceId, report.Reference)
+			continue
+		} else if err != nil {
+			log.Println("DB error: ", err)
+			continue
+		}
+
+		if status == SMSDelivered && !delivered {
+			continue // waiting for other parts
+		}
+
+		deliveredAt := report.Discharged
+		if deliveredAt.IsZero() {
+			deliveredAt = time.Now()
+		}
+
+		log.Println("delivery status: ", uuid, status)
+		if err := d.gateway.updateOutgoingMessageDelivery(uuid, status, deliveredAt); err != nil {
+			log.Println("DB error: ", err)
+		}
 	}
 }
 
 func (d *Device) pollMessages() {
 	log.Println("polling: ", d.Driver.DeviceId)
-	for _, message := range *d.Driver.ReadSMS() {
-		sms := IncomingSMS{
-			Device: d.Driver.DeviceId,
-			Mobile: message[0],
-			Body: message[1],
+	messages, undecoded := d.Driver.ListSMS()
+	var received []int
+	for _, message := range messages {
+		if err := d.receiveIncoming(message); err != nil {
+			log.Println("DB error: ", err)
+			continue
 		}
+		received = append(received, message.Index)
+	}
 
-		if err := insertIncomingMessage(&sms); err != nil {
-			log.Fatalln("DB error: ", err)
+	// read messages are deleted at once when all of them are stored, those
+	// which could not be decoded or stored stay in modem storage otherwise,
+	// so stored ones are deleted one by one
+	if len(received) > 0 && len(received) == len(messages) && undecoded == 0 {
+		err := d.Driver.DeleteReadSMS()
+		if err == nil {
+			received = nil
+		} else {
+			log.Println("deleting read messages failed: ", d.Driver.DeviceId, err)
 		}
+	}
+	for _, index := range received {
+		d.Driver.DeleteSMS(index)
+	}
+	d.checkStorage()
+}
 
-		go incomingNotice(sms)
+// receiveIncoming stores message read from modem, it can be deleted from
+// modem unless error is returned
+func (d *Device) receiveIncoming(message modem.IncomingMessage) error {
+	if message.Parts > 1 {
+		return d.receiveMessagePart(message)
 	}
+
+	return d.receiveMessage(IncomingSMS{
+		Device: d.Driver.DeviceId,
+		Mobile: message.Originator,
+		Name: message.Name,
+		Body: message.Body,
+		Index: message.Index,
+		Status: message.Status,
+		SentAt: formatTimestamp(message.Timestamp),
+	})
 }
 
-func incomingNotice(sms IncomingSMS) {
-	if smtpSettings.Enabled == false {
+func (d *Device) receiveMessage(sms IncomingSMS) error {
+	if err := d.gateway.insertIncomingMessage(&sms); err != nil {
+		return err
+	}
+
+	go d.gateway.incomingNotice(sms)
+	return nil
+}
+
+// receiveMessagePart buffers part of concatenated message in database and
+// delivers the message once all parts are there. Error is returned only
+// when the part was not stored, message which fails to assemble is left to
+// flushMessageParts
+func (d *Device) receiveMessagePart(message modem.IncomingMessage) error {
+	err := d.gateway.insertIncomingPart(d.Driver.DeviceId, message.Originator, message.Reference, message.Parts, message.Part, message.Body,
+		message.Name, formatTimestamp(message.Timestamp))
+	if err != nil {
+		return err
+	}
+
+	parts, err := d.gateway.getIncomingParts(d.Driver.DeviceId, message.Originator, message.Reference, message.Parts)
+	if err != nil {
+		log.Println("DB error: ", err)
+		return nil
+	}
+
+	if len(parts) < message.Parts {
+		log.Println("waiting for parts:", d.Driver.DeviceId, message.Originator, message.Reference, len(parts), "of", message.Parts)
+		return nil
+	}
+
+	set := incomingPartSet{Mobile: message.Originator, Reference: message.Reference, Total: message.Parts}
+	if err := d.assembleMessage(set, false); err != nil {
+		log.Println("DB error: ", err)
+	}
+	return nil
+}
+
+// flushInterval is how often parts are checked for timeout, a tenth of the
+// timeout but not more often than database time stamps change
+func flushInterval(timeout time.Duration) time.Duration {
+	if interval := timeout / 10; interval > time.Second {
+		return interval
+	}
+	return time.Second
+}
+
+// flushMessageParts delivers messages whose parts did not arrive in time
+func (d *Device) flushMessageParts() {
+	sets, err := d.gateway.getStaleIncomingParts(d.Driver.DeviceId, d.gateway.options.IncomingPartTimeout)
+	if err != nil {
+		log.Println("DB error: ", err)
+		return
+	}
+
+	for _, set := range sets {
+		log.Println("incomplete message timed out:", d.Driver.DeviceId, set.Mobile, set.Reference)
+		if err := d.assembleMessage(set, true); err != nil {
+			log.Println("DB error: ", err)
+		}
+	}
+}
+
+// assembleMessage stores message joined from its parts, parts are kept
+// when it fails
+func (d *Device) assembleMessage(set incomingPartSet, partial bool) error {
+	parts, err := d.gateway.getIncomingParts(d.Driver.DeviceId, set.Mobile, set.Reference, set.Total)
+	if err != nil {
+		return err
+	}
+
+	name, sentAt, err := d.gateway.getIncomingPartsSender(d.Driver.DeviceId, set.Mobile, set.Reference, set.Total)
+	if err != nil {
+		return err
+	}
+
+	err = d.receiveMessage(IncomingSMS{
+		Device: d.Driver.DeviceId,
+		Mobile: set.Mobile,
+		Name: name,
+		Body: strings.Join(parts, ""),
+		Partial: partial,
+		Index: -1,
+		SentAt: sentAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	// message is stored, leftover parts would only deliver it again
+	return d.gateway.deleteIncomingParts(d.Driver.DeviceId, set.Mobile, set.Reference, set.Total)
+}
+
+// formatTimestamp keeps timezone of service centre time stamp, empty when
+// modem did not give any
+func formatTimestamp(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func (g *Gateway) incomingNotice(sms IncomingSMS) {
+	g.sendNotice(fmt.Sprintf("SMS message from %s%s", sms.Mobile, partialNotice(sms)), sms.Body)
+}
+
+func (g *Gateway) callNotice(call IncomingCall) {
+	caller := call.Mobile
+	if caller == "" {
+		caller = "unknown number"
+	}
+	g.sendNotice(fmt.Sprintf("Missed call from %s", caller),
+		fmt.Sprintf("Missed call from %s on %s at %s", caller, call.Device, time.Now().Format("2006-01-02 15:04:05")))
+}
+
+func (g *Gateway) storageNotice(device string, storage DeviceStorage) {
+	g.sendNotice(fmt.Sprintf("SMS storage of %s is almost full", device),
+		fmt.Sprintf("Storage %s of %s holds %d of %d messages, new messages are not received when it is full",
+			storage.Storage, device, storage.Used, storage.Total))
+}
+
+// sendNotice mails notification to SMTP recipient when it is enabled
+func (g *Gateway) sendNotice(subject, body string) {
+	smtpSettings := g.options.SMTP
+	if smtpSettings == nil || smtpSettings.Enabled == false {
 		return
 	}
 
@@ -298,16 +880,23 @@ func incomingNotice(sms IncomingSMS) {
 			"To: %s\r\n" +
 			"Content-Type: text/plain; charset=\"utf-8\"\r\n" +
 			"Content-Transfer-Encoding: base64\r\n" +
-			"Subject: SMS message from %s\r\n" +
+			"Subject: %s\r\n" +
 			"\r\n" +
 			"%s",
 			smtpSettings.Sender,
 			smtpSettings.Recipient,
-			sms.Mobile,
-			base64.StdEncoding.EncodeToString([]byte(sms.Body)),
+			subject,
+			base64.StdEncoding.EncodeToString([]byte(body)),
 		)),
 	);
 	if err != nil {
 		log.Println("SMTP error: ", err)
 	}
-}
\ No newline at end of file
+}
+
+func partialNotice(sms IncomingSMS) string {
+	if sms.Partial {
+		return " (incomplete)"
+	}
+	return ""
+}
@@ -0,0 +1,164 @@
+package gosms
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haxpax/gosms/modem"
+	"github.com/haxpax/gosms/modem/simulator"
+)
+
+// waitIncoming waits until database has n incoming messages
+func waitIncoming(t *testing.T, g *Gateway, n int) []IncomingSMS {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		messages, err := g.GetIncomingMessages("ORDER BY id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) >= n {
+			return messages
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d incoming messages, want %d", len(messages), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGatewayIncomingMessages(t *testing.T) {
+	sim := simulator.New()
+	options := testOptions(t)
+	options.Drivers = []*modem.Driver{simDriver(t, "gsm0", sim)}
+	g := startGateway(t, options)
+
+	long := strings.Repeat("long message ", 20)
+	sim.Receive("+447700900123", "hello")
+	sim.Receive("+447700900124", long)
+
+	messages := waitIncoming(t, g, 2)
+	if len(messages) != 2 || messages[0].Body != "hello" || messages[0].Mobile != "+447700900123" ||
+		messages[1].Body != long || messages[1].Partial || messages[1].Device != "gsm0" {
+		t.Errorf("got %+v", messages)
+	}
+
+	// messages are deleted from modem once they are in database
+	time.Sleep(100 * time.Millisecond)
+	if sim.Stored() != 0 {
+		t.Errorf("%d messages left in storage", sim.Stored())
+	}
+}
+
+func TestGatewayStatusReport(t *testing.T) {
+	sim := simulator.New()
+	sim.ReportDelay = 50 * time.Millisecond
+	options := testOptions(t)
+	options.Drivers = []*modem.Driver{simDriver(t, "gsm0", sim)}
+	g := startGateway(t, options)
+
+	// device does not ask for reports, message does
+	report := true
+	if err := g.SendMessage(&OutgoingSMS{UUID: "report", Mobile: "+447700900123", Body: "hello", Report: &report}); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+	if message := waitStatus(t, g, "report", SMSDelivered); message.DeliveredAt == "" {
+		t.Errorf("got %+v", message)
+	}
+
+	sim.ReportStatus = 0x46 // validity period expired
+	if err := g.SendMessage(&OutgoingSMS{UUID: "expired", Mobile: "+447700900123", Body: "hello", Report: &report}); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+	waitStatus(t, g, "expired", SMSExpired)
+}
+
+func TestGatewayIncomingPartTimeout(t *testing.T) {
+	sim := simulator.New()
+	options := testOptions(t)
+	options.Drivers = []*modem.Driver{simDriver(t, "gsm0", sim)}
+	options.IncomingPartTimeout = time.Second
+	g := startGateway(t, options)
+
+	// second part never arrives, parts are flushed even though polling is
+	// disabled
+	sim.ReceivePDU(&modem.Deliver{Originator: "+447700900123", Timestamp: time.Now(), Text: "first half", UDH: modem.ConcatHeader(9, 2, 1, false)})
+
+	messages := waitIncoming(t, g, 1)
+	if len(messages) != 1 || messages[0].Body != "first half" || !messages[0].Partial {
+		t.Errorf("got %+v", messages)
+	}
+}
+
+func TestGatewayLostLongMessage(t *testing.T) {
+	sim := simulator.New()
+	options := testOptions(t)
+	options.Drivers = []*modem.Driver{simDriver(t, "gsm0", sim)}
+	g := startGateway(t, options)
+
+	text := strings.Repeat("long message ", 20)
+	if err := g.SendMessage(&OutgoingSMS{UUID: "first", Mobile: "+447700900123", Body: text}); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+	waitStatus(t, g, "first", SMSProcessed)
+	sent := sim.Sent()
+	if len(sent) != 2 {
+		t.Fatalf("simulator sent %d parts, want 2", len(sent))
+	}
+
+	// modem is lost after first part of the same message went out
+	sim.Script(simulator.Timeout(fmt.Sprintf("AT+CMGS=%d", len(sent[1].PDU)/2-1)))
+	if err := g.SendMessage(&OutgoingSMS{UUID: "lost", Mobile: "+447700900123", Body: text}); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sim.Sent()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	sim.Unplug()
+	time.Sleep(200 * time.Millisecond)
+	sim.Reset()
+	sim.Plug()
+
+	// whole message is sent again under new reference, so the first part
+	// arrives twice
+	if message := waitStatus(t, g, "lost", SMSProcessed); message.Retries != 1 {
+		t.Errorf("got %+v", message)
+	}
+	sent = sim.Sent()
+	if len(sent) != 5 || sent[2].Text != sent[3].Text || bytes.Equal(sent[2].UDH, sent[3].UDH) {
+		t.Errorf("simulator sent %+v", sent)
+	}
+}
+
+func TestGatewayPollDeletesRead(t *testing.T) {
+	sim := simulator.New()
+	options := testOptions(t)
+	options.Drivers = []*modem.Driver{simDriver(t, "gsm0", sim)}
+	g := startGateway(t, options)
+
+	// announced messages can not be read, so they are polled, read ones
+	// are deleted at once and deleting single message is never needed
+	sim.Script(simulator.Fail("AT+CMGR", "ERROR"), simulator.Fail("AT+CMGD=2", "ERROR"))
+	sim.Receive("+447700900123", "one")
+	sim.Receive("+447700900123", "two")
+	waitIncoming(t, g, 2)
+	time.Sleep(100 * time.Millisecond)
+	if sim.Stored() != 0 {
+		t.Errorf("%d messages left in storage", sim.Stored())
+	}
+
+	// modem which can not delete read messages deletes them one by one
+	sim.Script(simulator.Fail("AT+CMGD=1,1", "ERROR"))
+	sim.Receive("+447700900123", "three")
+	waitIncoming(t, g, 3)
+	time.Sleep(100 * time.Millisecond)
+	if sim.Stored() != 0 {
+		t.Errorf("%d messages left in storage", sim.Stored())
+	}
+}